@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// adaptiveLimiter bounds the number of transfers (uploads and download
+// connections) in flight at once, adjusting the bound AIMD-style: it is
+// halved whenever B2 says it is too busy, and raised by one after as many
+// successful transfers as the current bound. It stays within [min, max].
+// A nil adaptiveLimiter doesn't limit anything.
+type adaptiveLimiter struct {
+	min, max int
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	limit     int
+	active    int
+	successes int
+}
+
+func newAdaptiveLimiter(min, max int) *adaptiveLimiter {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+
+	l := &adaptiveLimiter{min: min, max: max, limit: max}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// isThrottled reports whether err means B2 wants fewer requests: too many
+// requests, or too busy to take this one.
+func isThrottled(err error) bool {
+	b2err, ok := err.(*backblaze.B2Error)
+	return ok && (b2err.Status == 429 || b2err.Status == 503)
+}
+
+// do waits for a free slot, then calls fn and adjusts the bound according
+// to how it went.
+func (l *adaptiveLimiter) do(fn func() error) error {
+	if l == nil {
+		return fn()
+	}
+
+	l.mu.Lock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+	l.mu.Unlock()
+
+	err := fn()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+	switch {
+	case isThrottled(err):
+		l.successes = 0
+		if l.limit > l.min {
+			l.limit /= 2
+			if l.limit < l.min {
+				l.limit = l.min
+			}
+			debugf("B2 is throttling transfers, lowering concurrency to %v", l.limit)
+		}
+	case err == nil:
+		l.successes++
+		if l.successes >= l.limit && l.limit < l.max {
+			l.successes = 0
+			l.limit++
+			debugf("raising concurrency to %v", l.limit)
+		}
+	}
+	l.cond.Broadcast()
+
+	return err
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/url"
+	"os/exec"
+	"strings"
+)
+
+// For audit trails, Store can record the state of the repository an object
+// was stored from: the commit checked out (with recordcommit=yes), and a
+// freeform tag (with uploadtag=...), each as file info on the object.
+
+const (
+	gitHeadInfoKey = "git_head"
+	tagInfoKey     = "tag"
+)
+
+// gitHead returns the commit checked out in the repository the remote is
+// run from, or "" if there isn't one.
+func gitHead() string {
+	out, err := exec.Command("git", "rev-parse", "--verify", "-q", "HEAD").Output()
+	if err != nil {
+		debugf("couldn't find the HEAD commit: %v", err)
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// tagInfo returns the tag attribute for the uploadtag setting.
+func tagInfo(tag string) string {
+	return url.QueryEscape(tag)
+}
+
+// setInfo sets name to value in info, allocating info if needed, and
+// returns it.
+func setInfo(info map[string]string, name, value string) map[string]string {
+	if info == nil {
+		info = make(map[string]string)
+	}
+	info[name] = value
+	return info
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// reauthMinInterval keeps concurrent operations that all hit an expired
+// token at once from each re-authorizing.
+const reauthMinInterval = time.Minute
+
+// session is the authorized B2 client shared by every bucket handle, so
+// that re-authorizing it once refreshes the token for all of them.
+type session struct {
+	b2    *backblaze.B2
+	raw   *rawAPI
+	pacer *requestPacer
+	lists listLimiter
+	clock clock
+
+	mu         sync.Mutex
+	authorized time.Time
+}
+
+func newSession(b2 *backblaze.B2, creds backblaze.Credentials) *session {
+	c := realClock{}
+	return &session{
+		b2:         b2,
+		raw:        newRawAPI(creds),
+		clock:      c,
+		authorized: c.Now(),
+	}
+}
+
+// isExpiredAuth reports whether err means the authorization token is no
+// longer valid (B2 tokens last about 24 hours.)
+func isExpiredAuth(err error) bool {
+	b2err, ok := err.(*backblaze.B2Error)
+	if !ok || b2err.Status != 401 {
+		return false
+	}
+	return b2err.Code == "expired_auth_token" || b2err.Code == "bad_auth_token"
+}
+
+// reauthorize gets a new authorization token with the credentials the
+// session was created with, unless that was just done.
+func (s *session) reauthorize() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if since(s.clock, s.authorized) < reauthMinInterval {
+		return nil
+	}
+
+	debugf("authorization token expired, re-authorizing")
+	err := s.b2.AuthorizeAccount()
+	if err != nil {
+		if isClockSkew(err) {
+			return clockSkewError(err)
+		}
+		return err
+	}
+	s.authorized = s.clock.Now()
+	return nil
+}
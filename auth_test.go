@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A token that expires partway through a long session is replaced, and the
+// request that found it expired made again, whether it went through
+// go-backblaze or the raw API.
+func TestExpiredTokenMidSession(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f)
+
+	data := []byte("stored before the token expired")
+	key := testKey(data)
+	err := be.Store(nil, key, writeTestFile(t, data))
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	// A day later, the token has expired.
+	be.bucket.session.authorized = time.Now().Add(-24 * time.Hour)
+	be.bucket.clearListFileCache()
+	authorizations := f.callCount("b2_authorize_account")
+
+	f.fail("b2_list_file_names", 401, "expired_auth_token")
+	present, err := be.CheckPresent(nil, key)
+	if err != nil || !present {
+		t.Fatalf("CheckPresent = %v, %v; want true, nil", present, err)
+	}
+
+	f.fail("download", 401, "expired_auth_token")
+	file := filepath.Join(t.TempDir(), "retrieved")
+	err = be.Retrieve(nil, key, file)
+	if err != nil {
+		t.Fatalf("Retrieve: %v", err)
+	}
+	got, err := ioutil.ReadFile(file)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("retrieved %q (%v); want %q", got, err, data)
+	}
+
+	if n := f.callCount("b2_authorize_account") - authorizations; n < 2 {
+		t.Errorf("re-authorized %v times; want once for each API", n)
+	}
+}
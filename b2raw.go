@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+const b2APIHost = "https://api.backblazeb2.com"
+
+// rawAPI makes B2 API calls that go-backblaze doesn't provide. It keeps its
+// own authorization, obtained lazily on first use, and sends requests
+// through http.DefaultTransport like go-backblaze does, so it shares the
+// same TLS settings.
+type rawAPI struct {
+	creds backblaze.Credentials
+
+	mu   sync.Mutex
+	auth *authorizeResponse
+}
+
+type authorizeResponse struct {
+	AccountID               string `json:"accountId"`
+	AuthorizationToken      string `json:"authorizationToken"`
+	APIURL                  string `json:"apiUrl"`
+	DownloadURL             string `json:"downloadUrl"`
+	RecommendedPartSize     int64  `json:"recommendedPartSize"`
+	AbsoluteMinimumPartSize int64  `json:"absoluteMinimumPartSize"`
+	Allowed                 struct {
+		Capabilities []string `json:"capabilities"`
+		BucketID     string   `json:"bucketId"`
+		BucketName   string   `json:"bucketName"`
+		NamePrefix   *string  `json:"namePrefix"`
+	} `json:"allowed"`
+}
+
+// rawFile is a file as listed by b2_list_file_names. Unlike go-backblaze's
+// listings, it includes the file's SHA1 and info.
+type rawFile struct {
+	FileID        string            `json:"fileId"`
+	FileName      string            `json:"fileName"`
+	ContentLength int64             `json:"contentLength"`
+	ContentSha1   string            `json:"contentSha1"`
+	FileInfo      map[string]string `json:"fileInfo"`
+
+	// Action is "upload" for a file's content; see isUpload.
+	Action string `json:"action"`
+
+	// UploadTimestamp is when the file was uploaded, in milliseconds since
+	// the Unix epoch.
+	UploadTimestamp int64 `json:"uploadTimestamp"`
+}
+
+// sha1 returns the hex SHA1 of the file's content, or "" if B2 doesn't
+// know it, like contentSHA1.
+func (f rawFile) sha1() string {
+	sha, _ := parseContentSHA1(f.ContentSha1, f.FileInfo)
+	return sha
+}
+
+// isUpload reports whether f is a file's content, rather than the marker
+// left by hiding it (as Remove does with keepversions) or some other
+// non-file entry. b2_list_file_names only lists a file's latest version,
+// and leaves out hidden files, but presence mustn't depend on that alone:
+// a key whose latest version is a hide marker is absent, however many of
+// its older versions linger.
+func (f rawFile) isUpload() bool {
+	return f.Action == "" || f.Action == "upload"
+}
+
+// rawFileList is a page of b2_list_file_names results.
+type rawFileList struct {
+	Files        []rawFile `json:"files"`
+	NextFileName *string   `json:"nextFileName"`
+}
+
+func newRawAPI(creds backblaze.Credentials) *rawAPI {
+	return &rawAPI{creds: creds}
+}
+
+// decodeResponse decodes a B2 response into out, or returns the
+// *backblaze.B2Error it describes.
+func decodeResponse(resp *http.Response, out interface{}) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		b2err := &backblaze.B2Error{}
+		if json.Unmarshal(body, b2err) != nil || b2err.Status == 0 {
+			b2err.Status = resp.StatusCode
+			b2err.Message = string(body)
+		}
+		return b2err
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// authorization returns the current authorization, getting one if needed.
+func (r *rawAPI) authorization() (*authorizeResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.auth != nil {
+		return r.auth, nil
+	}
+
+	req, err := http.NewRequest("GET", b2APIHost+"/b2api/v2/b2_authorize_account", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(r.creds.AccountID, r.creds.ApplicationKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	auth := &authorizeResponse{}
+	err = decodeResponse(resp, auth)
+	if err != nil {
+		return nil, err
+	}
+	addSecret(auth.AuthorizationToken)
+
+	r.auth = auth
+	return auth, nil
+}
+
+func (r *rawAPI) forgetAuthorization(auth *authorizeResponse) {
+	r.mu.Lock()
+	if r.auth == auth {
+		r.auth = nil
+	}
+	r.mu.Unlock()
+}
+
+// call POSTs the JSON encoding of in to the named B2 API and decodes the
+// response into out. An expired token is replaced and the call tried again.
+func (r *rawAPI) call(api string, in, out interface{}) error {
+	return r.callTimeout(api, in, out, 0)
+}
+
+// callTimeout is like call, but gives up on each request after timeout (if
+// it's not 0.)
+func (r *rawAPI) callTimeout(api string, in, out interface{}, timeout time.Duration) error {
+	client := http.DefaultClient
+	if timeout > 0 {
+		client = &http.Client{Timeout: timeout}
+	}
+
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		auth, err := r.authorization()
+		if err != nil {
+			if isClockSkew(err) {
+				err = clockSkewError(err)
+			}
+			return fmt.Errorf("couldn't authorize: %v", err)
+		}
+
+		req, err := http.NewRequest("POST", auth.APIURL+"/b2api/v2/"+api, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", auth.AuthorizationToken)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		err = decodeResponse(resp, out)
+		resp.Body.Close()
+
+		if isExpiredAuth(err) && attempt == 0 {
+			r.forgetAuthorization(auth)
+			continue
+		}
+		return err
+	}
+}
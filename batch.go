@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// For rolling back a bad bulk import or migration, Store can tag each
+// object it uploads with a batch ID (batchid=..., or $B2_BATCHID for a
+// single run), as file info. The removebatch maintenance command then
+// finds every key tagged with a given ID and removes it. B2 can't list by
+// file info, so finding them takes a listing of the whole prefix.
+
+// batchInfoKey is the file info attribute holding an object's batch ID.
+const batchInfoKey = "batch_id"
+
+// getBatchID reads the batch ID to tag stored objects with: $B2_BATCHID if
+// it's set, and otherwise the batchid setting.
+func getBatchID(e configSource) (string, error) {
+	if id := os.Getenv("B2_BATCHID"); id != "" {
+		return id, nil
+	}
+	return e.GetConfig("batchid")
+}
+
+// batchInfo returns the batch_id attribute for batch ID id.
+func batchInfo(id string) string {
+	return url.QueryEscape(id)
+}
+
+// batchKeys calls fn with each key in bh tagged with batch ID id, and the
+// size of its object.
+func (be *B2Ext) batchKeys(bh *bucketHandle, id string, fn func(key string, size int64) error) error {
+	want := batchInfo(id)
+	return bh.listNamesWithInfo(be.prefix, func(f rawFile) error {
+		key, ok := keyInPrefix(be.prefix, f.FileName)
+		if !ok || f.FileInfo[batchInfoKey] != want {
+			return nil
+		}
+		return fn(key, f.ContentLength)
+	})
+}
+
+func runRemoveBatch(be *B2Ext, config argsConfig, args []string) error {
+	dryRun := hasFlag(args, "--dry-run")
+	var ids []string
+	for _, arg := range args {
+		if arg != "--dry-run" {
+			ids = append(ids, arg)
+		}
+	}
+	if len(ids) != 1 || ids[0] == "" {
+		return errors.New("usage: removebatch <batch id> [--dry-run]")
+	}
+	id := ids[0]
+
+	if be.cas {
+		return errors.New("objects aren't tagged with batch IDs with cas=yes, since they're shared between keys")
+	}
+
+	var keys []string
+	var sizes []int64
+	var total int64
+	err := be.batchKeys(be.bucket, id, func(key string, size int64) error {
+		keys = append(keys, key)
+		sizes = append(sizes, size)
+		total += size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		for i, key := range keys {
+			fmt.Printf("%v\t%d\n", key, sizes[i])
+		}
+		fmt.Printf("%v keys (%v) were stored in batch %#v\n", len(keys), formatBytes(total), id)
+		return nil
+	}
+
+	progress := newBatchProgress("Removing batch "+id, len(keys))
+	for i, key := range keys {
+		debugf("removing %v of batch %v", key, id)
+
+		err = be.removeEverywhere(key)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("removed\t%v\n", key)
+
+		progress.add(sizes[i])
+	}
+	progress.finish()
+
+	infof("removed %v keys of batch %#v; run git annex fsck --from on this remote so git-annex knows", len(keys), id)
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"time"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// With bloom=yes, Prepare lists every presence object once and builds a
+// bloom filter of their names, and CheckPresent consults it before asking
+// B2: a name the filter doesn't contain isn't present, so a run checking
+// many absent keys (fsck, or get from several remotes) costs one listing
+// pass instead of a listing per key. A name the filter may contain is still
+// checked for real. Stores add to the filter, and removals can leave it
+// claiming a name is there, which only costs a precise check. Keys stored
+// by other processes after the filter was built aren't in it, so it's only
+// for runs that aren't racing other writers to the same remote.
+
+const defaultBloomFPRate = 0.01
+
+type bloomFilter struct {
+	bits []uint64
+	k    uint64
+}
+
+// newBloomFilter returns a filter sized for n names with the given false
+// positive rate.
+func newBloomFilter(n int, fpRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(n)*math.Ln2))
+	return &bloomFilter{
+		bits: make([]uint64, (uint64(m)+63)/64),
+		k:    uint64(k),
+	}
+}
+
+// positions calls fn with each bit position for name, by double hashing.
+func (bf *bloomFilter) positions(name string, fn func(uint64)) {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	h1 := h.Sum64()
+	h2 := h1>>33 | h1<<31 | 1
+
+	nbits := uint64(len(bf.bits)) * 64
+	for i := uint64(0); i < bf.k; i++ {
+		fn((h1 + i*h2) % nbits)
+	}
+}
+
+func (bf *bloomFilter) add(name string) {
+	if bf == nil {
+		return
+	}
+	bf.positions(name, func(bit uint64) {
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	})
+}
+
+// mayContain reports false only if name was never added. A nil filter may
+// contain anything.
+func (bf *bloomFilter) mayContain(name string) bool {
+	if bf == nil {
+		return true
+	}
+	found := true
+	bf.positions(name, func(bit uint64) {
+		found = found && bf.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+	return found
+}
+
+// getFPRateConfig reads bloomfprate, a false positive rate strictly
+// between 0 and 1.
+func getFPRateConfig(e configSource) (float64, error) {
+	value, err := e.GetConfig("bloomfprate")
+	if err != nil {
+		return 0, err
+	}
+	if value == "" {
+		return defaultBloomFPRate, nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate <= 0 || rate >= 1 {
+		return 0, fmt.Errorf("bloomfprate must be between 0 and 1, not %#v", value)
+	}
+	return rate, nil
+}
+
+// presencePrefixes returns the prefixes under which presence objects (see
+// presenceName) are stored.
+func (be *B2Ext) presencePrefixes() []string {
+	if be.cas {
+		return []string{be.casIndexName("")}
+	}
+	return []string{be.prefix}
+}
+
+// buildBloom lists every presence object in bh and sets bh.bloom to a
+// filter of their names.
+func (be *B2Ext) buildBloom(bh *bucketHandle) error {
+	start := time.Now()
+
+	var names []string
+	for _, prefix := range be.presencePrefixes() {
+		err := bh.listNames(prefix, func(f backblaze.FileStatus) error {
+			if _, ok := keyInPrefix(prefix, f.Name); !be.cas && !ok {
+				return nil
+			}
+			names = append(names, f.Name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	bf := newBloomFilter(len(names), be.bloomFPRate)
+	for _, name := range names {
+		bf.add(name)
+	}
+	bh.bloom = bf
+
+	debugf("built a bloom filter of %v names (%v bytes) in %v",
+		len(names), len(bf.bits)*8, time.Since(start))
+	return nil
+}
@@ -0,0 +1,1073 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// bucketHandle is an opened B2 bucket along with the per-bucket state we
+// keep about it.
+type bucketHandle struct {
+	*backblaze.Bucket
+	name string
+
+	// keepVersions makes overwrites and removals leave the old versions in
+	// B2 (hidden) instead of deleting them.
+	keepVersions bool
+
+	// keepStaleOnDeleteFailure makes store succeed even if it can't delete
+	// the old, wrong version of a file after uploading the new one.
+	keepStaleOnDeleteFailure bool
+
+	// listPageSize is the number of names requested per listing call.
+	listPageSize int
+
+	// verifyAfterStore makes store download the start of each object it
+	// uploads, to confirm it landed.
+	verifyAfterStore bool
+
+	// listCacheTTL is how long the result of listFileCached is reused, or 0
+	// to not reuse it at all.
+	listCacheTTL time.Duration
+
+	// strictNames makes listFileCached fail when the listing turns up a
+	// longer name starting with the requested one, instead of taking it as
+	// a sign the requested name isn't there.
+	strictNames bool
+
+	// presenceVersions makes listFileCached list file versions rather
+	// than names (see presencesource.go).
+	presenceVersions bool
+
+	// hashAtEnd makes store hash files as they're uploaded, where it can
+	// (see hashatend.go).
+	hashAtEnd bool
+
+	// copyParts makes large file uploads copy parts already in the bucket
+	// instead of uploading them, using the parts index under partsPrefix
+	// (see copypart.go).
+	copyParts   bool
+	partsPrefix string
+
+	// partSizer sizes the parts of large files.
+	partSizer *partSizer
+
+	// packs holds the small keys packed together with pack=yes (see
+	// pack.go), or is nil.
+	packs *packer
+
+	// publishPrefix, if set, is where store uploads objects before copying
+	// them to their real names (see publish.go).
+	publishPrefix string
+
+	// indexCompression is the compression ("gzip" or "zstd") applied to
+	// internal objects written with putSmall, or "" for none (see
+	// compressSidecar).
+	indexCompression string
+
+	// bloom, if not nil, holds the names of the presence objects in the
+	// bucket (see bloom.go).
+	bloom *bloomFilter
+
+	session *session
+	retry   *retrier
+	limiter *adaptiveLimiter
+	clock   clock
+	metrics *metrics
+
+	// downloads makes the bucket's downloads; it's the bucket itself,
+	// except in tests.
+	downloads downloader
+
+	lastList struct {
+		setAt time.Time
+		file  string
+		found bool
+		id    string
+		sha   string
+		key   string
+	}
+}
+
+func openBucket(s *session, bucketName string, canCreateBucket bool) (*bucketHandle, error) {
+	b2 := s.b2
+	bucket, err := b2.Bucket(bucketName)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open bucket %#v: %v", bucketName, err)
+	}
+
+	if bucket == nil {
+		if !canCreateBucket {
+			return nil, s.missingBucketError(bucketName)
+		}
+
+		infof("Creating private B2 bucket %#v", bucketName)
+
+		bucket, err = createBucket(s, bucketName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &bucketHandle{
+		Bucket:       bucket,
+		name:         bucketName,
+		listPageSize: defaultListPageSize,
+		listCacheTTL: defaultListCacheTTL,
+		session:      s,
+		clock:        realClock{},
+		downloads:    bucket,
+	}, nil
+}
+
+// downloader is the part of *backblaze.Bucket that downloads files.
+type downloader interface {
+	DownloadFileByName(name string) (*backblaze.File, io.ReadCloser, error)
+	DownloadFileRangeByName(name string, fileRange *backblaze.FileRange) (*backblaze.File, io.ReadCloser, error)
+}
+
+// createBucket creates the private bucket name. Another process (such as a
+// concurrent initremote) may create it first, in which case that bucket is
+// used; either way, the bucket is looked up again afterwards to make sure
+// it's the one that exists.
+func createBucket(s *session, name string) (*backblaze.Bucket, error) {
+	b2 := s.b2
+	created, err := b2.CreateBucket(name, backblaze.AllPrivate)
+	if err != nil {
+		b2err, ok := err.(*backblaze.B2Error)
+		if !ok || b2err.Code != "duplicate_bucket_name" {
+			return nil, fmt.Errorf("couldn't create bucket %#v: %v", name, err)
+		}
+		debugf("bucket %#v already exists; opening it instead", name)
+		created = nil
+	}
+
+	bucket, err := b2.Bucket(name)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open bucket %#v after creating it: %v", name, err)
+	}
+	if bucket == nil || bucket.BucketInfo == nil {
+		if created == nil {
+			return nil, s.takenBucketError(name)
+		}
+		return nil, fmt.Errorf("created bucket %#v, but it can't be found", name)
+	}
+
+	if created != nil && created.BucketInfo != nil && created.ID != bucket.ID {
+		return nil, fmt.Errorf("bucket %#v was replaced by another bucket while it was being created", name)
+	}
+	if created == nil && bucket.BucketType != backblaze.AllPrivate {
+		fmt.Fprintf(os.Stderr, "Warning: bucket %#v was created elsewhere meanwhile, and is %v rather than private\n",
+			name, bucket.BucketType)
+	}
+
+	return bucket, nil
+}
+
+// call makes one logical B2 request, retrying it as needed and recording
+// each attempt in the metrics. If the authorization token has expired, the
+// session is re-authorized and the request made once more.
+func (bh *bucketHandle) call(op string, fn func() error) error {
+	attempt := func() error {
+		return bh.retry.do(op, func() error {
+			if bh.session != nil {
+				bh.session.pacer.wait()
+			}
+			start := bh.clock.Now()
+			err := fn()
+			bh.metrics.observeRequest(op, since(bh.clock, start), err)
+			logOp(op, "", "", 0, since(bh.clock, start), err)
+			return err
+		})
+	}
+
+	err := attempt()
+	if !isExpiredAuth(err) || bh.session == nil {
+		return err
+	}
+
+	reauthErr := bh.session.reauthorize()
+	if reauthErr != nil {
+		return fmt.Errorf("%v (and couldn't re-authorize: %v)", err, reauthErr)
+	}
+	return attempt()
+}
+
+// transfer is like call, for requests that move object data: each attempt
+// waits its turn with the adaptive concurrency limiter, if there is one.
+func (bh *bucketHandle) transfer(op string, fn func() error) error {
+	return bh.call(op, func() error {
+		return bh.limiter.do(fn)
+	})
+}
+
+// list is like call, for listing requests: each attempt waits its turn
+// with the session's limit on concurrent listings.
+func (bh *bucketHandle) list(op string, fn func() error) error {
+	return bh.call(op, func() error {
+		if bh.session == nil {
+			return fn()
+		}
+		return bh.session.lists.do(fn)
+	})
+}
+
+// isPublic reports whether files in the bucket can be downloaded without
+// authorization.
+func (bh *bucketHandle) isPublic() bool {
+	return bh.BucketInfo != nil && bh.BucketType == backblaze.AllPublic
+}
+
+func (bh *bucketHandle) listFileCached(file string) (found bool, fileID string, err error) {
+	found, fileID, _, err = bh.lookupFile(file)
+	return found, fileID, err
+}
+
+// lookupFile is like listFileCached, and also returns the file's SHA1 (in
+// hex), or "" if B2 doesn't know it or hasn't verified it.
+func (bh *bucketHandle) lookupFile(file string) (found bool, fileID, sha string, err error) {
+	// Caching the last result of ListFileNames is no less safe than not caching
+	// it; the race condition of two concurrent git annex copy --to b2 processes
+	// sending the same file can result in a file with two identical versions in
+	// both cases.
+	//
+	// However, caching this reduces the number of ListFileNames to half of what
+	// it is during uploads (since git-annex always calls checkpresent which
+	// uses ListFileNames before uploading, but when uploading we also do
+	// upload elision by calling ListFileNames.)
+
+	if bh.listCacheTTL <= 0 || bh.lastList.file != file || since(bh.clock, bh.lastList.setAt) > bh.listCacheTTL {
+		// The listing goes through the raw API, whose listings include
+		// each file's SHA1, so that store can skip an upload without
+		// asking B2 anything more.
+		var res rawFileList
+		var err error
+		if bh.presenceVersions {
+			res, err = bh.listLatestVersion(file)
+		} else {
+			err = bh.list("list filenames", func() error {
+				return bh.session.raw.call("b2_list_file_names", map[string]interface{}{
+					"bucketId":      bh.ID,
+					"startFileName": file,
+					"maxFileCount":  1,
+				}, &res)
+			})
+		}
+		if err != nil {
+			return false, "", "", err
+		}
+
+		// Only an exact match counts. The listing starts at file, so the
+		// first name may be one that merely sorts after it.
+		if bh.strictNames && len(res.Files) > 0 && res.Files[0].FileName != file &&
+			strings.HasPrefix(res.Files[0].FileName, file) {
+			return false, "", "", fmt.Errorf("looking for %#v, found %#v instead; "+
+				"is another remote or tool storing objects under the same prefix?", file, res.Files[0].FileName)
+		}
+
+		bh.lastList.setAt = bh.clock.Now()
+		if len(res.Files) == 0 || res.Files[0].FileName != file || !res.Files[0].isUpload() {
+			bh.lastList.file = file
+			bh.lastList.found = false
+			bh.lastList.id = ""
+			bh.lastList.sha = ""
+			bh.lastList.key = ""
+		} else {
+			// Only a verified SHA1 is kept, so that store looks closer at
+			// unverified ones.
+			f := res.Files[0]
+			sha, verified := parseContentSHA1(f.ContentSha1, f.FileInfo)
+			if !verified {
+				sha = ""
+			}
+			bh.lastList.file = file
+			bh.lastList.found = true
+			bh.lastList.id = f.FileID
+			bh.lastList.sha = sha
+			bh.lastList.key = foldedKeyInfo(f.FileInfo)
+		}
+	}
+
+	return bh.lastList.found, bh.lastList.id, bh.lastList.sha, nil
+}
+
+// lookupKey is like listFileCached, and also returns the key recorded in
+// the file's info (see casefold.go), or "" if none is.
+func (bh *bucketHandle) lookupKey(file string) (found bool, key string, err error) {
+	found, _, _, err = bh.lookupFile(file)
+	return found, bh.lastList.key, err
+}
+
+// fetchable reports whether file can actually be downloaded, by downloading
+// its first byte. Unlike a listing, this can't be fooled by a stale listing
+// or a hidden file's marker.
+func (bh *bucketHandle) fetchable(file string) (bool, error) {
+	err := bh.call("download file", func() error {
+		_, body, err := bh.downloads.DownloadFileRangeByName(file, &backblaze.FileRange{Start: 0, End: 0})
+		if err != nil {
+			return err
+		}
+		if body == nil {
+			return fmt.Errorf("no data returned for %#v", file)
+		}
+		return body.Close()
+	})
+	if err != nil {
+		if b2err, ok := err.(*backblaze.B2Error); ok && b2err.Status == 416 {
+			// The file exists, but is empty.
+			return true, nil
+		}
+		if classifyError(err) == errorNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// verifyStored downloads the first byte of name to make sure it can be
+// retrieved, and that B2 has sha (in hex) as its SHA1.
+func (bh *bucketHandle) verifyStored(name, sha string) error {
+	var b2file *backblaze.File
+	err := bh.call("download file range", func() error {
+		var (
+			body io.ReadCloser
+			err  error
+		)
+		b2file, body, err = bh.downloads.DownloadFileRangeByName(name, &backblaze.FileRange{Start: 0, End: 0})
+		if b2err, ok := err.(*backblaze.B2Error); ok && b2err.Status == 416 {
+			// The file is empty, so there's no first byte to get.
+			b2file, body, err = bh.downloads.DownloadFileByName(name)
+		}
+		if body != nil {
+			defer body.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if body == nil {
+			return fmt.Errorf("no data returned for %#v", name)
+		}
+		_, err = io.Copy(ioutil.Discard, body)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't download %#v after storing it: %v", name, err)
+	}
+
+	if b2file == nil || contentSHA1(b2file) != sha {
+		got := ""
+		if b2file != nil {
+			got = contentSHA1(b2file)
+		}
+		return fmt.Errorf("stored %#v, but downloading it shows SHA1 %#v instead of %v", name, got, sha)
+	}
+	return nil
+}
+
+func (bh *bucketHandle) clearListFileCache() {
+	bh.lastList.setAt = time.Time{}
+	bh.lastList.file = ""
+	bh.lastList.found = false
+	bh.lastList.id = ""
+	bh.lastList.sha = ""
+	bh.lastList.key = ""
+}
+
+// noProgress is a progress wrapper for transfers that aren't reported to
+// git-annex.
+func noProgress(r io.Reader) io.Reader {
+	return r
+}
+
+// store uploads the contents of fh as name, with file info info, unless the
+// bucket already holds a version of name with the same SHA1. hashed blocks
+// until the SHA1 and length of fh are known, after which fh must be
+// positioned at its start. progress wraps the reader the upload reads from.
+func (bh *bucketHandle) store(name string, fh io.ReadSeeker, info map[string]string,
+	progress func(io.Reader) io.Reader, hashed func() ([]byte, int64, error)) error {
+
+	found, fileID, listedSHA, err := bh.lookupFile(name)
+	if err != nil {
+		return fmt.Errorf("couldn't list filenames: %v", err)
+	}
+
+	// staleID is the ID of an existing version with the wrong contents, which
+	// is deleted once the new version has safely landed.
+	var staleID string
+
+	if found && listedSHA != "" {
+		// The listing (usually cached from the CHECKPRESENT before this)
+		// has the SHA1 to compare against, so a key that's already there
+		// costs no requests at all.
+		haveSHA, _, err := hashed()
+		if err != nil {
+			return err
+		}
+		if hex.EncodeToString(haveSHA) == listedSHA {
+			return nil
+		}
+		if !bh.keepVersions {
+			staleID = fileID
+		}
+	} else if found {
+		// file probably already stored; make sure using the SHA1
+		var b2file *backblaze.File
+		err := bh.call("get file info", func() (err error) {
+			b2file, err = bh.GetFileInfo(fileID)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't get file info for %#v: %v", fileID, err)
+		}
+		if b2file != nil {
+			haveSHA, _, err := hashed()
+			if err != nil {
+				return err
+			}
+
+			sha, verified := parseContentSHA1(b2file.ContentSha1, b2file.FileInfo)
+			wantSHA, err := hex.DecodeString(sha)
+			if err == nil && bytes.Equal(haveSHA, wantSHA) {
+				// File already exists with correct data. If B2 never
+				// verified its SHA1, it's uploaded again so that B2 does,
+				// unless hashatend would just leave it unverified again.
+				if verified || bh.hashAtEnd {
+					return nil
+				}
+				debugf("%#v has an unverified SHA1; uploading it again to have B2 verify it", name)
+			} else if sha == "" {
+				debugf("%#v has no SHA1 to compare; uploading it again to give it one", name)
+			}
+
+			// File exists but is the incorrect data. B2 will keep the old
+			// version around unless we delete it (unless that's what the
+			// user asked for.)
+			if !bh.keepVersions {
+				staleID = b2file.ID
+			}
+		}
+	}
+
+	// With hashatend, a file small enough for one upload is hashed while
+	// it's uploaded, instead of beforehand.
+	streamLength := int64(-1)
+	if bh.hashAtEnd {
+		streamLength, err = fh.Seek(0, 2)
+		if err == nil {
+			_, err = fh.Seek(0, 0)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// With atomicpublish, a single-part upload goes to a temporary name
+	// first (see publish.go). Large files need no such thing; they only
+	// appear once finished.
+	uploadName := name
+	if bh.publishPrefix != "" {
+		uploadName, err = bh.publishingName()
+		if err != nil {
+			return err
+		}
+	}
+
+	var haveSHA []byte
+	var uploaded *backblaze.File
+	var uploadedID string
+	if streamLength >= 0 && streamLength <= largeFileThreshold {
+		haveSHA, uploadedID, err = bh.storeHashAtEnd(uploadName, fh, streamLength, info, progress)
+	} else {
+		var contentLength int64
+		haveSHA, contentLength, err = hashed()
+		if err != nil {
+			return err
+		}
+
+		// The upload starts from wherever fh is; hashing must have left it
+		// at the start.
+		pos, seekErr := fh.Seek(0, 1)
+		if seekErr != nil {
+			return fmt.Errorf("couldn't seek in local file before uploading: %v", seekErr)
+		}
+		if pos != 0 {
+			return fmt.Errorf("local file is at offset %v instead of its start before uploading", pos)
+		}
+
+		if contentLength > largeFileThreshold {
+			uploadName = name
+			err = bh.storeLarge(name, fh, info, progress, haveSHA, contentLength)
+		} else {
+			first := true
+			err = bh.transfer("upload file", func() error {
+				if !first {
+					_, err := fh.Seek(0, 0)
+					if err != nil {
+						return err
+					}
+				}
+				first = false
+
+				// The HTTP client closes a request body that can be
+				// closed, and without a progress wrapper that would be fh
+				// itself, which retries (and the mirror) still need.
+				body := struct{ io.Reader }{bh.metrics.uploadCounter(progress(fh))}
+
+				var err error
+				uploaded, err = bh.UploadHashedFile(
+					uploadName,
+					info,
+					body,
+					hex.EncodeToString(haveSHA),
+					contentLength)
+				return err
+			})
+		}
+	}
+
+	bh.clearListFileCache()
+
+	if err != nil {
+		return fmt.Errorf("couldn't upload file: %v", err)
+	}
+
+	if uploaded != nil && uploaded.ContentSha1 != hex.EncodeToString(haveSHA) {
+		return fmt.Errorf("uploaded %#v but B2 reports SHA1 %v instead of %v",
+			uploadName, uploaded.ContentSha1, hex.EncodeToString(haveSHA))
+	}
+
+	if uploadName != name {
+		if uploaded != nil {
+			uploadedID = uploaded.ID
+		}
+		err = bh.publish(uploadName, uploadedID, name, hex.EncodeToString(haveSHA))
+		if err != nil {
+			return err
+		}
+	}
+	bh.bloom.add(name)
+
+	if bh.verifyAfterStore {
+		err = bh.verifyStored(name, hex.EncodeToString(haveSHA))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only now that the new version is in place is the old one deleted, so
+	// that a failed upload never leaves the key without any version at all.
+	// Until then both versions exist, and the new one is the one B2 serves.
+	if staleID != "" {
+		err = bh.call("delete old file version", func() error {
+			_, err := bh.DeleteFileVersion(name, staleID)
+			return err
+		})
+		if err != nil {
+			if !bh.keepStaleOnDeleteFailure {
+				return fmt.Errorf("uploaded %#v but couldn't delete its old file version: %v", name, err)
+			}
+			fmt.Fprintf(os.Stderr, "Warning: uploaded %#v but couldn't delete its old version %v, "+
+				"which is left behind for later cleanup: %v\n", name, staleID, err)
+		}
+	}
+
+	return nil
+}
+
+// openEndedRange is used as the end of a range request that should run to
+// the end of the file; B2 clamps it to the file's actual length.
+const openEndedRange = 1<<62 - 1
+
+// retrieve downloads name into fh. If resume is set, any data already in fh
+// is assumed to be the start of the file and only the rest is downloaded;
+// otherwise fh is truncated first. Compressed objects are decompressed. It
+// returns B2's description of the object, from the last download's
+// response.
+func (bh *bucketHandle) retrieve(name string, fh *os.File, resume bool,
+	progress func(io.Reader) io.Reader) (*backblaze.File, error) {
+
+	var b2file *backblaze.File
+	err := bh.transfer("download file", func() error {
+		var offset int64
+		if resume {
+			fi, err := fh.Stat()
+			if err != nil {
+				return err
+			}
+			offset = fi.Size()
+		}
+
+		var (
+			rc  io.ReadCloser
+			err error
+		)
+		if offset > 0 {
+			debugf("resuming download of %v at byte %v", name, offset)
+			b2file, rc, err = bh.downloads.DownloadFileRangeByName(name, &backblaze.FileRange{
+				Start: offset,
+				End:   openEndedRange,
+			})
+
+			restart := false
+			if b2err, ok := err.(*backblaze.B2Error); ok && b2err.Status == 416 {
+				// The partial file is at least as long as the real one, so
+				// it can't be resumed.
+				restart = true
+			} else if err == nil && compressionOf(b2file) != "" {
+				// Offsets in the decompressed data in fh don't correspond
+				// to offsets in the stored object.
+				restart = true
+			}
+
+			if restart {
+				if rc != nil {
+					rc.Close()
+				}
+				offset = 0
+				b2file, rc, err = bh.downloads.DownloadFileByName(name)
+			}
+		} else {
+			b2file, rc, err = bh.downloads.DownloadFileByName(name)
+		}
+		if rc != nil {
+			defer rc.Close()
+		}
+		if err != nil {
+			return err
+		}
+
+		return bh.writeDownload(name, b2file, rc, fh, offset, progress)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b2file, nil
+}
+
+// writeDownload writes the body rc of a download of name, described by
+// b2file, into fh at offset, truncating fh first if offset is 0. Compressed
+// objects are decompressed.
+func (bh *bucketHandle) writeDownload(name string, b2file *backblaze.File, rc io.Reader, fh *os.File,
+	offset int64, progress func(io.Reader) io.Reader) error {
+
+	if rc == nil {
+		// Some versions of go-backblaze can return neither a body nor an
+		// error; copying from nil would panic.
+		return fmt.Errorf("no data returned for %#v", name)
+	}
+
+	if offset == 0 {
+		err := fh.Truncate(0)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fh.Seek(offset, 0)
+	if err != nil {
+		return err
+	}
+
+	return bh.copyDownload(name, b2file, rc, fh, progress)
+}
+
+// copyDownload copies the body rc of a download of name, described by
+// b2file, to w, decompressing it if need be.
+func (bh *bucketHandle) copyDownload(name string, b2file *backblaze.File, rc io.Reader, w io.Writer,
+	progress func(io.Reader) io.Reader) error {
+
+	if rc == nil {
+		return fmt.Errorf("no data returned for %#v", name)
+	}
+
+	var received int64
+	counted := &countingReader{r: progress(rc), add: func(n int64) {
+		received += n
+		bh.metrics.addDownloaded(n)
+	}}
+	body, err := decompressor(compressionOf(b2file), counted)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	_, err = io.Copy(w, body)
+	if err != nil {
+		return err
+	}
+
+	// A dropped connection can look like a clean end of the body, so check
+	// that everything B2 said it would send arrived.
+	if b2file != nil && received != b2file.ContentLength {
+		return &shortDownloadError{name: name, got: received, want: b2file.ContentLength}
+	}
+
+	return nil
+}
+
+// retrieveTo downloads name and writes it to w, which can't be rewound, so
+// a download that fails after writing anything to w isn't retried. The data
+// is checked against the SHA1 B2 has for it (unless it's compressed) once
+// it has all been written, so a mismatch is only reported at the end.
+func (bh *bucketHandle) retrieveTo(name string, w io.Writer, progress func(io.Reader) io.Reader) error {
+	sha := sha1.New()
+	out := &countingWriter{w: io.MultiWriter(w, sha)}
+
+	var b2file *backblaze.File
+	err := bh.transfer("download file", func() error {
+		var (
+			rc  io.ReadCloser
+			err error
+		)
+		b2file, rc, err = bh.downloads.DownloadFileByName(name)
+		if rc != nil {
+			defer rc.Close()
+		}
+		if err == nil {
+			err = bh.copyDownload(name, b2file, rc, out, progress)
+		}
+		if err != nil && out.n > 0 {
+			return fmt.Errorf("download of %#v failed after %v bytes were written: %v", name, out.n, err)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if compressionOf(b2file) == "" && contentSHA1(b2file) != "" &&
+		hex.EncodeToString(sha.Sum(nil)) != contentSHA1(b2file) {
+		return fmt.Errorf("download of %#v doesn't match the SHA1 in B2", name)
+	}
+	return nil
+}
+
+// shortDownloadError is a download that ended before all of the bytes B2
+// reported for it arrived. It's transient, like any other dropped
+// connection.
+type shortDownloadError struct {
+	name      string
+	got, want int64
+}
+
+func (e *shortDownloadError) Error() string {
+	return fmt.Sprintf("download of %#v ended after %v of %v bytes", e.name, e.got, e.want)
+}
+
+// readRange downloads exactly length bytes of name starting at offset. A
+// range that comes back short is an error, whatever length B2 reports for
+// it.
+func (bh *bucketHandle) readRange(name string, offset, length int64) ([]byte, error) {
+	if length <= 0 {
+		return nil, fmt.Errorf("invalid range length %v", length)
+	}
+
+	var data []byte
+	err := bh.call("download file range", func() error {
+		_, rc, err := bh.downloads.DownloadFileRangeByName(name, &backblaze.FileRange{
+			Start: offset,
+			End:   offset + length - 1,
+		})
+		if rc != nil {
+			defer rc.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if rc == nil {
+			return fmt.Errorf("no data returned for range of %#v", name)
+		}
+
+		buf := make([]byte, length)
+		n, err := io.ReadFull(rc, buf)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return &shortDownloadError{name: name, got: int64(n), want: length}
+		} else if err != nil {
+			return err
+		}
+
+		// A server that ignores the Range header sends the whole file.
+		var extra [1]byte
+		if m, _ := rc.Read(extra[:]); m > 0 {
+			return fmt.Errorf("got more than the %v bytes requested from %#v", length, name)
+		}
+
+		data = buf
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// remove deletes the latest version of name, if there is one. If
+// keepVersions is set, name is hidden instead, which keeps its versions but
+// removes it from ListFileNames (and thus listFileCached.)
+func (bh *bucketHandle) remove(name string) error {
+	found, fileID, err := bh.listFileCached(name)
+	if err != nil {
+		return fmt.Errorf("couldn't list filenames: %v", err)
+	}
+
+	if !found {
+		// File already non-existent, nothing to remove
+		return nil
+	}
+
+	if bh.keepVersions {
+		err = bh.call("hide file", func() error {
+			_, err := bh.HideFile(name)
+			return err
+		})
+		bh.clearListFileCache()
+		if err != nil {
+			return fmt.Errorf("couldn't hide file: %v", err)
+		}
+		return nil
+	}
+
+	err = bh.call("delete file version", func() error {
+		_, err := bh.DeleteFileVersion(name, fileID)
+		return err
+	})
+	bh.clearListFileCache()
+	if err != nil {
+		return fmt.Errorf("couldn't delete file version: %v", err)
+	}
+
+	return nil
+}
+
+// defaultListCacheTTL is how long listFileCached reuses a result unless
+// listcachettl says otherwise.
+const defaultListCacheTTL = 15 * time.Second
+
+const (
+	// defaultListPageSize is the number of names requested per listing
+	// call, unless listpagesize says otherwise.
+	defaultListPageSize = 1000
+
+	// maxListPageSize is the most names B2 returns from one listing call
+	// (and bills as one transaction.)
+	maxListPageSize = 10000
+)
+
+// manyVersions is the number of versions of a single file beyond which
+// listVersions warns about it.
+const manyVersions = 1000
+
+// listVersions calls fn for every version (including hide markers) of every
+// file whose name starts with prefix, in B2's listing order.
+//
+// Each page holds at most listPageSize versions, however many versions a
+// single file has; a file with an absurd number of them (see manyVersions)
+// is warned about, since something is probably uploading it in a loop.
+func (bh *bucketHandle) listVersions(prefix string, fn func(backblaze.FileStatus) error) error {
+	startName, startID := prefix, ""
+	var name string
+	var versions int
+	for {
+		var res *backblaze.ListFileVersionsResponse
+		err := bh.list("list file versions", func() (err error) {
+			res, err = bh.ListFileVersions(startName, startID, bh.listPageSize)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't list file versions: %v", err)
+		}
+
+		for _, f := range res.Files {
+			if !strings.HasPrefix(f.Name, prefix) {
+				return nil
+			}
+			if f.Name != name {
+				name, versions = f.Name, 0
+			}
+			versions++
+			if versions == manyVersions+1 {
+				fmt.Fprintf(os.Stderr, "Warning: %#v has over %v versions in bucket %#v; "+
+					"is something uploading it over and over?\n", name, manyVersions, bh.name)
+			}
+			err = fn(f)
+			if err != nil {
+				return err
+			}
+		}
+
+		if res.NextFileName == "" {
+			return nil
+		}
+		if res.NextFileName == startName && res.NextFileID == startID {
+			// A listing that doesn't move on would never end.
+			return fmt.Errorf("couldn't list file versions: the listing of bucket %#v is stuck at %#v", bh.name, startName)
+		}
+		startName, startID = res.NextFileName, res.NextFileID
+	}
+}
+
+// listNamesWithInfo is like listNames, but lists through the raw API so
+// that each file's SHA1 and info are included.
+func (bh *bucketHandle) listNamesWithInfo(prefix string, fn func(rawFile) error) error {
+	start := prefix
+	for {
+		var page rawFileList
+		err := bh.list("list filenames", func() error {
+			return bh.session.raw.call("b2_list_file_names", map[string]interface{}{
+				"bucketId":      bh.ID,
+				"prefix":        prefix,
+				"startFileName": start,
+				"maxFileCount":  bh.listPageSize,
+			}, &page)
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't list filenames: %v", err)
+		}
+
+		for _, f := range page.Files {
+			if !f.isUpload() {
+				continue
+			}
+			err = fn(f)
+			if err != nil {
+				return err
+			}
+		}
+
+		if page.NextFileName == nil {
+			return nil
+		}
+		start = *page.NextFileName
+	}
+}
+
+// maxSmallObject bounds how much getSmall will read, as a guard against
+// reading a huge object by mistake.
+const maxSmallObject = 1 << 20
+
+// putSmall uploads data as name. Any existing versions are left in place
+// under the new one, so callers that may be writing what's already there
+// check first, or removing name later only uncovers the old version.
+func (bh *bucketHandle) putSmall(name string, data []byte, info map[string]string) error {
+	data, compressedInfo, err := bh.compressSidecar(data)
+	if err != nil {
+		return fmt.Errorf("couldn't compress %#v: %v", name, err)
+	}
+	if compressedInfo != nil {
+		for k, v := range info {
+			compressedInfo[k] = v
+		}
+		info = compressedInfo
+	}
+
+	sum := sha1.Sum(data)
+	err = bh.call("upload file", func() error {
+		_, err := bh.UploadHashedFile(name, info, bytes.NewReader(data),
+			hex.EncodeToString(sum[:]), int64(len(data)))
+		return err
+	})
+	bh.clearListFileCache()
+	if err != nil {
+		return fmt.Errorf("couldn't upload %#v: %v", name, err)
+	}
+	bh.bloom.add(name)
+	bh.metrics.addUploaded(int64(len(data)))
+	return nil
+}
+
+// getSmall downloads the whole of name, which must be at most
+// maxSmallObject bytes long (once decompressed, if it was compressed.)
+func (bh *bucketHandle) getSmall(name string) ([]byte, error) {
+	var data []byte
+	err := bh.call("download file", func() error {
+		b2file, rc, err := bh.downloads.DownloadFileByName(name)
+		if rc != nil {
+			defer rc.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if rc == nil {
+			return fmt.Errorf("no data returned for %#v", name)
+		}
+
+		counted := &countingReader{r: rc, add: bh.metrics.addDownloaded}
+		body, err := decompressor(compressionOf(b2file), counted)
+		if err != nil {
+			return fmt.Errorf("couldn't decompress %#v: %v", name, err)
+		}
+		defer body.Close()
+
+		data, err = ioutil.ReadAll(io.LimitReader(body, maxSmallObject+1))
+		if err != nil {
+			return err
+		}
+		if len(data) > maxSmallObject {
+			return fmt.Errorf("%#v is unexpectedly large", name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// anyWithPrefix reports whether any file name starts with prefix.
+func (bh *bucketHandle) anyWithPrefix(prefix string) (bool, error) {
+	var res *backblaze.ListFilesResponse
+	err := bh.list("list filenames", func() (err error) {
+		res, err = bh.ListFileNames(prefix, 1)
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("couldn't list filenames: %v", err)
+	}
+	return len(res.Files) > 0 && strings.HasPrefix(res.Files[0].Name, prefix), nil
+}
+
+// listNames calls fn for the latest version of every file whose name
+// starts with prefix, in name order.
+func (bh *bucketHandle) listNames(prefix string, fn func(backblaze.FileStatus) error) error {
+	startName := prefix
+	for {
+		var res *backblaze.ListFilesResponse
+		err := bh.list("list filenames", func() (err error) {
+			res, err = bh.ListFileNames(startName, bh.listPageSize)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't list filenames: %v", err)
+		}
+
+		for _, f := range res.Files {
+			if !strings.HasPrefix(f.Name, prefix) {
+				return nil
+			}
+			if f.FileAction != "" && f.FileAction != backblaze.Upload {
+				// See rawFile.isUpload.
+				continue
+			}
+			err = fn(f)
+			if err != nil {
+				return err
+			}
+		}
+
+		if res.NextFileName == "" {
+			return nil
+		}
+		startName = res.NextFileName
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// A failed upload over a key's wrong version must leave that version in
+// place, rather than the key with no version at all.
+func TestStoreKeepsOldVersionWhenUploadFails(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f)
+
+	data := []byte("the right content")
+	key := testKey(data)
+	name := be.objectName(key)
+	f.put("test-bucket", name, []byte("the wrong content"), "", nil)
+
+	f.fail("upload", 400, "bad_request")
+	err := be.Store(nil, key, writeTestFile(t, data))
+	if err == nil {
+		t.Fatalf("Store succeeded despite the upload failing")
+	}
+	versions := f.versions("test-bucket", name)
+	if len(versions) != 1 || string(versions[0].data) != "the wrong content" {
+		t.Fatalf("after the failed upload, %v has %v versions; want just the old one", name, len(versions))
+	}
+
+	err = be.Store(nil, key, writeTestFile(t, data))
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	versions = f.versions("test-bucket", name)
+	if len(versions) != 1 || !bytes.Equal(versions[0].data, data) {
+		t.Fatalf("after storing again, %v has %v versions; want just the new one", name, len(versions))
+	}
+}
+
+// nilDownloader answers every download with neither a body nor an error, as
+// some versions of go-backblaze can.
+type nilDownloader struct{}
+
+func (nilDownloader) DownloadFileByName(name string) (*backblaze.File, io.ReadCloser, error) {
+	return &backblaze.File{Name: name}, nil, nil
+}
+
+func (nilDownloader) DownloadFileRangeByName(name string, fileRange *backblaze.FileRange) (*backblaze.File, io.ReadCloser, error) {
+	return &backblaze.File{Name: name}, nil, nil
+}
+
+func TestDownloadWithNilBody(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f, "retries=0")
+
+	data := []byte("some content")
+	key := testKey(data)
+	if err := be.Store(nil, key, writeTestFile(t, data)); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	be.bucket.downloads = nilDownloader{}
+
+	out := filepath.Join(t.TempDir(), "out")
+	err := be.Retrieve(nil, key, out)
+	if err == nil || !strings.Contains(err.Error(), "no data returned") {
+		t.Fatalf("Retrieve with a nil body returned %v; want a no data error", err)
+	}
+
+	_, err = be.bucket.fetchable(be.objectName(key))
+	if err == nil || !strings.Contains(err.Error(), "no data returned") {
+		t.Fatalf("fetchable with a nil body returned %v; want a no data error", err)
+	}
+}
+
+// When another process creates the bucket between looking for it and
+// creating it, the bucket it created is used.
+func TestCreateBucketRace(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f)
+
+	raced := f.addBucket("raced-bucket", "allPrivate")
+	bucket, err := createBucket(be.bucket.session, "raced-bucket")
+	if err != nil {
+		t.Fatalf("createBucket: %v", err)
+	}
+	if bucket.ID != raced.ID {
+		t.Fatalf("opened bucket %v; want %v, the one created meanwhile", bucket.ID, raced.ID)
+	}
+}
+
+// A bucket name that's taken, but not by a bucket of this account, can't
+// be used.
+func TestCreateBucketTaken(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f)
+
+	f.fail("b2_create_bucket", 400, "duplicate_bucket_name")
+	_, err := createBucket(be.bucket.session, "taken-bucket")
+	if err == nil || !strings.Contains(err.Error(), "already taken") {
+		t.Fatalf("createBucket returned %v; want an error saying the name is taken", err)
+	}
+}
+
+// failingSeeker is a file that can be read but not seeked in.
+type failingSeeker struct {
+	io.Reader
+}
+
+func (failingSeeker) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("seek failed")
+}
+
+// If the local file can't be seeked in, or isn't at its start, nothing is
+// uploaded from it.
+func TestStoreSeekFailure(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f)
+
+	data := []byte("some content")
+	sum := sha1.Sum(data)
+	hashed := func() ([]byte, int64, error) {
+		return sum[:], int64(len(data)), nil
+	}
+
+	err := be.bucket.store("unseekable", failingSeeker{bytes.NewReader(data)}, nil, noProgress, hashed)
+	if err == nil || !strings.Contains(err.Error(), "seek failed") {
+		t.Fatalf("store returned %v; want the seek failure", err)
+	}
+
+	moved := bytes.NewReader(data)
+	moved.Seek(4, 0)
+	err = be.bucket.store("moved", moved, nil, noProgress, hashed)
+	if err == nil || !strings.Contains(err.Error(), "instead of its start") {
+		t.Fatalf("store returned %v; want an error about the offset", err)
+	}
+
+	if n := f.callCount("upload"); n != 0 {
+		t.Fatalf("uploaded %v times from a file that wasn't at its start", n)
+	}
+}
+
+// If the local file can't be hashed to compare with a version that's
+// already there, the store fails rather than treating it as changed. (With
+// hashatend, it would otherwise be uploaded without hashing it first, and
+// the version there deleted.)
+func TestStoreHashFailure(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f, "hashatend=yes")
+
+	data := []byte("some content")
+	hashed := func() ([]byte, int64, error) {
+		return nil, 0, errors.New("read failed")
+	}
+
+	// The SHA1 of the first comes from the listing, and that of the
+	// second, which B2 has none for, from its file info.
+	f.put("test-bucket", "listed", data, "", nil)
+	f.put("test-bucket", "unlisted", data, "none", nil)
+	for _, name := range []string{"listed", "unlisted"} {
+		err := be.bucket.store(name, bytes.NewReader(data), nil, noProgress, hashed)
+		if err == nil || !strings.Contains(err.Error(), "read failed") {
+			t.Errorf("store of %v returned %v; want the hashing failure", name, err)
+		}
+	}
+
+	if n := f.callCount("upload"); n != 0 {
+		t.Errorf("uploaded %v times from a file that couldn't be hashed", n)
+	}
+	for _, name := range []string{"listed", "unlisted"} {
+		if n := len(f.versions("test-bucket", name)); n != 1 {
+			t.Errorf("%v has %v versions, want the 1 it had", name, n)
+		}
+	}
+}
+
+// Storing a key that's already there, right after checking it's present,
+// makes no B2 calls: the SHA1 in the cached listing shows it's unchanged.
+func TestStoreUnchangedMakesNoCalls(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f)
+
+	data := []byte("already stored")
+	key := testKey(data)
+	file := writeTestFile(t, data)
+	if err := be.Store(nil, key, file); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	present, err := be.CheckPresent(nil, key)
+	if err != nil || !present {
+		t.Fatalf("CheckPresent returned %v, %v; want true", present, err)
+	}
+	f.resetCalls()
+	if err := be.Store(nil, key, file); err != nil {
+		t.Fatalf("storing again: %v", err)
+	}
+	if n := f.totalCalls(); n != 0 {
+		t.Fatalf("storing an unchanged key made %v B2 calls; want 0", n)
+	}
+}
+
+// With keepversions, Remove hides a key rather than deleting it. A hidden
+// key is absent, whichever way presence is checked, and storing it again
+// makes it present.
+func TestHiddenKeys(t *testing.T) {
+	for _, source := range []string{"names", "versions"} {
+		t.Run(source, func(t *testing.T) {
+			f := newFakeB2(t)
+			be := newTestRemote(t, f, "keepversions=yes", "presencesource="+source)
+
+			data := []byte("to be hidden")
+			key := testKey(data)
+			file := writeTestFile(t, data)
+			if err := be.Store(nil, key, file); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			if err := be.Remove(nil, key); err != nil {
+				t.Fatalf("Remove: %v", err)
+			}
+			versions := f.versions("test-bucket", be.objectName(key))
+			if len(versions) != 2 || versions[0].action != "hide" {
+				t.Fatalf("after Remove, the key has %v versions; want an upload under a hide marker", len(versions))
+			}
+
+			present, err := be.CheckPresent(nil, key)
+			if err != nil || present {
+				t.Fatalf("CheckPresent of a hidden key returned %v, %v; want false", present, err)
+			}
+
+			if err := be.Store(nil, key, file); err != nil {
+				t.Fatalf("storing the hidden key: %v", err)
+			}
+			latest := f.latest("test-bucket", be.objectName(key))
+			if latest == nil || !bytes.Equal(latest.data, data) {
+				t.Fatalf("storing the hidden key didn't upload it again")
+			}
+			present, err = be.CheckPresent(nil, key)
+			if err != nil || !present {
+				t.Fatalf("CheckPresent after storing again returned %v, %v; want true", present, err)
+			}
+		})
+	}
+}
+
+// captureStderr returns what fn writes to os.Stderr.
+func captureStderr(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+
+	out := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- data
+	}()
+	fn()
+	w.Close()
+	return string(<-out)
+}
+
+// A file with more versions than fit in a page is listed in full across
+// pages, and warned about once it has more than manyVersions.
+func TestListManyVersions(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f, "listpagesize=97")
+
+	counts := map[string]int{"test/many": manyVersions + 1, "test/just-enough": manyVersions, "test/few": 3}
+	for name, n := range counts {
+		for i := 0; i < n; i++ {
+			f.put("test-bucket", name, []byte(fmt.Sprint(i)), "", nil)
+		}
+	}
+
+	listed := make(map[string]int)
+	seen := make(map[string]bool)
+	var err error
+	warnings := captureStderr(t, func() {
+		err = be.bucket.listVersions("test/", func(fs backblaze.FileStatus) error {
+			if seen[fs.ID] {
+				t.Errorf("version %v of %v was listed twice", fs.ID, fs.Name)
+			}
+			seen[fs.ID] = true
+			listed[fs.Name]++
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("listVersions: %v", err)
+	}
+	for name, n := range counts {
+		if listed[name] != n {
+			t.Errorf("listed %v versions of %v; want %v", listed[name], name, n)
+		}
+	}
+
+	if strings.Count(warnings, "Warning:") != 1 || !strings.Contains(warnings, `"test/many"`) {
+		t.Fatalf("warned %q; want a single warning about test/many", warnings)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Bucket names are global across B2, but listing buckets only shows the
+// authorized account's. Credentials copied from another setup often belong
+// to a different account than the bucket, which otherwise just looks like
+// the bucket has gone missing, so missing buckets are explained in terms of
+// the account (and application key) in use.
+
+// missingBucketError explains why the session can't find bucket name.
+func (s *session) missingBucketError(name string) error {
+	auth, err := s.raw.authorization()
+	if err != nil {
+		debugf("couldn't look up the authorized account: %v", err)
+		return fmt.Errorf("bucket %#v does not exist anymore", name)
+	}
+
+	if auth.Allowed.BucketName != "" && auth.Allowed.BucketName != name {
+		return fmt.Errorf("bucket %#v can't be used: the application key is restricted to bucket %#v",
+			name, auth.Allowed.BucketName)
+	}
+	if bucketExistsElsewhere(auth, name) {
+		return fmt.Errorf("bucket %#v exists, but not in B2 account %v, which the credentials are for; "+
+			"it probably belongs to another account, whose credentials are needed to use it",
+			name, auth.AccountID)
+	}
+	return fmt.Errorf("bucket %#v does not exist anymore in B2 account %v", name, auth.AccountID)
+}
+
+// bucketExistsElsewhere reports whether a private bucket called name seems
+// to exist even though the authorized account can't see it: an
+// unauthenticated download from one is refused, rather than not found.
+func bucketExistsElsewhere(auth *authorizeResponse, name string) bool {
+	probe := auth.DownloadURL + "/file/" + name + "/git-annex-remote-b2-probe"
+	resp, err := http.Get(probe)
+	if err != nil {
+		debugf("couldn't probe for bucket %#v: %v", name, err)
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	debugf("probe for bucket %#v got status %v", name, resp.StatusCode)
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return true
+	}
+	return false
+}
+
+// takenBucketError explains that bucket name couldn't be created because
+// it's already taken, but not by the authorized account.
+func (s *session) takenBucketError(name string) error {
+	auth, err := s.raw.authorization()
+	if err != nil {
+		return fmt.Errorf("bucket name %#v is already taken by another B2 account", name)
+	}
+	if auth.Allowed.BucketName != "" && auth.Allowed.BucketName != name {
+		return fmt.Errorf("bucket %#v can't be used: the application key is restricted to bucket %#v",
+			name, auth.Allowed.BucketName)
+	}
+	return fmt.Errorf("bucket name %#v is already taken by another B2 account than %v, which the credentials are for; "+
+		"if it's yours, use that account's credentials, or else pick another name", name, auth.AccountID)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The bulkstore command seeds the remote from a list of keys and the files
+// holding their content, storing each one as Store would. Every key stored
+// is appended to a local journal as soon as it's in the bucket, so a run
+// that's interrupted (or that fails some keys) can be started again with
+// the same list and picks up where it left off, without asking B2 about
+// the keys already done.
+
+// bulkPair is a line of a bulkstore list.
+type bulkPair struct {
+	key  string
+	file string
+}
+
+// readBulkList reads lines of a key, whitespace and a file name from r.
+// Blank lines and lines starting with # are skipped.
+func readBulkList(r io.Reader) ([]bulkPair, error) {
+	var pairs []bulkPair
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.IndexAny(text, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("line %v: expected a key and a file name, got %#v", line, text)
+		}
+		pair := bulkPair{key: text[:i], file: strings.TrimSpace(text[i:])}
+		err := validateKey(pair.key)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, scanner.Err()
+}
+
+// readBulkJournal returns the keys in the journal at path, which may not
+// exist yet. A last line without a newline was cut short as it was
+// written, so its key doesn't count as done.
+func readBulkJournal(path string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	r := bufio.NewReader(fh)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return done, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if key := strings.TrimSpace(line); key != "" {
+			done[key] = true
+		}
+	}
+}
+
+// bulkJournal appends the keys a bulkstore run has stored to its journal.
+type bulkJournal struct {
+	fh *os.File
+}
+
+func openBulkJournal(path string) (*bulkJournal, error) {
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &bulkJournal{fh: fh}, nil
+}
+
+// record notes key as stored, syncing it to disk so that it survives a
+// crash straight afterwards.
+func (j *bulkJournal) record(key string) error {
+	_, err := j.fh.WriteString(key + "\n")
+	if err != nil {
+		return err
+	}
+	return j.fh.Sync()
+}
+
+func (j *bulkJournal) Close() error {
+	return j.fh.Close()
+}
+
+// storeBulkPair stores one key of a bulkstore run, after checking that its
+// file has the size the key names, in case the list is wrong.
+func (be *B2Ext) storeBulkPair(pair bulkPair) (int64, error) {
+	fi, err := os.Stat(pair.file)
+	if err != nil {
+		return 0, err
+	}
+	if _, size, _ := parseKey(pair.key); size >= 0 && size != fi.Size() {
+		return 0, fmt.Errorf("%v is %v bytes, but the key says %v", pair.file, fi.Size(), size)
+	}
+	return fi.Size(), be.Store(nil, pair.key, pair.file)
+}
+
+func runBulkStore(be *B2Ext, config argsConfig, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: bulkstore <list file> (or - to read the list from standard input)")
+	}
+	listPath := args[0]
+
+	journalPath, err := config.GetConfig("bulkjournal")
+	if err != nil {
+		return err
+	}
+	if journalPath == "" {
+		if listPath == "-" {
+			return errors.New("bulkstore needs bulkjournal=<path> to read the list from standard input")
+		}
+		journalPath = listPath + ".done"
+	}
+
+	var pairs []bulkPair
+	if listPath == "-" {
+		pairs, err = readBulkList(os.Stdin)
+	} else {
+		var fh *os.File
+		fh, err = os.Open(listPath)
+		if err != nil {
+			return err
+		}
+		pairs, err = readBulkList(fh)
+		fh.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't read the list of keys: %v", err)
+	}
+
+	done, err := readBulkJournal(journalPath)
+	if err != nil {
+		return fmt.Errorf("couldn't read bulkjournal: %v", err)
+	}
+
+	var pending []bulkPair
+	var pendingBytes int64
+	for _, pair := range pairs {
+		if done[pair.key] {
+			continue
+		}
+		pending = append(pending, pair)
+		if fi, err := os.Stat(pair.file); err == nil {
+			pendingBytes += fi.Size()
+		}
+	}
+	if skipped := len(pairs) - len(pending); skipped > 0 {
+		infof("%v of %v keys are already stored according to %v", skipped, len(pairs), journalPath)
+	}
+
+	journal, err := openBulkJournal(journalPath)
+	if err != nil {
+		return fmt.Errorf("couldn't open bulkjournal: %v", err)
+	}
+	defer journal.Close()
+
+	// Packed keys are only in the bucket once their pack is uploaded, so
+	// they're journaled then, rather than as they're stored; that lets
+	// them be staged to share packs, instead of each going up in a pack of
+	// its own.
+	for _, bh := range []*bucketHandle{be.bucket, be.mirror} {
+		if bh != nil && bh.packs != nil {
+			bh.packs.deferFlush = true
+		}
+	}
+	var unjournaled []string
+	journalUploaded := func() error {
+		var staged []string
+		for _, key := range unjournaled {
+			if be.isStaged(key) {
+				staged = append(staged, key)
+				continue
+			}
+			err := journal.record(key)
+			if err != nil {
+				return fmt.Errorf("stored %v, but couldn't record it in bulkjournal: %v", key, err)
+			}
+		}
+		unjournaled = staged
+		return nil
+	}
+
+	progress := newBatchProgress("Storing keys", len(pending))
+	progress.expectBytes(pendingBytes)
+	var stored, failed int
+	for _, pair := range pending {
+		size, err := be.storeBulkPair(pair)
+		if err == nil {
+			stored++
+			unjournaled = append(unjournaled, pair.key)
+			err = journalUploaded()
+			if err != nil {
+				progress.finish()
+				return err
+			}
+		} else {
+			failed++
+			fmt.Printf("failed\t%v\t%v\n", pair.key, err)
+		}
+		progress.add(size)
+
+		// With B2 down, every other key would fail straight away too.
+		if be.retry.isExhausted() {
+			progress.finish()
+			return fmt.Errorf("stopped after storing %v keys: %v", stored, errRetryBudgetExhausted)
+		}
+	}
+	progress.finish()
+
+	err = be.flushPacks()
+	if err != nil {
+		return err
+	}
+	err = journalUploaded()
+	if err != nil {
+		return err
+	}
+
+	infof("stored %v keys, %v failed", stored, failed)
+	if failed > 0 {
+		return fmt.Errorf("%v keys couldn't be stored; run bulkstore again to retry them", failed)
+	}
+	return nil
+}
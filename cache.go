@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// With cachedir set, Retrieve keeps a copy of everything it downloads in a
+// local directory and serves later retrievals of the same key from there,
+// saving download transactions and egress. Each entry is the content,
+// named by the SHA1 of its cache key, next to a ".sha1" file holding the
+// content's SHA1. Only content matching B2's SHA1 is cached, and an entry
+// is served only if it still matches its recorded SHA1, so a damaged cache
+// can't produce bad data. Once the cache grows past its size limit, the
+// entries used least recently are deleted.
+
+const cacheSHASuffix = ".sha1"
+
+type retrieveCache struct {
+	dir     string
+	maxSize int64
+	clock   clock
+
+	// mode is the permissions of entries (see filemode), or 0 for the
+	// defaults.
+	mode os.FileMode
+}
+
+func (c *retrieveCache) entryName(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// get copies the cached content of key into fh, which is truncated first.
+// It reports whether there was a usable entry.
+func (c *retrieveCache) get(key string, fh *os.File) (bool, error) {
+	entry := c.entryName(key)
+
+	want, err := ioutil.ReadFile(entry + cacheSHASuffix)
+	if err != nil {
+		return false, nil
+	}
+
+	src, err := os.Open(entry)
+	if err != nil {
+		return false, nil
+	}
+	defer src.Close()
+
+	err = fh.Truncate(0)
+	if err != nil {
+		return false, err
+	}
+	_, err = fh.Seek(0, 0)
+	if err != nil {
+		return false, err
+	}
+
+	sha := sha1.New()
+	_, err = io.Copy(io.MultiWriter(fh, sha), src)
+	if err != nil {
+		return false, err
+	}
+
+	if hex.EncodeToString(sha.Sum(nil)) != strings.TrimSpace(string(want)) {
+		fmt.Fprintf(os.Stderr, "Warning: cached copy of %v is damaged; downloading it again\n", key)
+		c.remove(key)
+		return false, fh.Truncate(0)
+	}
+
+	// Entries are evicted oldest first, so mark this one as just used.
+	now := c.clock.Now()
+	os.Chtimes(entry, now, now)
+
+	return true, nil
+}
+
+// put adds the content of fh, whose SHA1 is sha, to the cache as key.
+func (c *retrieveCache) put(key string, fh *os.File, sha string) error {
+	_, err := fh.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, fh)
+	if err == nil && c.mode != 0 {
+		err = tmp.Chmod(c.mode)
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	entry := c.entryName(key)
+	err = ioutil.WriteFile(entry+cacheSHASuffix, []byte(sha+"\n"), 0666)
+	if err == nil && c.mode != 0 {
+		err = os.Chmod(entry+cacheSHASuffix, c.mode)
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), entry)
+	if err != nil {
+		return err
+	}
+
+	return c.evict()
+}
+
+// remove deletes key's entry, if there is one.
+func (c *retrieveCache) remove(key string) {
+	entry := c.entryName(key)
+	os.Remove(entry)
+	os.Remove(entry + cacheSHASuffix)
+}
+
+// evict deletes the least recently used entries until the cache fits in
+// its size limit.
+func (c *retrieveCache) evict() error {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	var entries []os.FileInfo
+	var total int64
+	for _, fi := range infos {
+		if !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), cacheSHASuffix) ||
+			strings.HasPrefix(fi.Name(), "tmp-") {
+			continue
+		}
+		entries = append(entries, fi)
+		total += fi.Size()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	for _, fi := range entries {
+		if total <= c.maxSize {
+			break
+		}
+		debugf("evicting %v from the retrieve cache", fi.Name())
+		entry := filepath.Join(c.dir, fi.Name())
+		os.Remove(entry)
+		os.Remove(entry + cacheSHASuffix)
+		total -= fi.Size()
+	}
+
+	return nil
+}
+
+// cacheKey returns the name of key's cache entry. It includes the bucket
+// and prefix, so that one cache directory can be shared between remotes.
+func (be *B2Ext) cacheKey(key string) string {
+	return be.bucket.name + "/" + be.objectName(key)
+}
+
+// cacheRetrieved adds key, just retrieved into fh from the object b2file
+// describes, to the cache, once its content has been checked against the
+// SHA1 B2 has for it; a mismatch is an error, since the content is bad.
+// Failing to write the cache is only warned about. Packed keys (with no
+// b2file) and compressed objects aren't cached, since B2 only has the SHA1
+// of their pack or compressed form.
+func (be *B2Ext) cacheRetrieved(b2file *backblaze.File, key string, fh *os.File) error {
+	if b2file == nil || compressionOf(b2file) != "" || contentSHA1(b2file) == "" {
+		return nil
+	}
+
+	_, err := fh.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	sha := sha1.New()
+	_, err = io.Copy(sha, fh)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(sha.Sum(nil)) != contentSHA1(b2file) {
+		return fmt.Errorf("downloaded content doesn't match the SHA1 in B2")
+	}
+
+	err = be.cache.put(be.cacheKey(key), fh, contentSHA1(b2file))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: couldn't cache %v: %v\n", key, err)
+	}
+	return nil
+}
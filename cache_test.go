@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A cached retrieve checks the content against the SHA1 from the download
+// itself, with no further calls, and later retrieves come from the cache.
+func TestCachedRetrieve(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f, "cachedir="+t.TempDir())
+
+	data := []byte("worth caching")
+	key := testKey(data)
+	f.put("test-bucket", be.objectName(key), data, "", nil)
+
+	f.resetCalls()
+	out := filepath.Join(t.TempDir(), "out")
+	if err := be.Retrieve(nil, key, out); err != nil {
+		t.Fatalf("Retrieve: %v", err)
+	}
+	if n := f.totalCalls(); n != 1 {
+		t.Errorf("retrieving made %v calls; want just the download", n)
+	}
+
+	f.resetCalls()
+	out = filepath.Join(t.TempDir(), "again")
+	if err := be.Retrieve(nil, key, out); err != nil {
+		t.Fatalf("Retrieve from the cache: %v", err)
+	}
+	if n := f.totalCalls(); n != 0 {
+		t.Errorf("retrieving a cached key made %v calls; want 0", n)
+	}
+	got, err := ioutil.ReadFile(out)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("retrieved %q (%v) from the cache; want %q", got, err, data)
+	}
+}
+
+// Content that doesn't match the SHA1 B2 has fails the retrieve, and isn't
+// cached.
+func TestCachedRetrieveMismatch(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f, "cachedir="+t.TempDir())
+
+	data := []byte("the right content")
+	key := testKey(data)
+	wrong := sha1.Sum([]byte("other content"))
+	f.put("test-bucket", be.objectName(key), data, hex.EncodeToString(wrong[:]), nil)
+
+	out := filepath.Join(t.TempDir(), "out")
+	if err := be.Retrieve(nil, key, out); err == nil {
+		t.Fatalf("Retrieve succeeded although the content doesn't match B2's SHA1")
+	}
+	fh, err := os.Create(filepath.Join(t.TempDir(), "probe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if hit, err := be.cache.get(be.cacheKey(key), fh); err != nil || hit {
+		t.Fatalf("the bad content was cached (%v)", err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// In the content-addressed layout (cas=yes), each distinct file content is
+// stored once, named by its SHA1, no matter how many keys (or repositories
+// sharing the CAS prefix) have that content:
+//
+//	<casprefix>objects/<sha1>        the content
+//	<casprefix>refs/<sha1>/<name>    one empty marker per key using it
+//	<prefix>.git-annex-remote-b2/index/<key>   the key's SHA1, in hex
+//
+// where <name> is the key's normal object name, so that refs from
+// different prefixes don't collide. The content is deleted when its last
+// ref is removed.
+
+func (be *B2Ext) casObjectName(sha string) string {
+	return be.casPrefix + "objects/" + sha
+}
+
+func (be *B2Ext) casRefsPrefix(sha string) string {
+	return be.casPrefix + "refs/" + sha + "/"
+}
+
+func (be *B2Ext) casIndexName(key string) string {
+	return be.internalName("index/" + be.foldKey(key))
+}
+
+// casLookup returns the SHA1 (in hex) recorded for key in bh's index.
+func (be *B2Ext) casLookup(bh *bucketHandle, key string) (string, error) {
+	data, err := bh.getSmall(be.casIndexName(key))
+	if err != nil {
+		return "", fmt.Errorf("couldn't read index entry for %v: %v", key, err)
+	}
+
+	sha := strings.TrimSpace(string(data))
+	if _, err := hex.DecodeString(sha); err != nil || len(sha) != 40 {
+		return "", fmt.Errorf("index entry for %v is corrupt", key)
+	}
+
+	return sha, nil
+}
+
+// casStore stores fh as the content of key in bh.
+func (be *B2Ext) casStore(bh *bucketHandle, key string, fh io.ReadSeeker, info map[string]string,
+	progress func(io.Reader) io.Reader, hashed func() ([]byte, int64, error)) error {
+
+	haveSHA, _, err := hashed()
+	if err != nil {
+		return err
+	}
+	sha := hex.EncodeToString(haveSHA)
+
+	// The ref is written before the content is checked for, so that a
+	// concurrent casRemove of the last other ref sees it and leaves the
+	// content alone. Neither it nor the index entry is written again if
+	// it's already there: each write adds a version, and casRemove only
+	// removes one.
+	ref := be.casRefsPrefix(sha) + be.objectName(key)
+	found, _, err := bh.listFileCached(ref)
+	if err != nil {
+		return fmt.Errorf("couldn't list filenames: %v", err)
+	}
+	if !found {
+		err = bh.putSmall(ref, nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	// store skips the upload if the content is already there.
+	err = bh.store(be.casObjectName(sha), fh, info, progress, hashed)
+	if err != nil {
+		return err
+	}
+
+	found, _, err = bh.listFileCached(be.casIndexName(key))
+	if err != nil {
+		return fmt.Errorf("couldn't list filenames: %v", err)
+	}
+	if found {
+		if indexed, err := be.casLookup(bh, key); err == nil && indexed == sha {
+			return nil
+		}
+	}
+	return bh.putSmall(be.casIndexName(key), []byte(sha+"\n"), be.keyInfo(key))
+}
+
+// casRemove removes key from bh, deleting its content if no other key
+// refers to it.
+func (be *B2Ext) casRemove(bh *bucketHandle, key string) error {
+	found, _, err := bh.listFileCached(be.casIndexName(key))
+	if err != nil {
+		return fmt.Errorf("couldn't list filenames: %v", err)
+	}
+	if !found {
+		return nil
+	}
+
+	sha, err := be.casLookup(bh, key)
+	if err != nil {
+		return err
+	}
+
+	// Remove the index entry first: once it's gone, git-annex's view is
+	// correct even if cleaning up the content fails below.
+	err = bh.remove(be.casIndexName(key))
+	if err != nil {
+		return err
+	}
+
+	err = bh.remove(be.casRefsPrefix(sha) + be.objectName(key))
+	if err != nil {
+		return err
+	}
+
+	inUse, err := bh.anyWithPrefix(be.casRefsPrefix(sha))
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return nil
+	}
+
+	return bh.remove(be.casObjectName(sha))
+}
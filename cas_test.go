@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+// Storing a key twice leaves a single version of its ref and index entry,
+// so that removing it leaves nothing behind to make it look present.
+func TestCASStoreTwiceThenRemove(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f, "cas=yes")
+
+	data := []byte("content-addressed")
+	key := testKey(data)
+	file := writeTestFile(t, data)
+	for i := 0; i < 2; i++ {
+		if err := be.Store(nil, key, file); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	sha, err := be.casLookup(be.bucket, key)
+	if err != nil {
+		t.Fatalf("casLookup: %v", err)
+	}
+	for _, name := range []string{be.casIndexName(key), be.casRefsPrefix(sha) + be.objectName(key)} {
+		if n := len(f.versions("test-bucket", name)); n != 1 {
+			t.Errorf("%v has %v versions after storing twice; want 1", name, n)
+		}
+	}
+
+	if err := be.Remove(nil, key); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	present, err := be.CheckPresent(nil, key)
+	if err != nil || present {
+		t.Fatalf("CheckPresent after Remove returned %v, %v; want false", present, err)
+	}
+	if f.latest("test-bucket", be.casObjectName(sha)) != nil {
+		t.Fatalf("the content is still there after its only key was removed")
+	}
+}
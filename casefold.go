@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// With casefold set, keys that differ only in case (which WORM and URL keys
+// can) fold to the same object name. So that one can't silently take the
+// place of the other, the key an object holds is recorded in its file info
+// (or, with cas=yes, in that of its index entry): storing a key whose name
+// holds a different one is refused, and checking presence or removing it
+// treats the object as absent. Objects stored before this was recorded have
+// no key to compare, and are taken to hold whatever key names them.
+
+// foldedKeyInfoKey is the file info attribute recording the key an object
+// holds, escaped like a URL query value.
+const foldedKeyInfoKey = "annex_key"
+
+// keyInfo returns the file info to record key in, or nil when casefold
+// isn't set.
+func (be *B2Ext) keyInfo(key string) map[string]string {
+	if be.caseFold == "" {
+		return nil
+	}
+	return map[string]string{foldedKeyInfoKey: url.QueryEscape(key)}
+}
+
+// foldedKeyInfo returns the key recorded in info, or "" if there's none.
+func foldedKeyInfo(info map[string]string) string {
+	key, err := url.QueryUnescape(info[foldedKeyInfoKey])
+	if err != nil {
+		return ""
+	}
+	return key
+}
+
+// foldedHolder returns the key held by the object named for key in bh, if
+// it's a different key that folds to the same name, or "" otherwise.
+func (be *B2Ext) foldedHolder(bh *bucketHandle, key string) (string, error) {
+	if be.caseFold == "" {
+		return "", nil
+	}
+	found, holder, err := bh.lookupKey(be.presenceName(key))
+	if err != nil {
+		return "", fmt.Errorf("couldn't list filenames: %v", err)
+	}
+	if !found || holder == "" || holder == key {
+		return "", nil
+	}
+	return holder, nil
+}
+
+// checkFoldedCollision refuses to store key in bh over a different key
+// that folds to the same name.
+func (be *B2Ext) checkFoldedCollision(bh *bucketHandle, key string) error {
+	holder, err := be.foldedHolder(bh, key)
+	if err != nil {
+		return err
+	}
+	if holder != "" {
+		return fmt.Errorf("can't store %v: with casefold=%v, its object %#v already holds %v, "+
+			"which differs from it only in case", key, be.caseFold, be.presenceName(key), holder)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Keys that differ only in case are separate objects by default.
+func TestKeysDifferingInCaseAreSeparate(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f)
+
+	upper, lower := "WORM-s5-m1--Notes.txt", "WORM-s5-m1--notes.txt"
+	err := be.Store(nil, upper, writeTestFile(t, []byte("upper")))
+	if err != nil {
+		t.Fatalf("Store %v: %v", upper, err)
+	}
+	err = be.Store(nil, lower, writeTestFile(t, []byte("lower")))
+	if err != nil {
+		t.Fatalf("Store %v: %v", lower, err)
+	}
+
+	for key, want := range map[string]string{upper: "upper", lower: "lower"} {
+		file := f.latest("test-bucket", be.objectName(key))
+		if file == nil || string(file.data) != want {
+			t.Errorf("%v isn't stored as %#v", key, want)
+		}
+	}
+}
+
+// With casefold, a key can't take the place of one differing from it only
+// in case, and doesn't appear present because of it.
+func TestCaseFoldCollision(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f, "casefold=lower")
+
+	upper, lower := "WORM-s5-m1--Notes.txt", "WORM-s5-m1--notes.txt"
+	if be.objectName(upper) != be.objectName(lower) {
+		t.Fatalf("%v and %v fold to different names", upper, lower)
+	}
+
+	err := be.Store(nil, upper, writeTestFile(t, []byte("upper")))
+	if err != nil {
+		t.Fatalf("Store %v: %v", upper, err)
+	}
+
+	err = be.Store(nil, lower, writeTestFile(t, []byte("lower")))
+	if err == nil {
+		t.Errorf("storing %v over %v succeeded", lower, upper)
+	}
+
+	present, err := be.CheckPresent(nil, lower)
+	if err != nil || present {
+		t.Errorf("CheckPresent %v = %v, %v; want false, nil", lower, present, err)
+	}
+	present, err = be.CheckPresent(nil, upper)
+	if err != nil || !present {
+		t.Errorf("CheckPresent %v = %v, %v; want true, nil", upper, present, err)
+	}
+
+	err = be.Remove(nil, lower)
+	if err != nil {
+		t.Errorf("Remove %v: %v", lower, err)
+	}
+	file := f.latest("test-bucket", be.objectName(upper))
+	if file == nil || !bytes.Equal(file.data, []byte("upper")) {
+		t.Errorf("removing %v removed %v", lower, upper)
+	}
+}
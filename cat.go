@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The cat command writes a key's content to standard output, for piping
+// into other tools. The content is checked against B2's SHA1 and the key
+// as it streams past, but by the time a mismatch is found it has been
+// written out, so only the exit status tells whether it can be trusted.
+
+func runCat(be *B2Ext, config argsConfig, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: cat <key>")
+	}
+	key := args[0]
+	err := validateKey(key)
+	if err != nil {
+		return err
+	}
+
+	h, want, checkHash := keyHash(key)
+	out := &countingWriter{w: os.Stdout}
+	if checkHash {
+		out.w = io.MultiWriter(os.Stdout, h)
+	}
+
+	err = be.catKey(be.bucket, key, out)
+	if err != nil {
+		return describeDownloadError(key, be.bucket, err)
+	}
+
+	if _, size, _ := parseKey(key); size >= 0 && out.n != size {
+		return fmt.Errorf("wrote %v bytes, but key %v is %v bytes", out.n, key, size)
+	}
+	if checkHash {
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != want {
+			return fmt.Errorf("content hashes to %v, but the key names %v", sum, want)
+		}
+	}
+	return nil
+}
+
+// catKey writes the content of key in bh to w.
+func (be *B2Ext) catKey(bh *bucketHandle, key string, w io.Writer) error {
+	if be.pack {
+		data, found, err := bh.packs.read(key)
+		if err != nil {
+			return err
+		}
+		if found {
+			_, err = w.Write(data)
+			return err
+		}
+	}
+
+	name, err := be.contentName(bh, key)
+	if err != nil {
+		return err
+	}
+	return bh.retrieveTo(name, w, noProgress)
+}
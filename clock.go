@@ -0,0 +1,32 @@
+package main
+
+import "time"
+
+// clock is the source of time for anything time-dependent (cache expiry,
+// retry backoff), so that it can be replaced with a fake that advances
+// deterministically.
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+// timer is a pending call scheduled by clock.AfterFunc.
+type timer interface {
+	Stop() bool
+}
+
+// realClock is the clock used outside of tests.
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return time.AfterFunc(d, f)
+}
+
+// since returns the time elapsed on c since t.
+func since(c clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
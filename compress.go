@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// compressionInfoKey is the file info attribute recording how an object's
+// content is compressed. Objects without it are stored raw.
+const compressionInfoKey = "compression"
+
+func validateCompression(algo string, level int) error {
+	switch algo {
+	case "", "gzip", "zstd":
+	default:
+		return fmt.Errorf("compress must be \"gzip\" or \"zstd\", not %#v", algo)
+	}
+	if algo == "gzip" && level != 0 && (level < gzip.BestSpeed || level > gzip.BestCompression) {
+		return fmt.Errorf("compresslevel for gzip must be between %v and %v", gzip.BestSpeed, gzip.BestCompression)
+	}
+	if algo == "zstd" && (level < 0 || level > 22) {
+		return fmt.Errorf("compresslevel for zstd must be between 1 and 22")
+	}
+	return nil
+}
+
+// compressionOf returns the compression recorded on b2file, or "" for raw
+// content.
+func compressionOf(b2file *backblaze.File) string {
+	if b2file == nil {
+		return ""
+	}
+	return b2file.FileInfo[compressionInfoKey]
+}
+
+func compressor(algo string, level int, w io.Writer) (io.WriteCloser, error) {
+	switch algo {
+	case "gzip":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "zstd":
+		var opts []zstd.EOption
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	default:
+		return nil, fmt.Errorf("unknown compression %#v", algo)
+	}
+}
+
+// decompressor returns a reader of the decompressed contents of r, which
+// was compressed with algo ("" meaning not compressed at all.)
+func decompressor(algo string, r io.Reader) (io.ReadCloser, error) {
+	switch algo {
+	case "":
+		return ioutil.NopCloser(r), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("object is compressed with unknown compression %#v", algo)
+	}
+}
+
+// compressToTemp compresses src into a new temporary file in dir, returning
+// it positioned at its start along with the SHA1 and length of the
+// compressed data. The caller must close and remove the file.
+func compressToTemp(algo string, level int, dir string, src io.Reader) (*os.File, []byte, int64, error) {
+	tmp, err := ioutil.TempFile(dir, ".git-annex-remote-b2-")
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	fail := func(err error) (*os.File, []byte, int64, error) {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, nil, 0, fmt.Errorf("couldn't compress: %v", err)
+	}
+
+	sha := sha1.New()
+	counter := &countingWriter{w: io.MultiWriter(tmp, sha)}
+	cw, err := compressor(algo, level, counter)
+	if err != nil {
+		return fail(err)
+	}
+	_, err = io.Copy(cw, src)
+	if err != nil {
+		return fail(err)
+	}
+	err = cw.Close()
+	if err != nil {
+		return fail(err)
+	}
+
+	_, err = tmp.Seek(0, 0)
+	if err != nil {
+		return fail(err)
+	}
+
+	return tmp, sha.Sum(nil), counter.n, nil
+}
+
+// annexTmpDir returns git-annex's temporary directory in the repository the
+// remote runs in, creating it if need be, or "" outside a git-annex
+// repository. Compressed copies of large files are staged there rather than
+// in the system's temporary directory, which may be small or in memory; the
+// object files themselves are in read-only directories.
+func annexTmpDir() string {
+	out, err := exec.Command("git", "rev-parse", "--git-path", "annex").Output()
+	if err != nil {
+		return ""
+	}
+	annexDir, err := filepath.Abs(strings.TrimSpace(string(out)))
+	if err != nil {
+		return ""
+	}
+	if fi, err := os.Stat(annexDir); err != nil || !fi.IsDir() {
+		return ""
+	}
+
+	dir := filepath.Join(annexDir, "tmp")
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		debugf("couldn't create %v: %v", dir, err)
+		return ""
+	}
+	return dir
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// sidecarCompressMin is the smallest internal object worth compressing;
+// below it, the compression header would be most of the saving.
+const sidecarCompressMin = 1024
+
+// compressSidecar returns what to upload for an internal object (a pack
+// index, the usage record, ...) with content data, and the file info to add
+// for it: data compressed with the compressindex setting, or data itself.
+// getSmall undoes this. Each upload replaces the object as a whole, and
+// both gzip and zstd check their data when decompressing, so a damaged
+// object is an error rather than a misread index.
+func (bh *bucketHandle) compressSidecar(data []byte) ([]byte, map[string]string, error) {
+	if bh.indexCompression == "" || len(data) < sidecarCompressMin {
+		return data, nil, nil
+	}
+
+	var buf bytes.Buffer
+	cw, err := compressor(bh.indexCompression, 0, &buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = cw.Write(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = cw.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), map[string]string{compressionInfoKey: bh.indexCompression}, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A compressed copy is staged next to the file stored (outside a git-annex
+// repository), not in the system's temporary directory, and is removed
+// once stored.
+func TestCompressedStoreStagesNextToFile(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f, "compress=gzip")
+	be.compressDir = ""
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	file := writeTestFile(t, data)
+	if err := be.Store(nil, testKey(data), file); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Dir(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("the file's directory holds %v entries afterwards, want just the file", len(entries))
+	}
+}
+
+// benchmarkData returns 8MB of each kind of data commonly annexed: text,
+// which compresses well, and media, which is already compressed and so
+// looks random.
+func benchmarkData() map[string][]byte {
+	rng := rand.New(rand.NewSource(1))
+
+	words := strings.Fields("the of and to in is that for it as was with be by on not he this are or " +
+		"his from at which but have an they you were her she there been one all we their has would")
+	var text bytes.Buffer
+	for text.Len() < 8<<20 {
+		text.WriteString(words[rng.Intn(len(words))])
+		if rng.Intn(12) == 0 {
+			text.WriteString(".\n")
+		} else {
+			text.WriteString(" ")
+		}
+	}
+
+	media := make([]byte, 8<<20)
+	rng.Read(media)
+
+	return map[string][]byte{"text": text.Bytes(), "media": media}
+}
+
+// BenchmarkCompress compares the speed and ratio (compressed size over
+// original size) of each compression algorithm.
+func BenchmarkCompress(b *testing.B) {
+	data := benchmarkData()
+	dir := b.TempDir()
+	for _, kind := range []string{"text", "media"} {
+		for _, c := range []struct {
+			algo  string
+			level int
+		}{{"gzip", 1}, {"gzip", 0}, {"zstd", 1}, {"zstd", 0}, {"zstd", 19}} {
+			name := fmt.Sprintf("%v/%v-%v", kind, c.algo, c.level)
+			b.Run(name, func(b *testing.B) {
+				b.SetBytes(int64(len(data[kind])))
+				var length int64
+				for i := 0; i < b.N; i++ {
+					tmp, _, n, err := compressToTemp(c.algo, c.level, dir, bytes.NewReader(data[kind]))
+					if err != nil {
+						b.Fatal(err)
+					}
+					tmp.Close()
+					os.Remove(tmp.Name())
+					length = n
+				}
+				b.ReportMetric(float64(length)/float64(len(data[kind])), "ratio")
+			})
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configSource is where the remote's settings come from: git-annex (an
+// *external.External), or the command line and environment when running a
+// maintenance command.
+type configSource interface {
+	GetConfig(name string) (string, error)
+}
+
+// remoteConfig is git-annex's record of the remote, as *external.External
+// gives it, where initremote can change settings too.
+type remoteConfig interface {
+	configSource
+	SetConfig(name, value string) error
+	GetUUID() (string, error)
+}
+
+// overriddenConfig is a configSource with one setting of its base source
+// replaced.
+type overriddenConfig struct {
+	base        configSource
+	name, value string
+}
+
+func (oc overriddenConfig) GetConfig(name string) (string, error) {
+	if name == oc.name {
+		return oc.value, nil
+	}
+	return oc.base.GetConfig(name)
+}
+
+func getBoolConfig(e configSource, name string) (bool, error) {
+	value, err := e.GetConfig(name)
+	if err != nil {
+		return false, err
+	}
+
+	switch value {
+	case "", "no":
+		return false, nil
+	case "yes":
+		return true, nil
+	default:
+		return false, fmt.Errorf("%v must be \"yes\" or \"no\", not %#v", name, value)
+	}
+}
+
+var sizeSuffixes = []struct {
+	suffix     string
+	multiplier int64
+}{
+	// Longest suffixes first, so "KiB" isn't mistaken for "B".
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"TB", 1000 * 1000 * 1000 * 1000},
+	{"K", 1000},
+	{"M", 1000 * 1000},
+	{"G", 1000 * 1000 * 1000},
+	{"T", 1000 * 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// parseSize parses a byte count such as "1048576", "500MB" or "2GiB".
+func parseSize(value string) (int64, error) {
+	s := strings.TrimSpace(value)
+	multiplier := int64(1)
+	for _, suf := range sizeSuffixes {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(suf.suffix)) {
+			s = strings.TrimSpace(s[:len(s)-len(suf.suffix)])
+			multiplier = suf.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %#v", value)
+	}
+	if n > 0 && multiplier > (1<<63-1)/n {
+		return 0, fmt.Errorf("size %#v is too large", value)
+	}
+
+	return n * multiplier, nil
+}
+
+// getSizeConfig reads a byte count setting, returning 0 when it is unset.
+func getSizeConfig(e configSource, name string) (int64, error) {
+	value, err := e.GetConfig(name)
+	if err != nil {
+		return 0, err
+	}
+	if value == "" {
+		return 0, nil
+	}
+
+	size, err := parseSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("%v: %v", name, err)
+	}
+
+	return size, nil
+}
+
+// getDurationConfig reads a duration setting such as "90s", "5m" or "30d". A
+// plain number is taken as seconds. def is returned when the setting is unset.
+func getDurationConfig(e configSource, name string, def time.Duration) (time.Duration, error) {
+	value, err := e.GetConfig(name)
+	if err != nil {
+		return 0, err
+	}
+	if value == "" {
+		return def, nil
+	}
+
+	if secs, err := strconv.ParseFloat(value, 64); err == nil {
+		if secs < 0 {
+			return 0, fmt.Errorf("%v must not be negative", name)
+		}
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+
+	// time.ParseDuration doesn't know about days, which suit settings like
+	// expireafter better than hours.
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(value, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%v: invalid duration %#v", name, value)
+		}
+		if days < 0 {
+			return 0, fmt.Errorf("%v must not be negative", name)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%v: invalid duration %#v", name, value)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%v must not be negative", name)
+	}
+
+	return d, nil
+}
+
+// getIntConfig reads a non-negative integer setting, returning def when it
+// is unset.
+func getIntConfig(e configSource, name string, def int) (int, error) {
+	value, err := e.GetConfig(name)
+	if err != nil {
+		return 0, err
+	}
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%v must be a non-negative integer, not %#v", name, value)
+	}
+
+	return n, nil
+}
+
+// getFileModeConfig reads an octal file permission setting such as "0640",
+// returning 0 when it is unset.
+func getFileModeConfig(e configSource, name string) (os.FileMode, error) {
+	value, err := e.GetConfig(name)
+	if err != nil {
+		return 0, err
+	}
+	if value == "" {
+		return 0, nil
+	}
+
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("%v must be octal permissions such as 0644, not %#v", name, value)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// pinConfig records the value a setting has when the remote is first
+// initialized, and refuses to let a later enableremote change it. It's for
+// settings that decide object names, where a change would orphan every
+// object already stored.
+func pinConfig(e remoteConfig, name string) error {
+	value, err := e.GetConfig(name)
+	if err != nil {
+		return err
+	}
+
+	// The recorded value is prefixed with "=" so that an empty setting is
+	// distinguishable from one that was never recorded.
+	pinned, err := e.GetConfig(name + "pinned")
+	if err != nil {
+		return err
+	}
+
+	if pinned == "" {
+		return e.SetConfig(name+"pinned", "="+value)
+	}
+	if pinned != "="+value {
+		return fmt.Errorf("%v can't be changed after the remote is initialized (it was %#v); "+
+			"doing so would orphan the objects already stored", name, pinned[1:])
+	}
+
+	return nil
+}
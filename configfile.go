@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// configFile holds settings read from the file named by the configfile
+// setting (or $B2_CONFIGFILE.) The file has one "name = value" per line;
+// blank lines and lines starting with "#" or ";" are ignored, as are
+// "[section]" headers, and values may be quoted.
+//
+// Precedence, highest first: git-annex config (or arguments to a maintenance
+// command), environment variables, then the config file.
+type configFile struct {
+	path   string
+	values map[string]string
+}
+
+func loadConfigFile(path string) (*configFile, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open configfile: %v", err)
+	}
+	defer fh.Close()
+
+	cf := &configFile{path: path, values: make(map[string]string)}
+
+	scanner := bufio.NewScanner(fh)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' || line[0] == '[' {
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%v:%v: expected \"name = value\"", path, lineNo)
+		}
+		name := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		if name == "configfile" {
+			return nil, fmt.Errorf("%v:%v: configfile can't be set from a config file", path, lineNo)
+		}
+		if _, dup := cf.values[name]; dup {
+			return nil, fmt.Errorf("%v:%v: %v is set more than once", path, lineNo, name)
+		}
+		cf.values[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read configfile: %v", err)
+	}
+
+	if fi, err := fh.Stat(); err == nil && fi.Mode().Perm()&0077 != 0 {
+		if _, ok := cf.values["appkey"]; ok {
+			fmt.Fprintf(os.Stderr, "Warning: configfile %v contains appkey but is readable by other users\n", path)
+		}
+	}
+
+	return cf, nil
+}
+
+// get returns the value of name in the file, or "" if it isn't set or there
+// is no file.
+func (cf *configFile) get(name string) string {
+	if cf == nil {
+		return ""
+	}
+	return cf.values[name]
+}
+
+// openConfigFile loads the config file named by e's configfile setting or
+// $B2_CONFIGFILE, or returns nil if neither is set.
+func openConfigFile(e configSource) (*configFile, error) {
+	path, err := e.GetConfig("configfile")
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		path = os.Getenv("B2_CONFIGFILE")
+	}
+	if path == "" {
+		return nil, nil
+	}
+
+	return loadConfigFile(path)
+}
+
+// withConfigFile is a configSource that falls back to a config file for
+// settings its base source doesn't have.
+type withConfigFile struct {
+	base configSource
+	file *configFile
+}
+
+func (wc withConfigFile) GetConfig(name string) (string, error) {
+	value, err := wc.base.GetConfig(name)
+	if err != nil || value != "" {
+		return value, err
+	}
+	return wc.file.get(name), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// With cas=yes and copyparts=yes, every part of a large file is recorded in
+// a parts index inside the bucket, under the part's SHA1. When a later large
+// file has a part with the same SHA1, that part is copied from the earlier
+// file on the B2 side (b2_copy_part) instead of being uploaded again. Index
+// entries outlive the files they point into, so a failed copy just falls
+// back to uploading the part.
+
+// partSource is where a copy of a part can be found.
+type partSource struct {
+	fileID         string
+	offset, length int64
+}
+
+func (ps partSource) String() string {
+	return fmt.Sprintf("%v %d %d", ps.fileID, ps.offset, ps.length)
+}
+
+func parsePartSource(s string) (partSource, bool) {
+	fields := strings.Fields(s)
+	if len(fields) != 3 {
+		return partSource{}, false
+	}
+	offset, err1 := strconv.ParseInt(fields[1], 10, 64)
+	length, err2 := strconv.ParseInt(fields[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return partSource{}, false
+	}
+	return partSource{fileID: fields[0], offset: offset, length: length}, true
+}
+
+// canCopyParts reports whether this key can copy parts, which needs
+// permission to read the files copied from.
+func (bh *bucketHandle) canCopyParts() bool {
+	auth, err := bh.session.raw.authorization()
+	if err != nil {
+		return false
+	}
+	for _, c := range auth.Allowed.Capabilities {
+		if c == "readFiles" {
+			return true
+		}
+	}
+	debugf("not copying parts: the application key can't read files")
+	return false
+}
+
+// findPart returns a copy of the part with the given SHA1 and length, if
+// the parts index knows of one.
+func (bh *bucketHandle) findPart(sha string, length int64) (partSource, bool) {
+	data, err := bh.getSmall(bh.partsPrefix + sha)
+	if err != nil {
+		return partSource{}, false
+	}
+	src, ok := parsePartSource(string(data))
+	if !ok || src.length != length {
+		return partSource{}, false
+	}
+	return src, true
+}
+
+// recordParts adds the parts of the finished large file fileID, which have
+// the given SHA1s and sizes, to the parts index.
+func (bh *bucketHandle) recordParts(fileID string, partSHAs []string, partSizes []int64) {
+	offset := int64(0)
+	for i, sha := range partSHAs {
+		src := partSource{fileID: fileID, offset: offset, length: partSizes[i]}
+		offset += partSizes[i]
+
+		err := bh.putSmall(bh.partsPrefix+sha, []byte(src.String()), nil)
+		if err != nil {
+			debugf("couldn't record part %v of %v: %v", i+1, fileID, err)
+		}
+	}
+}
+
+type copyPartResponse struct {
+	ContentSha1 string `json:"contentSha1"`
+}
+
+// copyPart makes part of the large file fileID a copy of src, which must
+// have the SHA1 sha.
+func (bh *bucketHandle) copyPart(fileID string, part int, src partSource, sha string) error {
+	var copied copyPartResponse
+	err := bh.call("copy part", func() error {
+		return bh.session.raw.call("b2_copy_part", map[string]interface{}{
+			"sourceFileId": src.fileID,
+			"largeFileId":  fileID,
+			"partNumber":   part,
+			"range":        fmt.Sprintf("bytes=%d-%d", src.offset, src.offset+src.length-1),
+		}, &copied)
+	})
+	if err != nil {
+		return err
+	}
+	if copied.ContentSha1 != sha {
+		return fmt.Errorf("copied part has SHA1 %v instead of %v", copied.ContentSha1, sha)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Parts a large file shares with one stored earlier are copied from it on
+// the B2 side, and the copy reads back the same as an upload would.
+func TestCopyPartsRoundTrip(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f, "cas=yes", "copyparts=yes")
+
+	if err := storeTestLarge(t, be, "first", []byte("aaaabbbbcc")); err != nil {
+		t.Fatalf("storing the first file: %v", err)
+	}
+	f.resetCalls()
+
+	data := []byte("aaaabbbbdd")
+	if err := storeTestLarge(t, be, "second", data); err != nil {
+		t.Fatalf("storing the second file: %v", err)
+	}
+	if n := f.callCount("b2_copy_part"); n != 2 {
+		t.Errorf("copied %v parts; want 2", n)
+	}
+	if n := f.callCount("upload_part"); n != 1 {
+		t.Errorf("uploaded %v parts; want 1", n)
+	}
+
+	stored := f.latest("test-bucket", "second")
+	if stored == nil || !bytes.Equal(stored.data, data) {
+		t.Fatalf("the second file wasn't stored intact")
+	}
+
+	var got bytes.Buffer
+	if err := be.bucket.retrieveTo("second", &got, noProgress); err != nil {
+		t.Fatalf("downloading the second file: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("downloaded %q; want %q", got.Bytes(), data)
+	}
+}
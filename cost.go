@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The estimate command gives a rough monthly B2 bill for the remote: its
+// storage, from the usage record (see usage.go), and, given a metrics file
+// written by a typical run (see metrics.go), the transactions and egress
+// of that many runs a month. Rates default to B2's published ones and can
+// be overridden. Free allowances are per account, so they're left out.
+
+// Default rates, in US dollars.
+const (
+	defaultStorageRate = 6.95  // per TB-month
+	defaultClassBRate  = 0.004 // per 10,000 transactions
+	defaultClassCRate  = 0.004 // per 1,000 transactions
+	defaultEgressRate  = 0.01  // per GB beyond the free allowance
+
+	// B2 doesn't charge for egress up to three times the average amount
+	// stored in the month.
+	freeEgressMultiple = 3
+)
+
+// transactionClass maps the request types counted in metrics to B2's
+// transaction classes; anything else is class A, which is free.
+var transactionClass = map[string]string{
+	"download file":               "B",
+	"download file by id":         "B",
+	"download file range":         "B",
+	"get file info":               "B",
+	"list buckets":                "C",
+	"list file versions":          "C",
+	"list filenames":              "C",
+	"list unfinished large files": "C",
+}
+
+// runMetrics is what a metrics file says one run did.
+type runMetrics struct {
+	requests   map[string]int64
+	downloaded int64
+}
+
+// readRunMetrics reads the request counts and bytes downloaded from a
+// metrics file in the format metrics.format writes.
+func readRunMetrics(path string) (runMetrics, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return runMetrics{}, err
+	}
+	defer fh.Close()
+
+	rm := runMetrics{requests: make(map[string]int64)}
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var op string
+		var n int64
+		if _, err := fmt.Sscanf(line, "git_annex_remote_b2_requests_total{op=%q} %d", &op, &n); err == nil {
+			rm.requests[op] += n
+		} else if _, err := fmt.Sscanf(line, "git_annex_remote_b2_downloaded_bytes_total %d", &n); err == nil {
+			rm.downloaded = n
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return runMetrics{}, err
+	}
+	return rm, nil
+}
+
+// getRateConfig reads a non-negative amount in dollars, returning def when
+// the setting is unset.
+func getRateConfig(e configSource, name string, def float64) (float64, error) {
+	value, err := e.GetConfig(name)
+	if err != nil {
+		return 0, err
+	}
+	if value == "" {
+		return def, nil
+	}
+	rate, err := strconv.ParseFloat(strings.TrimPrefix(value, "$"), 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("%v must be an amount in dollars, not %#v", name, value)
+	}
+	return rate, nil
+}
+
+func runEstimate(be *B2Ext, config argsConfig, args []string) error {
+	rates := []struct {
+		name string
+		def  float64
+		rate float64
+	}{
+		{name: "storagerate", def: defaultStorageRate},
+		{name: "classbrate", def: defaultClassBRate},
+		{name: "classcrate", def: defaultClassCRate},
+		{name: "egressrate", def: defaultEgressRate},
+	}
+	for i := range rates {
+		rate, err := getRateConfig(config, rates[i].name, rates[i].def)
+		if err != nil {
+			return err
+		}
+		rates[i].rate = rate
+	}
+	storageRate, classBRate, classCRate, egressRate := rates[0].rate, rates[1].rate, rates[2].rate, rates[3].rate
+
+	ttl, err := getDurationConfig(config, "usagettl", time.Hour)
+	if err != nil {
+		return err
+	}
+	runs, err := getIntConfig(config, "runspermonth", 30)
+	if err != nil {
+		return err
+	}
+	metricsPath, err := config.GetConfig("metricsfrom")
+	if err != nil {
+		return err
+	}
+
+	// The saved usage is used if it's fresh, but not written, so that
+	// estimating changes nothing in the bucket.
+	buckets := []*bucketHandle{be.bucket}
+	if be.mirror != nil {
+		buckets = append(buckets, be.mirror)
+	}
+	var stored int64
+	for _, bh := range buckets {
+		report, ok := be.savedUsage(bh)
+		if !ok || time.Since(report.at) > ttl || hasFlag(args, "--refresh") {
+			report, err = be.measureUsage(bh)
+			if err != nil {
+				return err
+			}
+		}
+		stored += report.bytes
+	}
+
+	storageCost := float64(stored) / 1e12 * storageRate
+	total := storageCost
+	fmt.Printf("storage\t%v\t$%.2f\n", formatBytes(stored), storageCost)
+
+	if metricsPath == "" {
+		fmt.Printf("transactions\tunknown (pass metricsfrom=<metrics file of a typical run>)\n")
+		fmt.Printf("egress\tunknown\n")
+	} else {
+		rm, err := readRunMetrics(metricsPath)
+		if err != nil {
+			return fmt.Errorf("couldn't read metricsfrom: %v", err)
+		}
+
+		var classB, classC int64
+		for op, n := range rm.requests {
+			switch transactionClass[op] {
+			case "B":
+				classB += n
+			case "C":
+				classC += n
+			}
+		}
+		classB *= int64(runs)
+		classC *= int64(runs)
+		classBCost := float64(classB) / 10000 * classBRate
+		classCCost := float64(classC) / 1000 * classCRate
+
+		egress := rm.downloaded * int64(runs)
+		billable := egress - freeEgressMultiple*stored
+		if billable < 0 {
+			billable = 0
+		}
+		egressCost := float64(billable) / 1e9 * egressRate
+
+		total += classBCost + classCCost + egressCost
+		fmt.Printf("class B\t%v transactions\t$%.2f\n", classB, classBCost)
+		fmt.Printf("class C\t%v transactions\t$%.2f\n", classC, classCCost)
+		fmt.Printf("egress\t%v (%v beyond the free allowance)\t$%.2f\n", formatBytes(egress), formatBytes(billable), egressCost)
+	}
+
+	fmt.Printf("total\tabout $%.2f a month\n", total)
+	infof("This is a rough estimate: it leaves out B2's free allowances, which are per account, "+
+		"and assumes %v runs a month like the one in metricsfrom", runs)
+	return nil
+}
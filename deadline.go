@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+// With maxtransfertime set, a Store or Retrieve that's still going after
+// that long is aborted, however well it's progressing, so that transfers
+// fit in a backup window; git-annex can retry the key in a later run. The
+// deadline is enforced as the transfer's data is read, so it's noticed
+// within one read, and other timeouts still cover connections that stall.
+
+// transferTimeoutError is returned by a transfer that ran past its
+// deadline. It isn't retried.
+type transferTimeoutError struct {
+	limit time.Duration
+}
+
+func (err *transferTimeoutError) Error() string {
+	return fmt.Sprintf("transfer took longer than maxtransfertime of %v; aborted so it can be retried later", err.limit)
+}
+
+// isTransferTimeout reports whether err is a transferTimeoutError, possibly
+// as the failure of an HTTP request whose body it interrupted.
+func isTransferTimeout(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	_, ok := err.(*transferTimeoutError)
+	return ok
+}
+
+type deadlineReader struct {
+	r        io.Reader
+	clock    clock
+	deadline time.Time
+	limit    time.Duration
+}
+
+func (dr *deadlineReader) Read(p []byte) (int, error) {
+	if dr.clock.Now().After(dr.deadline) {
+		return 0, &transferTimeoutError{limit: dr.limit}
+	}
+	return dr.r.Read(p)
+}
+
+// withDeadline adds the maxtransfertime deadline, counted from now, to the
+// progress wrapper of a transfer.
+func (be *B2Ext) withDeadline(progress func(io.Reader) io.Reader) func(io.Reader) io.Reader {
+	if be.maxTransferTime <= 0 {
+		return progress
+	}
+	c := be.bucket.clock
+	deadline := c.Now().Add(be.maxTransferTime)
+	return chainProgress(progress, func(r io.Reader) io.Reader {
+		return &deadlineReader{r: r, clock: c, deadline: deadline, limit: be.maxTransferTime}
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// segmentMinSize is the smallest piece a segmented download splits a file
+// into; files too small to give every connection this much are downloaded
+// with a single stream.
+const segmentMinSize = 16 << 20
+
+// retrieveSegmented downloads name into fh using up to concurrency ranged
+// requests in parallel, then checks the result against the SHA1 B2 has for
+// it. fh is truncated first. Like retrieve, it returns B2's description of
+// the object.
+func (bh *bucketHandle) retrieveSegmented(name string, fh *os.File, concurrency int,
+	progress func(io.Reader) io.Reader) (*backblaze.File, error) {
+
+	found, fileID, err := bh.listFileCached(name)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list filenames: %v", err)
+	}
+	if !found {
+		// Let the plain download report the error.
+		return bh.retrieve(name, fh, false, progress)
+	}
+
+	var b2file *backblaze.File
+	err = bh.call("get file info", func() (err error) {
+		b2file, err = bh.GetFileInfo(fileID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get file info for %#v: %v", fileID, err)
+	}
+
+	size := b2file.ContentLength
+	if size < int64(concurrency)*segmentMinSize || compressionOf(b2file) != "" {
+		return bh.retrieve(name, fh, false, progress)
+	}
+
+	err = fh.Truncate(0)
+	if err == nil {
+		err = fh.Truncate(size)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sink := newProgressSink(progress)
+	defer sink.Close()
+
+	segmentSize := (size + int64(concurrency) - 1) / int64(concurrency)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrency)
+	for start := int64(0); start < size; start += segmentSize {
+		end := start + segmentSize
+		if end > size {
+			end = size
+		}
+
+		wg.Add(1)
+		go func(start, end int64) {
+			defer wg.Done()
+			errs <- bh.downloadSegment(name, fh, start, end, sink)
+		}(start, end)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	wantSHA := contentSHA1(b2file)
+	if wantSHA == "" {
+		return b2file, nil
+	}
+
+	_, err = fh.Seek(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	sha := sha1.New()
+	_, err = io.Copy(sha, fh)
+	if err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(sha.Sum(nil)) != wantSHA {
+		return nil, fmt.Errorf("segmented download of %#v has the wrong SHA1", name)
+	}
+
+	return b2file, nil
+}
+
+// downloadSegment downloads bytes [start, end) of name into the same
+// offsets of fh.
+func (bh *bucketHandle) downloadSegment(name string, fh *os.File, start, end int64, sink *progressSink) error {
+	return bh.transfer("download file range", func() error {
+		_, rc, err := bh.downloads.DownloadFileRangeByName(name, &backblaze.FileRange{
+			Start: start,
+			End:   end - 1,
+		})
+		if rc != nil {
+			defer rc.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if rc == nil {
+			return fmt.Errorf("no data returned for range of %#v", name)
+		}
+
+		w := &offsetWriter{w: fh, offset: start}
+		n, err := io.Copy(w, io.TeeReader(io.LimitReader(rc, end-start), sink))
+		bh.metrics.addDownloaded(n)
+		if err != nil {
+			return err
+		}
+		if n != end-start {
+			return &shortDownloadError{name: name, got: n, want: end - start}
+		}
+
+		return nil
+	})
+}
+
+// offsetWriter writes sequentially to w starting at offset.
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.w.WriteAt(p, ow.offset)
+	ow.offset += int64(n)
+	return n, err
+}
+
+// progressSink funnels byte counts from several concurrent transfers into a
+// single progress reader, which isn't safe for concurrent use itself. If
+// the progress reader fails (as it does past maxtransfertime), so do later
+// writes to the sink.
+type progressSink struct {
+	counts chan int
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func newProgressSink(progress func(io.Reader) io.Reader) *progressSink {
+	ps := &progressSink{
+		counts: make(chan int, 64),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(ps.done)
+		_, err := io.Copy(ioutil.Discard, progress(&countReader{counts: ps.counts}))
+		if err != nil {
+			ps.mu.Lock()
+			ps.err = err
+			ps.mu.Unlock()
+
+			// Keep accepting counts, so that senders never block.
+			for range ps.counts {
+			}
+		}
+	}()
+	return ps
+}
+
+// add reports n more bytes transferred.
+func (ps *progressSink) add(n int) {
+	ps.counts <- n
+}
+
+// Write reports len(p) more bytes transferred.
+func (ps *progressSink) Write(p []byte) (int, error) {
+	ps.mu.Lock()
+	err := ps.err
+	ps.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	ps.counts <- len(p)
+	return len(p), nil
+}
+
+func (ps *progressSink) Close() error {
+	close(ps.counts)
+	<-ps.done
+	return nil
+}
+
+// countReader produces as many (zero) bytes as are sent on counts.
+type countReader struct {
+	counts  chan int
+	pending int
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	if cr.pending == 0 {
+		n, ok := <-cr.counts
+		if !ok {
+			return 0, io.EOF
+		}
+		cr.pending = n
+	}
+
+	n := cr.pending
+	if n > len(p) {
+		n = len(p)
+	}
+	for i := range p[:n] {
+		p[i] = 0
+	}
+	cr.pending -= n
+	return n, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// BenchmarkRetrieveSegmented downloads a 64MB key from a server 50ms away
+// that sends each response at 64MB/s, as over a long, fat link where a
+// single TCP connection can't fill the pipe, with one connection and with
+// several.
+func BenchmarkRetrieveSegmented(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4<<20)
+	key := testKey(data)
+
+	for _, concurrency := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			f := newFakeB2(b)
+			f.latency = 50 * time.Millisecond
+			f.downloadRate = 64 << 20
+			be := newTestRemote(b, f, fmt.Sprintf("downloadconcurrency=%d", concurrency))
+			f.put("test-bucket", be.objectName(key), data, "", nil)
+			dir := b.TempDir()
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				file := filepath.Join(dir, fmt.Sprint(i))
+				err := be.Retrieve(nil, key, file)
+				if err != nil {
+					b.Fatalf("Retrieve: %v", err)
+				}
+				b.StopTimer()
+				got, err := ioutil.ReadFile(file)
+				if err != nil || !bytes.Equal(got, data) {
+					b.Fatalf("retrieved the wrong content (%v)", err)
+				}
+				os.Remove(file)
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// With downloadendpoint set, downloads go to that URL instead of the
+// download host B2 names when authorizing, for setups where downloads pass
+// through a CDN or proxy while API requests go to B2 directly. go-backblaze
+// takes the download host from its own authorization, so requests are
+// redirected at the transport, the way the test endpoint is (see faults.go).
+// The download URLs reported to git-annex stay B2's own, so that they
+// don't change along with the setting.
+//
+// The same transport sets the Accept-Encoding of downloads (see
+// downloadencoding below.)
+
+// parseDownloadEndpoint checks that endpoint is an https URL, with no
+// query or fragment; its path, if any, is prepended to download paths.
+func parseDownloadEndpoint(endpoint string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil ||
+		u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("downloadendpoint must be an https URL such as \"https://cdn.example.com\", not %#v", endpoint)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	return u, nil
+}
+
+// Objects stored with compress are already compressed, and compressing
+// them again in transit (as a proxy in front of B2 may, when asked to) only
+// costs time. By default, downloads then ask for the identity encoding;
+// otherwise Go's HTTP client offers gzip and transparently decodes it.
+// Either way the bytes read are those stored, which are what B2's SHA1
+// covers, so checking downloads works the same. downloadencoding=identity
+// or downloadencoding=gzip picks one regardless of compress.
+
+// getDownloadEncodingConfig reads downloadencoding, returning the
+// Accept-Encoding downloads should send, or "" to leave it to Go.
+func getDownloadEncodingConfig(e configSource, compress string) (string, error) {
+	encoding, err := e.GetConfig("downloadencoding")
+	if err != nil {
+		return "", err
+	}
+	switch encoding {
+	case "", "auto":
+		if compress != "" {
+			return "identity", nil
+		}
+		return "", nil
+	case "identity":
+		return "identity", nil
+	case "gzip":
+		return "", nil
+	default:
+		return "", fmt.Errorf("downloadencoding must be \"auto\", \"identity\" or \"gzip\", not %#v", encoding)
+	}
+}
+
+// downloadTransport sends requests for B2's download host to the download
+// endpoint instead, if there is one, and sets their Accept-Encoding.
+type downloadTransport struct {
+	next           http.RoundTripper
+	host           string
+	endpoint       *url.URL
+	acceptEncoding string
+}
+
+func (t *downloadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host {
+		return t.next.RoundTrip(req)
+	}
+
+	u := *req.URL
+	if t.endpoint != nil {
+		u.Scheme = t.endpoint.Scheme
+		u.Host = t.endpoint.Host
+		u.Path = t.endpoint.Path + req.URL.Path
+		u.RawPath = ""
+	}
+
+	r := new(http.Request)
+	*r = *req
+	r.URL = &u
+	r.Host = u.Host
+	if t.acceptEncoding != "" && req.Header.Get("Accept-Encoding") == "" {
+		r.Header = req.Header.Clone()
+		r.Header.Set("Accept-Encoding", t.acceptEncoding)
+	}
+	return t.next.RoundTrip(r)
+}
+
+// installDownloadTransport redirects the session's downloads to the
+// downloadendpoint setting, and sets their Accept-Encoding as
+// downloadencoding says, for objects stored with compression compress.
+func installDownloadTransport(e configSource, s *session, compress string) error {
+	var u *url.URL
+	endpoint, err := e.GetConfig("downloadendpoint")
+	if err != nil {
+		return err
+	}
+	if endpoint != "" {
+		u, err = parseDownloadEndpoint(endpoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	acceptEncoding, err := getDownloadEncodingConfig(e, compress)
+	if err != nil {
+		return err
+	}
+
+	if u == nil && acceptEncoding == "" {
+		if t, ok := http.DefaultTransport.(*downloadTransport); ok {
+			http.DefaultTransport = t.next
+		}
+		return nil
+	}
+
+	auth, err := s.raw.authorization()
+	if err != nil {
+		return fmt.Errorf("couldn't look up B2's download host: %v", err)
+	}
+	download, err := url.Parse(auth.DownloadURL)
+	if err != nil || download.Host == "" {
+		return fmt.Errorf("B2 returned an unusable download URL %#v", auth.DownloadURL)
+	}
+
+	t, ok := http.DefaultTransport.(*downloadTransport)
+	if !ok {
+		t = &downloadTransport{next: http.DefaultTransport}
+		http.DefaultTransport = t
+	}
+	t.host = download.Host
+	t.endpoint = u
+	t.acceptEncoding = acceptEncoding
+
+	if u != nil {
+		debugf("sending downloads for %v to %v", download.Host, u)
+	}
+	if acceptEncoding != "" {
+		debugf("asking for %v encoding of downloads", acceptEncoding)
+	}
+	return nil
+}
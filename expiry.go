@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Remotes used as a cache can give stored objects an expiry. Store tags
+// each upload with an expires file info attribute, and INITREMOTE sets
+// lifecycle rules on the prefix's keys that hide objects that many days
+// after upload and delete them a day later. Where lifecycle rules aren't
+// wanted, the expire maintenance command removes the objects past their
+// tagged expiry instead.
+
+// expiresInfoKey is the file info attribute holding an object's expiry, in
+// seconds since the Unix epoch.
+const expiresInfoKey = "expires"
+
+// expiryInfo returns the expires attribute of an object stored now.
+func (be *B2Ext) expiryInfo() string {
+	return strconv.FormatInt(be.bucket.clock.Now().Add(be.expireAfter).Unix(), 10)
+}
+
+type lifecycleRule struct {
+	FileNamePrefix            string `json:"fileNamePrefix"`
+	DaysFromUploadingToHiding *int   `json:"daysFromUploadingToHiding"`
+	DaysFromHidingToDeleting  *int   `json:"daysFromHidingToDeleting"`
+}
+
+type bucketLifecycle struct {
+	BucketID       string          `json:"bucketId"`
+	LifecycleRules []lifecycleRule `json:"lifecycleRules"`
+}
+
+// B2's lifecycle rules match names by prefix alone, and a rule on the
+// whole prefix would expire the remote's internal objects (its owner
+// marker, manifest and the like) along with the keys. Instead there's a
+// rule for each character a key can start with: git-annex keys start with
+// their backend's name, which is upper case letters and digits (or lower
+// case, with casefold=lower), while internal objects start with a dot.
+
+// lifecycleKeyStarts returns the characters keys stored by the remote can
+// start with, as far as its lifecycle rules go.
+func (be *B2Ext) lifecycleKeyStarts() string {
+	starts := "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	if be.caseFold == "lower" {
+		starts = strings.ToLower(starts)
+	}
+	return starts
+}
+
+// lifecycleCovers reports whether key's object is covered by the lifecycle
+// rules setExpiryLifecycle sets.
+func (be *B2Ext) lifecycleCovers(key string) bool {
+	folded := be.foldKey(key)
+	return folded != "" && strings.IndexByte(be.lifecycleKeyStarts(), folded[0]) >= 0
+}
+
+// warnUncovered warns that key, about to be stored, won't be expired by
+// the lifecycle rules, if it won't.
+func (be *B2Ext) warnUncovered(key string) {
+	if be.expireLifecycle && !be.lifecycleCovers(key) {
+		fmt.Fprintf(os.Stderr, "Warning: the lifecycle rules only cover keys starting with one of %v, so they "+
+			"won't expire %v; run the expire command to remove it once it has expired\n", be.lifecycleKeyStarts(), key)
+	}
+}
+
+// setLifecycleRules makes the bucket's lifecycle rules for each of prefixes
+// hide files hideDays after upload and delete them a day after that. Rules
+// for those prefixes, and any for base itself (as set by earlier versions,
+// which covered internal objects too), are replaced; others are left alone.
+func (bh *bucketHandle) setLifecycleRules(base string, prefixes []string, hideDays int) error {
+	auth, err := bh.session.raw.authorization()
+	if err != nil {
+		return fmt.Errorf("couldn't authorize: %v", err)
+	}
+
+	var list struct {
+		Buckets []bucketLifecycle `json:"buckets"`
+	}
+	err = bh.list("list buckets", func() error {
+		return bh.session.raw.call("b2_list_buckets", map[string]string{
+			"accountId": auth.AccountID,
+			"bucketId":  bh.ID,
+		}, &list)
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't read lifecycle rules of bucket %#v: %v", bh.name, err)
+	}
+	if len(list.Buckets) != 1 {
+		return fmt.Errorf("couldn't read lifecycle rules of bucket %#v: bucket not listed", bh.name)
+	}
+
+	deleteDays := 1
+	replaced := map[string]bool{base: true}
+	var rules []lifecycleRule
+	for _, prefix := range prefixes {
+		replaced[prefix] = true
+		rules = append(rules, lifecycleRule{
+			FileNamePrefix:            prefix,
+			DaysFromUploadingToHiding: &hideDays,
+			DaysFromHidingToDeleting:  &deleteDays,
+		})
+	}
+	for _, r := range list.Buckets[0].LifecycleRules {
+		if !replaced[r.FileNamePrefix] {
+			rules = append(rules, r)
+		}
+	}
+
+	err = bh.call("update bucket", func() error {
+		return bh.session.raw.call("b2_update_bucket", map[string]interface{}{
+			"accountId":      auth.AccountID,
+			"bucketId":       bh.ID,
+			"lifecycleRules": rules,
+		}, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't set lifecycle rules on bucket %#v: %v", bh.name, err)
+	}
+
+	return nil
+}
+
+// setExpiryLifecycle sets the lifecycle rules matching expireafter on each
+// bucket. The prefix must not be empty, or the rules would cover every
+// file in the bucket.
+func (be *B2Ext) setExpiryLifecycle() error {
+	days := int((be.expireAfter + 24*time.Hour - 1) / (24 * time.Hour))
+
+	var prefixes []string
+	for _, c := range be.lifecycleKeyStarts() {
+		prefixes = append(prefixes, be.prefix+string(c))
+	}
+
+	buckets := []*bucketHandle{be.bucket}
+	if be.mirror != nil {
+		buckets = append(buckets, be.mirror)
+	}
+
+	for _, bh := range buckets {
+		debugf("setting lifecycle rules on bucket %#v: hide keys under %#v after %v days", bh.name, be.prefix, days)
+		err := bh.setLifecycleRules(be.prefix, prefixes, days)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expiredKeys calls fn with each key in bh whose tagged expiry has passed,
+// and the size of its object.
+func (be *B2Ext) expiredKeys(bh *bucketHandle, fn func(key string, size int64) error) error {
+	now := bh.clock.Now().Unix()
+	return bh.listNamesWithInfo(be.prefix, func(f rawFile) error {
+		key, ok := keyInPrefix(be.prefix, f.FileName)
+		if !ok {
+			return nil
+		}
+
+		expires, err := strconv.ParseInt(f.FileInfo[expiresInfoKey], 10, 64)
+		if err != nil || expires > now {
+			return nil
+		}
+
+		return fn(key, f.ContentLength)
+	})
+}
+
+func runExpire(be *B2Ext, config argsConfig, args []string) error {
+	var expired []string
+	var sizes []int64
+	err := be.expiredKeys(be.bucket, func(key string, size int64) error {
+		expired = append(expired, key)
+		sizes = append(sizes, size)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	progress := newBatchProgress("Removing expired keys", len(expired))
+
+	for i, key := range expired {
+		debugf("removing expired key %v", key)
+
+		err = be.removeEverywhere(key)
+		if err != nil {
+			return err
+		}
+
+		progress.add(sizes[i])
+	}
+	progress.finish()
+
+	infof("removed %v expired keys", len(expired))
+	return nil
+}
+
+// removeEverywhere removes key from both buckets and the manifest, as
+// Remove would, for maintenance commands.
+func (be *B2Ext) removeEverywhere(key string) error {
+	err := be.removeKey(be.bucket, key)
+	if err != nil {
+		return err
+	}
+
+	err = be.journalRecord(journalRemove, key, 0, "")
+	if err != nil {
+		return err
+	}
+
+	if be.manifest {
+		err = be.manifestForget(be.bucket, key)
+		if err != nil {
+			return fmt.Errorf("removed %v but couldn't remove it from the manifest: %v", key, err)
+		}
+	}
+
+	if be.mirror != nil {
+		err = be.removeKey(be.mirror, key)
+		if err != nil {
+			return fmt.Errorf("couldn't remove from mirror bucket %#v: %v", be.mirror.name, err)
+		}
+	}
+
+	return nil
+}
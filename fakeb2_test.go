@@ -0,0 +1,786 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeB2 is an in-memory B2 server, speaking enough of both versions of the
+// API for go-backblaze and the raw API. Tests reach it through the test
+// endpoint (see faults.go), so nothing in them talks to real Backblaze.
+type fakeB2 struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	buckets  []*fakeBucket
+	files    []*fakeFile
+	large    map[string]*fakeLargeFile
+	nextID   int
+	calls    map[string]int
+	failures map[string][]fakeFailure
+
+	// auth is merged into every b2_authorize_account response.
+	auth map[string]interface{}
+
+	// latency delays every request, and downloadRate (if set) limits
+	// each download to that many bytes a second, as a distant server
+	// would. Both must be set before any requests are made.
+	latency      time.Duration
+	downloadRate int64
+}
+
+type fakeBucket struct {
+	ID             string        `json:"bucketId"`
+	AccountID      string        `json:"accountId"`
+	Name           string        `json:"bucketName"`
+	BucketType     string        `json:"bucketType"`
+	LifecycleRules []interface{} `json:"lifecycleRules"`
+}
+
+// fakeFile is one version of a file: an upload, or a hide marker.
+type fakeFile struct {
+	id, bucketID, name, action string
+	data                       []byte
+	sha                        string
+	info                       map[string]string
+	uploaded                   int64
+}
+
+type fakeLargeFile struct {
+	bucketID, name string
+	info           map[string]string
+	parts          map[int][]byte
+}
+
+// fakeFailure is an error to return from a call, instead of making it or
+// (if after is set) once it has been made.
+type fakeFailure struct {
+	status     int
+	code       string
+	after      bool
+	retryAfter string
+}
+
+const (
+	fakeAccountID = "fakeaccount"
+	fakeAppKey    = "fakeappkey"
+)
+
+func newFakeB2(t testing.TB) *fakeB2 {
+	f := newUnstartedFakeB2(t)
+	f.Start()
+	return f
+}
+
+// newUnstartedFakeB2 returns a fakeB2 that hasn't started serving yet, so
+// that its server can be configured first.
+func newUnstartedFakeB2(t testing.TB) *fakeB2 {
+	f := &fakeB2{
+		large:    make(map[string]*fakeLargeFile),
+		calls:    make(map[string]int),
+		failures: make(map[string][]fakeFailure),
+		auth:     make(map[string]interface{}),
+	}
+	f.Server = httptest.NewUnstartedServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// fail makes the next call to api fail with status and code.
+func (f *fakeB2) fail(api string, status int, code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[api] = append(f.failures[api], fakeFailure{status: status, code: code})
+}
+
+// failAfter makes the next call to api fail with status and code, after
+// it has been carried out.
+func (f *fakeB2) failAfter(api string, status int, code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[api] = append(f.failures[api], fakeFailure{status: status, code: code, after: true})
+}
+
+// throttle makes the next call to api fail with status, sending
+// retryAfter as its Retry-After header.
+func (f *fakeB2) throttle(api string, status int, retryAfter string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[api] = append(f.failures[api], fakeFailure{status: status, code: "too_many_requests", retryAfter: retryAfter})
+}
+
+// callCount returns how many times api has been called.
+func (f *fakeB2) callCount(api string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[api]
+}
+
+// resetCalls forgets the calls made so far.
+func (f *fakeB2) resetCalls() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = make(map[string]int)
+}
+
+// totalCalls returns how many calls have been made to any API.
+func (f *fakeB2) totalCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.calls {
+		n += c
+	}
+	return n
+}
+
+func (f *fakeB2) newID() string {
+	f.nextID++
+	return fmt.Sprintf("fakeid%06d", f.nextID)
+}
+
+func (f *fakeB2) bucketByName(name string) *fakeBucket {
+	for _, b := range f.buckets {
+		if b.Name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// addBucket creates a bucket directly, as something other than the remote
+// would.
+func (f *fakeB2) addBucket(name, bucketType string) *fakeBucket {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b := &fakeBucket{ID: f.newID(), AccountID: fakeAccountID, Name: name, BucketType: bucketType}
+	f.buckets = append(f.buckets, b)
+	return b
+}
+
+// put stores a version of name in bucket directly, with contentSha1 as the
+// SHA1 B2 reports for it (or the real one, if that's "").
+func (f *fakeB2) put(bucket, name string, data []byte, contentSha1 string, info map[string]string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if contentSha1 == "" {
+		sum := sha1.Sum(data)
+		contentSha1 = hex.EncodeToString(sum[:])
+	}
+	return f.addVersion(f.bucketByName(bucket).ID, name, "upload", data, contentSha1, info).id
+}
+
+func (f *fakeB2) addVersion(bucketID, name, action string, data []byte, sha string, info map[string]string) *fakeFile {
+	if info == nil {
+		info = make(map[string]string)
+	}
+	file := &fakeFile{
+		id:       f.newID(),
+		bucketID: bucketID,
+		name:     name,
+		action:   action,
+		data:     data,
+		sha:      sha,
+		info:     info,
+		uploaded: int64(f.nextID),
+	}
+	f.files = append(f.files, file)
+	return file
+}
+
+// versions returns the versions of name in bucket, newest first.
+func (f *fakeB2) versions(bucket, name string) []*fakeFile {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.versionsOf(f.bucketByName(bucket).ID, name)
+}
+
+func (f *fakeB2) versionsOf(bucketID, name string) []*fakeFile {
+	var vs []*fakeFile
+	for i := len(f.files) - 1; i >= 0; i-- {
+		if f.files[i].bucketID == bucketID && f.files[i].name == name {
+			vs = append(vs, f.files[i])
+		}
+	}
+	return vs
+}
+
+// latest returns the content of name in bucket, or nil if it's absent or
+// hidden.
+func (f *fakeB2) latest(bucket, name string) *fakeFile {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.latestOf(f.bucketByName(bucket).ID, name)
+}
+
+func (f *fakeB2) latestOf(bucketID, name string) *fakeFile {
+	vs := f.versionsOf(bucketID, name)
+	if len(vs) == 0 || vs[0].action != "upload" {
+		return nil
+	}
+	return vs[0]
+}
+
+func (f *fakeB2) fileByID(id string) *fakeFile {
+	for _, file := range f.files {
+		if file.id == id {
+			return file
+		}
+	}
+	return nil
+}
+
+func (file *fakeFile) json() map[string]interface{} {
+	return map[string]interface{}{
+		"accountId":       fakeAccountID,
+		"bucketId":        file.bucketID,
+		"fileId":          file.id,
+		"fileName":        file.name,
+		"action":          file.action,
+		"contentLength":   len(file.data),
+		"size":            len(file.data),
+		"contentSha1":     file.sha,
+		"contentType":     "application/octet-stream",
+		"fileInfo":        file.info,
+		"uploadTimestamp": file.uploaded,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "code": code, "message": message})
+}
+
+// apiName names the API a request is for: the b2_* call, "upload",
+// "upload_part" or "download".
+func apiName(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/file/"):
+		return "download"
+	case strings.HasPrefix(path, "/upload_part/"):
+		return "upload_part"
+	case strings.HasPrefix(path, "/upload/"):
+		return "upload"
+	}
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+func (f *fakeB2) serve(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(f.latency)
+	if data := f.handle(w, r); data != nil {
+		f.send(w, data)
+	}
+}
+
+// handle answers a request, except for the body of a download, which is
+// returned to be sent without holding the lock.
+func (f *fakeB2) handle(w http.ResponseWriter, r *http.Request) []byte {
+	api := apiName(r.URL.Path)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls[api]++
+	var failure *fakeFailure
+	if queue := f.failures[api]; len(queue) > 0 {
+		failure = &queue[0]
+		f.failures[api] = queue[1:]
+	}
+	if failure != nil && failure.retryAfter != "" {
+		w.Header().Set("Retry-After", failure.retryAfter)
+	}
+	if failure != nil && !failure.after {
+		writeError(w, failure.status, failure.code, "injected by the test")
+		return nil
+	}
+	if failure != nil {
+		w = &discardingWriter{header: make(http.Header), w: w}
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	var req map[string]interface{}
+	if r.Method == "POST" && api != "upload" && api != "upload_part" && len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeError(w, 400, "bad_json", err.Error())
+			return nil
+		}
+	}
+	str := func(name string) string {
+		s, _ := req[name].(string)
+		return s
+	}
+	num := func(name string, def int) int {
+		if n, ok := req[name].(float64); ok {
+			return int(n)
+		}
+		return def
+	}
+
+	switch api {
+	case "b2_authorize_account":
+		user, pass, _ := r.BasicAuth()
+		if user != fakeAccountID || pass != fakeAppKey {
+			writeError(w, 401, "unauthorized", "bad credentials")
+			return nil
+		}
+		resp := map[string]interface{}{
+			"accountId":               fakeAccountID,
+			"authorizationToken":      "faketoken",
+			"apiUrl":                  f.URL,
+			"downloadUrl":             f.URL,
+			"recommendedPartSize":     100 << 20,
+			"absoluteMinimumPartSize": 5 * 1000 * 1000,
+			"allowed": map[string]interface{}{
+				"capabilities": []string{"listBuckets", "listFiles", "readFiles", "writeFiles", "deleteFiles"},
+				"namePrefix":   nil,
+			},
+		}
+		for k, v := range f.auth {
+			resp[k] = v
+		}
+		writeJSON(w, resp)
+
+	case "b2_list_buckets":
+		var buckets []*fakeBucket
+		for _, b := range f.buckets {
+			if (str("bucketName") == "" || b.Name == str("bucketName")) && (str("bucketId") == "" || b.ID == str("bucketId")) {
+				buckets = append(buckets, b)
+			}
+		}
+		writeJSON(w, map[string]interface{}{"buckets": buckets})
+
+	case "b2_create_bucket":
+		if f.bucketByName(str("bucketName")) != nil {
+			writeError(w, 400, "duplicate_bucket_name", "Bucket name is already in use.")
+			return nil
+		}
+		b := &fakeBucket{ID: f.newID(), AccountID: fakeAccountID, Name: str("bucketName"), BucketType: str("bucketType")}
+		f.buckets = append(f.buckets, b)
+		writeJSON(w, b)
+
+	case "b2_update_bucket":
+		for _, b := range f.buckets {
+			if b.ID == str("bucketId") {
+				if rules, ok := req["lifecycleRules"].([]interface{}); ok {
+					b.LifecycleRules = rules
+				}
+				writeJSON(w, b)
+				return nil
+			}
+		}
+		writeError(w, 400, "bad_request", "no such bucket")
+
+	case "b2_get_upload_url":
+		writeJSON(w, map[string]string{
+			"bucketId":           str("bucketId"),
+			"uploadUrl":          f.URL + "/upload/" + str("bucketId"),
+			"authorizationToken": "fakeuploadtoken",
+		})
+
+	case "upload":
+		name, err := url.QueryUnescape(r.Header.Get("X-Bz-File-Name"))
+		if err != nil {
+			writeError(w, 400, "bad_request", "bad file name")
+			return nil
+		}
+		data, sha := body, r.Header.Get("X-Bz-Content-Sha1")
+		if sha == "hex_digits_at_end" {
+			if len(data) < 40 {
+				writeError(w, 400, "bad_request", "missing SHA1")
+				return nil
+			}
+			data, sha = data[:len(data)-40], string(data[len(data)-40:])
+		}
+		sum := sha1.Sum(data)
+		if hex.EncodeToString(sum[:]) != sha {
+			writeError(w, 400, "bad_request", "Sha1 did not match data received")
+			return nil
+		}
+		if r.Header.Get("X-Bz-Content-Sha1") == "hex_digits_at_end" {
+			sha = "unverified:" + sha
+		}
+		info := make(map[string]string)
+		for k, v := range r.Header {
+			if strings.HasPrefix(k, "X-Bz-Info-") {
+				info[strings.ToLower(k[len("X-Bz-Info-"):])] = v[0]
+			}
+		}
+		file := f.addVersion(strings.TrimPrefix(r.URL.Path, "/upload/"), name, "upload", data, sha, info)
+		writeJSON(w, file.json())
+
+	case "b2_start_large_file":
+		info := make(map[string]string)
+		if m, ok := req["fileInfo"].(map[string]interface{}); ok {
+			for k, v := range m {
+				info[k], _ = v.(string)
+			}
+		}
+		id := f.newID()
+		f.large[id] = &fakeLargeFile{bucketID: str("bucketId"), name: str("fileName"), info: info, parts: make(map[int][]byte)}
+		writeJSON(w, map[string]string{"fileId": id, "fileName": str("fileName"), "bucketId": str("bucketId")})
+
+	case "b2_get_upload_part_url":
+		writeJSON(w, map[string]string{
+			"fileId":             str("fileId"),
+			"uploadUrl":          f.URL + "/upload_part/" + str("fileId"),
+			"authorizationToken": "fakeuploadtoken",
+		})
+
+	case "upload_part":
+		lf := f.large[strings.TrimPrefix(r.URL.Path, "/upload_part/")]
+		part, _ := strconv.Atoi(r.Header.Get("X-Bz-Part-Number"))
+		sum := sha1.Sum(body)
+		if lf == nil || part < 1 || hex.EncodeToString(sum[:]) != r.Header.Get("X-Bz-Content-Sha1") {
+			writeError(w, 400, "bad_request", "bad part")
+			return nil
+		}
+		lf.parts[part] = body
+		writeJSON(w, map[string]interface{}{"partNumber": part, "contentSha1": hex.EncodeToString(sum[:])})
+
+	case "b2_copy_part":
+		lf := f.large[str("largeFileId")]
+		src := f.fileByID(str("sourceFileId"))
+		var start, end int
+		if lf == nil || src == nil {
+			writeError(w, 400, "bad_request", "no such file")
+			return nil
+		}
+		if _, err := fmt.Sscanf(str("range"), "bytes=%d-%d", &start, &end); err != nil || end >= len(src.data) {
+			writeError(w, 400, "bad_request", "bad range")
+			return nil
+		}
+		data := append([]byte(nil), src.data[start:end+1]...)
+		lf.parts[num("partNumber", 0)] = data
+		sum := sha1.Sum(data)
+		writeJSON(w, map[string]interface{}{"partNumber": num("partNumber", 0), "contentSha1": hex.EncodeToString(sum[:])})
+
+	case "b2_finish_large_file":
+		lf := f.large[str("fileId")]
+		shas, _ := req["partSha1Array"].([]interface{})
+		if lf == nil || len(shas) != len(lf.parts) {
+			writeError(w, 400, "bad_request", "no such unfinished file, or parts missing")
+			return nil
+		}
+		var data []byte
+		for i := range shas {
+			part := lf.parts[i+1]
+			sum := sha1.Sum(part)
+			if hex.EncodeToString(sum[:]) != shas[i] {
+				writeError(w, 400, "bad_request", fmt.Sprintf("part %v SHA1 doesn't match", i+1))
+				return nil
+			}
+			data = append(data, part...)
+		}
+		delete(f.large, str("fileId"))
+		file := f.addVersion(lf.bucketID, lf.name, "upload", data, "none", lf.info)
+		file.id = str("fileId")
+		writeJSON(w, file.json())
+
+	case "b2_cancel_large_file":
+		if f.large[str("fileId")] == nil {
+			writeError(w, 400, "bad_request", "no such unfinished file")
+			return nil
+		}
+		delete(f.large, str("fileId"))
+		writeJSON(w, map[string]string{"fileId": str("fileId")})
+
+	case "b2_list_unfinished_large_files":
+		var files []map[string]interface{}
+		for id, lf := range f.large {
+			if lf.bucketID == str("bucketId") && strings.HasPrefix(lf.name, str("namePrefix")) {
+				files = append(files, map[string]interface{}{"fileId": id, "fileName": lf.name, "fileInfo": lf.info})
+			}
+		}
+		writeJSON(w, map[string]interface{}{"files": files, "nextFileId": nil})
+
+	case "b2_copy_file":
+		src := f.fileByID(str("sourceFileId"))
+		if src == nil || src.action != "upload" {
+			writeError(w, 400, "bad_request", "no such file")
+			return nil
+		}
+		info := make(map[string]string)
+		for k, v := range src.info {
+			info[k] = v
+		}
+		file := f.addVersion(src.bucketID, str("fileName"), "upload", src.data, src.sha, info)
+		writeJSON(w, file.json())
+
+	case "b2_list_file_names":
+		f.listNames(w, str("bucketId"), str("startFileName"), str("prefix"), num("maxFileCount", 100))
+
+	case "b2_list_file_versions":
+		f.listVersions(w, str("bucketId"), str("startFileName"), str("startFileId"), str("prefix"), num("maxFileCount", 100))
+
+	case "b2_get_file_info":
+		file := f.fileByID(str("fileId"))
+		if file == nil || file.action != "upload" {
+			writeError(w, 404, "not_found", "file not present")
+			return nil
+		}
+		writeJSON(w, file.json())
+
+	case "b2_hide_file":
+		if f.latestOf(str("bucketId"), str("fileName")) == nil {
+			writeError(w, 400, "no_such_file", "file not present")
+			return nil
+		}
+		file := f.addVersion(str("bucketId"), str("fileName"), "hide", nil, "", nil)
+		writeJSON(w, file.json())
+
+	case "b2_delete_file_version":
+		for i, file := range f.files {
+			if file.id == str("fileId") && file.name == str("fileName") {
+				f.files = append(f.files[:i], f.files[i+1:]...)
+				writeJSON(w, map[string]string{"fileId": file.id, "fileName": file.name})
+				return nil
+			}
+		}
+		writeError(w, 400, "file_not_present", "File not present")
+
+	case "download":
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/file/"), "/", 2)
+		b := f.bucketByName(parts[0])
+		if b == nil || len(parts) < 2 {
+			writeError(w, 404, "not_found", "bucket not found")
+			return nil
+		}
+		return f.download(w, r, f.latestOf(b.ID, parts[1]))
+
+	case "b2_download_file_by_id":
+		file := f.fileByID(r.URL.Query().Get("fileId"))
+		if file != nil && file.action != "upload" {
+			file = nil
+		}
+		return f.download(w, r, file)
+
+	default:
+		writeError(w, 400, "bad_request", "the fake doesn't know "+r.URL.Path)
+	}
+
+	if failure != nil {
+		writeError(w.(*discardingWriter).real(), failure.status, failure.code, "injected by the test")
+	}
+	return nil
+}
+
+// download answers a download of file (nil if it's absent), returning the
+// data to send.
+func (f *fakeB2) download(w http.ResponseWriter, r *http.Request, file *fakeFile) []byte {
+	if file == nil {
+		writeError(w, 404, "not_found", "file not present")
+		return nil
+	}
+
+	data, status := file.data, 200
+	if rng := r.Header.Get("Range"); rng != "" {
+		var start, end int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil {
+			writeError(w, 400, "bad_request", "bad range")
+			return nil
+		}
+		if start >= len(data) {
+			writeError(w, 416, "range_not_satisfiable", "range not satisfiable")
+			return nil
+		}
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		data, status = data[start:end+1], 206
+	}
+
+	h := w.Header()
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("X-Bz-File-Id", file.id)
+	h.Set("X-Bz-File-Name", url.QueryEscape(file.name))
+	h.Set("X-Bz-Content-Sha1", file.sha)
+	for k, v := range file.info {
+		h.Set("X-Bz-Info-"+k, v)
+	}
+	w.WriteHeader(status)
+	if len(data) == 0 {
+		return nil
+	}
+	return data
+}
+
+// send writes data, no faster than downloadRate (if it's set.)
+func (f *fakeB2) send(w http.ResponseWriter, data []byte) {
+	if f.downloadRate <= 0 {
+		w.Write(data)
+		return
+	}
+	const chunk = 64 << 10
+	start := time.Now()
+	for sent := 0; sent < len(data); {
+		n := chunk
+		if n > len(data)-sent {
+			n = len(data) - sent
+		}
+		if _, err := w.Write(data[sent : sent+n]); err != nil {
+			return
+		}
+		sent += n
+		due := time.Duration(float64(sent) / float64(f.downloadRate) * float64(time.Second))
+		time.Sleep(due - time.Since(start))
+	}
+}
+
+func (f *fakeB2) listNames(w http.ResponseWriter, bucketID, start, prefix string, max int) {
+	names := make(map[string]bool)
+	for _, file := range f.files {
+		if file.bucketID == bucketID && file.name >= start && strings.HasPrefix(file.name, prefix) {
+			names[file.name] = true
+		}
+	}
+	var sorted []string
+	for name := range names {
+		if f.latestOf(bucketID, name) != nil {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+
+	var files []map[string]interface{}
+	var next interface{}
+	for i, name := range sorted {
+		if i == max {
+			next = name
+			break
+		}
+		files = append(files, f.latestOf(bucketID, name).json())
+	}
+	writeJSON(w, map[string]interface{}{"files": files, "nextFileName": next})
+}
+
+func (f *fakeB2) listVersions(w http.ResponseWriter, bucketID, startName, startID, prefix string, max int) {
+	var all []*fakeFile
+	for _, file := range f.files {
+		if file.bucketID == bucketID && file.name >= startName && strings.HasPrefix(file.name, prefix) {
+			all = append(all, file)
+		}
+	}
+	// By name, then newest first.
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].name != all[j].name {
+			return all[i].name < all[j].name
+		}
+		return all[i].uploaded > all[j].uploaded
+	})
+	if startID != "" {
+		for i, file := range all {
+			if file.id == startID {
+				all = all[i:]
+				break
+			}
+		}
+	}
+
+	var files []map[string]interface{}
+	var nextName, nextID interface{}
+	for i, file := range all {
+		if i == max {
+			nextName, nextID = file.name, file.id
+			break
+		}
+		files = append(files, file.json())
+	}
+	writeJSON(w, map[string]interface{}{"files": files, "nextFileName": nextName, "nextFileId": nextID})
+}
+
+// discardingWriter swallows the response to a call that is to fail after
+// being carried out, so that the failure can be sent instead.
+type discardingWriter struct {
+	header http.Header
+	w      http.ResponseWriter
+}
+
+func (d *discardingWriter) Header() http.Header         { return d.header }
+func (d *discardingWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardingWriter) WriteHeader(int)             {}
+func (d *discardingWriter) real() http.ResponseWriter   { return d.w }
+
+// newTestRemote sets up a remote storing into bucket "test-bucket" of f,
+// with the given settings (as name=value) on top of the credentials and
+// bucket.
+func newTestRemote(t testing.TB, f *fakeB2, settings ...string) *B2Ext {
+	be, err := setupTestRemote(t, f, settings...)
+	if err != nil {
+		t.Fatalf("couldn't set up the remote: %v", err)
+	}
+	return be
+}
+
+// setupTestRemote is newTestRemote, returning the error from setting up
+// instead of failing the test.
+func setupTestRemote(t testing.TB, f *fakeB2, settings ...string) (*B2Ext, error) {
+	config := testRemoteConfig(t, f, settings...)
+	be := &B2Ext{}
+	return be, be.setup(config, true)
+}
+
+// testRemoteConfig sends the remote's requests to f for the rest of the
+// test, and returns the config of a remote storing into bucket
+// "test-bucket", with the given settings (as name=value) on top of the
+// credentials and bucket.
+func testRemoteConfig(t testing.TB, f *fakeB2, settings ...string) argsConfig {
+	transport := http.DefaultTransport
+	wasQuiet := quiet
+	t.Cleanup(func() {
+		http.DefaultTransport = transport
+		quiet = wasQuiet
+		os.Unsetenv(testEndpointEnv)
+	})
+	os.Setenv(testEndpointEnv, f.URL)
+	quiet = true
+
+	config := argsConfig{
+		"accountid": fakeAccountID,
+		"appkey":    fakeAppKey,
+		"bucket":    "test-bucket",
+		"prefix":    "test",
+	}
+	for _, s := range settings {
+		i := strings.Index(s, "=")
+		config[s[:i]] = s[i+1:]
+	}
+	return config
+}
+
+// writeTestFile writes data to a new file in a temporary directory and
+// returns its name.
+func writeTestFile(t testing.TB, data []byte) string {
+	name := filepath.Join(t.TempDir(), "content")
+	err := ioutil.WriteFile(name, data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// testKey returns a SHA1 key for data, as git-annex would name it.
+func testKey(data []byte) string {
+	sum := sha1.Sum(data)
+	return fmt.Sprintf("SHA1-s%d--%x", len(data), sum)
+}
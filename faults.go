@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// For testing the remote's resilience, every B2 request can be redirected
+// to a fake B2 server, and failures injected into the conversation with it.
+// This is deliberately undocumented outside this file:
+//
+//   GIT_ANNEX_EXTERNAL_B2_TEST_ENDPOINT=http://127.0.0.1:8080
+//     sends requests meant for Backblaze to this server instead, and refuses
+//     to send requests anywhere else. It can't be a Backblaze host.
+//   GIT_ANNEX_EXTERNAL_B2_FAULTS=500=0.05,429=0.05,slow=0.1,truncate=0.02
+//     injects each kind of failure into that fraction of requests.
+//   GIT_ANNEX_EXTERNAL_B2_FAULT_SEED=N
+//     seeds the choice of requests to fail, for repeatable runs (default 1.)
+//
+// Failures are only ever injected into requests to the test endpoint, so
+// they can't be turned on against real Backblaze.
+
+const (
+	testEndpointEnv = "GIT_ANNEX_EXTERNAL_B2_TEST_ENDPOINT"
+	faultsEnv       = "GIT_ANNEX_EXTERNAL_B2_FAULTS"
+	faultSeedEnv    = "GIT_ANNEX_EXTERNAL_B2_FAULT_SEED"
+)
+
+var faultKinds = []string{"500", "429", "slow", "truncate"}
+
+// slowReadDelay is how long each read of a slow response body takes.
+const slowReadDelay = 100 * time.Millisecond
+
+func isBackblazeHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return host == "backblazeb2.com" || strings.HasSuffix(host, ".backblazeb2.com") ||
+		host == "backblaze.com" || strings.HasSuffix(host, ".backblaze.com")
+}
+
+func parseFaults(spec string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	if spec == "" {
+		return rates, nil
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		i := strings.Index(part, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%v: %#v is not kind=rate", faultsEnv, part)
+		}
+		kind, value := part[:i], part[i+1:]
+
+		known := false
+		for _, k := range faultKinds {
+			known = known || k == kind
+		}
+		if !known {
+			return nil, fmt.Errorf("%v: unknown kind %#v (want one of %v)",
+				faultsEnv, kind, strings.Join(faultKinds, ", "))
+		}
+
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("%v: rate %#v for %v is not between 0 and 1", faultsEnv, value, kind)
+		}
+		rates[kind] = rate
+	}
+
+	return rates, nil
+}
+
+// installTestTransport redirects http.DefaultTransport to the test
+// endpoint, if one is set.
+func installTestTransport() error {
+	endpoint := os.Getenv(testEndpointEnv)
+	faults := os.Getenv(faultsEnv)
+	if endpoint == "" {
+		if faults != "" {
+			return fmt.Errorf("%v can only be used together with %v", faultsEnv, testEndpointEnv)
+		}
+		return nil
+	}
+
+	if _, ok := http.DefaultTransport.(*testTransport); ok {
+		return nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("%v must be an http or https URL, not %#v", testEndpointEnv, endpoint)
+	}
+	if isBackblazeHost(u.Hostname()) {
+		return fmt.Errorf("%v must not be a Backblaze host", testEndpointEnv)
+	}
+
+	rates, err := parseFaults(faults)
+	if err != nil {
+		return err
+	}
+
+	seed := int64(1)
+	if s := os.Getenv(faultSeedEnv); s != "" {
+		seed, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%v must be a number, not %#v", faultSeedEnv, s)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "WARNING: sending B2 requests to the test endpoint %v\n", endpoint)
+	http.DefaultTransport = &testTransport{
+		next:     http.DefaultTransport,
+		endpoint: u,
+		rates:    rates,
+		rand:     rand.New(rand.NewSource(seed)),
+	}
+	return nil
+}
+
+// testTransport sends requests to the test endpoint and injects failures
+// into them.
+type testTransport struct {
+	next     http.RoundTripper
+	endpoint *url.URL
+	rates    map[string]float64
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// pickFault returns the kind of failure to inject into a request, or "".
+func (t *testTransport) pickFault() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, kind := range faultKinds {
+		if t.rand.Float64() < t.rates[kind] {
+			return kind
+		}
+	}
+	return ""
+}
+
+func (t *testTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isBackblazeHost(req.URL.Hostname()) {
+		u := *req.URL
+		u.Scheme = t.endpoint.Scheme
+		u.Host = t.endpoint.Host
+
+		r := new(http.Request)
+		*r = *req
+		r.URL = &u
+		r.Host = u.Host
+		req = r
+	}
+	if req.URL.Host != t.endpoint.Host {
+		return nil, fmt.Errorf("refusing to send a request to %v while %v is set", req.URL.Host, testEndpointEnv)
+	}
+
+	fault := t.pickFault()
+	switch fault {
+	case "500":
+		debugf("injecting a 500 into %v", req.URL.Path)
+		return injectedError(req, 500, "internal_error", nil), nil
+	case "429":
+		debugf("injecting a 429 into %v", req.URL.Path)
+		return injectedError(req, 429, "too_many_requests", http.Header{"Retry-After": {"1"}}), nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch fault {
+	case "slow":
+		debugf("slowing down the response to %v", req.URL.Path)
+		resp.Body = &slowBody{ReadCloser: resp.Body}
+	case "truncate":
+		debugf("truncating the response to %v", req.URL.Path)
+		resp.Body = &truncatedBody{ReadCloser: resp.Body, remaining: resp.ContentLength / 2}
+	}
+
+	return resp, nil
+}
+
+func injectedError(req *http.Request, status int, code string, header http.Header) *http.Response {
+	body := fmt.Sprintf(`{"status":%d,"code":%q,"message":"injected failure"}`, status, code)
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Content-Type", "application/json")
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %v", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(body))),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// slowBody delays every read.
+type slowBody struct {
+	io.ReadCloser
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	time.Sleep(slowReadDelay)
+	return b.ReadCloser.Read(p)
+}
+
+// truncatedBody ends the body early, as a dropped connection would.
+type truncatedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
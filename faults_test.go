@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// instantClock is the real clock, except that sleeping takes no time, so
+// that retries don't slow tests down.
+type instantClock struct {
+	realClock
+}
+
+func (instantClock) Sleep(time.Duration) {}
+
+func TestFaultsNeedTestEndpoint(t *testing.T) {
+	transport := http.DefaultTransport
+	defer func() {
+		http.DefaultTransport = transport
+		os.Unsetenv(testEndpointEnv)
+		os.Unsetenv(faultsEnv)
+	}()
+
+	os.Setenv(faultsEnv, "500=0.5")
+	if err := installTestTransport(); err == nil {
+		t.Errorf("faults were accepted without a test endpoint")
+	}
+
+	for _, endpoint := range []string{
+		"https://api.backblazeb2.com",
+		"https://f001.backblazeb2.com",
+		"https://www.backblaze.com.",
+		"ftp://127.0.0.1",
+	} {
+		os.Setenv(testEndpointEnv, endpoint)
+		if err := installTestTransport(); err == nil {
+			t.Errorf("test endpoint %v was accepted", endpoint)
+		}
+	}
+	if _, ok := http.DefaultTransport.(*testTransport); ok {
+		t.Errorf("a test transport was installed")
+	}
+}
+
+func TestParseFaults(t *testing.T) {
+	rates, err := parseFaults("500=0.05,429=0.1,slow=0,truncate=1")
+	if err != nil {
+		t.Fatalf("parseFaults: %v", err)
+	}
+	want := map[string]float64{"500": 0.05, "429": 0.1, "slow": 0, "truncate": 1}
+	for kind, rate := range want {
+		if rates[kind] != rate {
+			t.Errorf("rate of %v is %v, want %v", kind, rates[kind], rate)
+		}
+	}
+
+	for _, spec := range []string{"500", "404=0.1", "500=1.5", "500=-1", "500=often"} {
+		if _, err := parseFaults(spec); err == nil {
+			t.Errorf("parseFaults(%#v) succeeded", spec)
+		}
+	}
+}
+
+// With a good share of requests failing in every way the test transport
+// knows, transfers are retried until they get through intact.
+func TestTransfersSurviveFaults(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f, "retries=20", "retrybudget=1000h", "maxconsecutivefailures=0")
+	be.retry.clock = instantClock{}
+
+	rates, err := parseFaults("500=0.1,429=0.1,slow=0.02,truncate=0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	http.DefaultTransport.(*testTransport).rates = rates
+
+	var keys []string
+	contents := make(map[string][]byte)
+	for i := 0; i < 10; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i)}, i*10000+1)
+		key := testKey(data)
+		keys = append(keys, key)
+		contents[key] = data
+
+		err := be.Store(nil, key, writeTestFile(t, data))
+		if err != nil {
+			t.Fatalf("Store %v: %v", key, err)
+		}
+	}
+
+	dir := t.TempDir()
+	for _, key := range keys {
+		present, err := be.CheckPresent(nil, key)
+		if err != nil || !present {
+			t.Errorf("CheckPresent %v = %v, %v; want true, nil", key, present, err)
+		}
+
+		file := filepath.Join(dir, key)
+		err = be.Retrieve(nil, key, file)
+		if err != nil {
+			t.Errorf("Retrieve %v: %v", key, err)
+			continue
+		}
+		got, err := ioutil.ReadFile(file)
+		if err != nil || !bytes.Equal(got, contents[key]) {
+			t.Errorf("retrieved the wrong content for %v (%v)", key, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// B2 limits each object to 10 file info attributes, of at most 7000 bytes
+// all told (counting each attribute's header name and value). With enough
+// of the optional attributes set, and long values for the free text ones,
+// a store could go over that and fail every time, so fitFileInfo trims the
+// file info to fit, giving up the least important attributes first.
+
+const (
+	maxInfoAttrs = 10
+	maxInfoBytes = 7000
+
+	// infoHeaderPrefix is counted as part of each attribute's size.
+	infoHeaderPrefix = "X-Bz-Info-"
+)
+
+// infoPriority lists the attributes Store sets, most important first.
+// compression is needed to read the object back at all, large_file_sha1
+// (added for large files) to check it, and annex_key to tell which key it
+// holds, so those are never dropped; the others are given up from the end
+// of the list.
+var infoPriority = []string{
+	compressionInfoKey,
+	largeFileSHA1InfoKey,
+	foldedKeyInfoKey,
+	expiresInfoKey,
+	batchInfoKey,
+	gitHeadInfoKey,
+	tagInfoKey,
+	filenameInfoKey,
+}
+
+// essentialInfo is how many of infoPriority are never dropped.
+const essentialInfo = 3
+
+// truncatableInfo are the attributes holding free text, which are
+// shortened before anything is dropped.
+var truncatableInfo = map[string]bool{
+	tagInfoKey:      true,
+	filenameInfoKey: true,
+}
+
+func infoAttrSize(name, value string) int {
+	return len(infoHeaderPrefix) + len(name) + len(value)
+}
+
+// fitFileInfo returns info trimmed to fit B2's limits on file info, with
+// room to spare for large_file_sha1. Attributes are truncated or dropped in
+// reverse order of infoPriority, and each one is noted with debugf.
+func fitFileInfo(key string, info map[string]string) map[string]string {
+	// Room is kept for the large file SHA1, which isn't in info yet.
+	reserve := infoAttrSize(largeFileSHA1InfoKey, strings.Repeat("0", 40))
+	attrs, size := 1, reserve
+	for name, value := range info {
+		attrs++
+		size += infoAttrSize(name, value)
+	}
+	if attrs <= maxInfoAttrs && size <= maxInfoBytes {
+		return info
+	}
+
+	// Attributes not in infoPriority sort after all of those, by name.
+	order := append([]string(nil), infoPriority...)
+	var others []string
+	for name := range info {
+		if priorityOf(name) < 0 {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	order = append(order, others...)
+
+	fitted := make(map[string]string, len(info))
+	for name, value := range info {
+		fitted[name] = value
+	}
+
+	for i := len(order) - 1; i >= essentialInfo && (attrs > maxInfoAttrs || size > maxInfoBytes); i-- {
+		name := order[i]
+		value, ok := fitted[name]
+		if !ok {
+			continue
+		}
+
+		if attrs <= maxInfoAttrs && truncatableInfo[name] {
+			over := size - maxInfoBytes
+			if over < len(value) {
+				short := truncateEscaped(value, len(value)-over)
+				debugf("file info of %v is too large for B2; truncating %v from %v to %v bytes",
+					key, name, len(value), len(short))
+				fitted[name] = short
+				size -= len(value) - len(short)
+				continue
+			}
+		}
+
+		debugf("file info of %v is too large for B2; leaving out %v", key, name)
+		delete(fitted, name)
+		attrs--
+		size -= infoAttrSize(name, value)
+	}
+
+	return fitted
+}
+
+func priorityOf(name string) int {
+	for i, n := range infoPriority {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// truncateEscaped shortens the percent-encoded value to at most n bytes,
+// without splitting an escape.
+func truncateEscaped(value string, n int) string {
+	if n >= len(value) {
+		return value
+	}
+	value = value[:n]
+	if i := strings.LastIndex(value, "%"); i >= 0 && i >= len(value)-2 {
+		value = value[:i]
+	}
+	return value
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// infoSize returns the number of attributes and bytes info counts for
+// against B2's limits, with room for large_file_sha1.
+func infoSize(info map[string]string) (attrs, size int) {
+	attrs, size = 1, infoAttrSize(largeFileSHA1InfoKey, strings.Repeat("0", 40))
+	for name, value := range info {
+		attrs++
+		size += infoAttrSize(name, value)
+	}
+	return attrs, size
+}
+
+func TestFitFileInfoUnchanged(t *testing.T) {
+	info := map[string]string{compressionInfoKey: "gzip", filenameInfoKey: "some%2Ffile"}
+	fitted := fitFileInfo("KEY", info)
+	if len(fitted) != 2 || fitted[filenameInfoKey] != "some%2Ffile" {
+		t.Fatalf("info that fits was changed to %v", fitted)
+	}
+}
+
+// A filename too long to fit is truncated to fit exactly, without
+// splitting an escape, and the other attributes are kept.
+func TestFitFileInfoTruncates(t *testing.T) {
+	info := map[string]string{
+		compressionInfoKey: "zstd",
+		tagInfoKey:         "tag",
+		filenameInfoKey:    strings.Repeat("%2F", 3000),
+	}
+	fitted := fitFileInfo("KEY", info)
+
+	if attrs, size := infoSize(fitted); attrs > maxInfoAttrs || size > maxInfoBytes || size < maxInfoBytes-2 {
+		t.Fatalf("fitted info has %v attributes of %v bytes; want at most %v, just under %v bytes",
+			attrs, size, maxInfoAttrs, maxInfoBytes)
+	}
+	if fitted[compressionInfoKey] != "zstd" || fitted[tagInfoKey] != "tag" {
+		t.Fatalf("truncating the filename lost other attributes: %v", fitted)
+	}
+	if name := fitted[filenameInfoKey]; len(name)%3 != 0 || !strings.HasSuffix(name, "%2F") {
+		t.Fatalf("the filename was truncated in the middle of an escape: ...%v", name[len(name)-4:])
+	}
+}
+
+// With too many attributes, the least important are left out, and the
+// essential ones never are.
+func TestFitFileInfoDrops(t *testing.T) {
+	info := make(map[string]string)
+	for _, name := range infoPriority {
+		info[name] = "x"
+	}
+	for i := 0; len(info) < maxInfoAttrs+2; i++ {
+		info[fmt.Sprintf("extra%d", i)] = "x"
+	}
+	fitted := fitFileInfo("KEY", info)
+
+	if attrs, _ := infoSize(fitted); attrs != maxInfoAttrs {
+		t.Fatalf("fitted info has %v attributes; want %v", attrs, maxInfoAttrs)
+	}
+	for _, name := range infoPriority[:essentialInfo] {
+		if _, ok := fitted[name]; !ok {
+			t.Errorf("essential attribute %v was left out", name)
+		}
+	}
+	// Attributes Store doesn't know of go first, from the end.
+	for _, name := range []string{"extra1", "extra2", "extra3"} {
+		if _, ok := fitted[name]; ok {
+			t.Errorf("%v was kept over more important attributes", name)
+		}
+	}
+	if _, ok := fitted["extra0"]; !ok {
+		t.Errorf("extra0 was left out, although leaving out less was enough")
+	}
+}
+
+func TestTruncateEscaped(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		n     int
+		want  string
+	}{
+		{"ab%2Fc", 6, "ab%2Fc"},
+		{"ab%2Fc", 5, "ab%2F"},
+		{"ab%2Fc", 4, "ab"},
+		{"ab%2Fc", 3, "ab"},
+		{"ab%2Fc", 2, "ab"},
+	} {
+		if got := truncateEscaped(c.value, c.n); got != c.want {
+			t.Errorf("truncateEscaped(%q, %v) = %q; want %q", c.value, c.n, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// With recordfilename=yes, Store records the name of a work tree file using
+// each key as file info on its object, so that a bucket of keys can be
+// browsed and recovered by hand.
+
+// filenameInfoKey is the file info attribute holding the original file
+// name, percent-encoded since B2 passes file info in HTTP headers.
+const filenameInfoKey = "filename"
+
+// maxFilenameInfo is the longest (encoded) file name recorded; B2 limits
+// the total size of an object's file info.
+const maxFilenameInfo = 1024
+
+// originalFilename returns the name of a work tree file using key, or ""
+// if none can be found. git-annex usually hands Store the key's object
+// file, named after the key itself, so the file name is looked up with
+// git annex whereused (run in the repository, which is the working
+// directory of the remote) in that case.
+func originalFilename(key, file string) string {
+	if base := filepath.Base(file); base != key {
+		return base
+	}
+
+	out, err := exec.Command("git", "annex", "whereused", "--key="+key).Output()
+	if err != nil {
+		debugf("couldn't find a file using %v: %v", key, err)
+		return ""
+	}
+
+	// Each line is the key, a space, and a file using it.
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if file := strings.TrimPrefix(scanner.Text(), key+" "); file != scanner.Text() {
+			return filepath.Base(file)
+		}
+	}
+
+	return ""
+}
+
+// filenameInfo returns the filename attribute for key, stored from file.
+func filenameInfo(key, file string) string {
+	name := url.QueryEscape(originalFilename(key, file))
+	if len(name) > maxFilenameInfo {
+		return ""
+	}
+	return name
+}
+
+// recordedInfo returns the file info recorded on the content of key in bh,
+// or nil if it isn't there.
+func (be *B2Ext) recordedInfo(bh *bucketHandle, key string) (map[string]string, error) {
+	name, err := be.contentName(bh, key)
+	if err != nil {
+		return nil, err
+	}
+
+	found, fileID, err := bh.listFileCached(name)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	var b2file *backblaze.File
+	err = bh.call("get file info", func() (err error) {
+		b2file, err = bh.GetFileInfo(fileID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get file info for %#v: %v", fileID, err)
+	}
+	if b2file == nil {
+		return nil, nil
+	}
+
+	return b2file.FileInfo, nil
+}
+
+// infoValue decodes a percent-encoded file info value, returning "" if it
+// can't be decoded.
+func infoValue(info map[string]string, name string) string {
+	value, err := url.QueryUnescape(info[name])
+	if err != nil {
+		return ""
+	}
+	return value
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// The fixsha1 command repairs objects B2 has no SHA1 for, as left by other
+// tools that upload large files without one. Without it, store can't tell
+// such an object already holds the right content, and downloads of it
+// can't be verified. Each one is downloaded, hashed and uploaded again with
+// its SHA1 set, replacing the old version. This downloads and uploads every
+// such object in full, so it's only ever run explicitly.
+
+// missingSHA1 lists the objects in bh under the remote's prefixes that B2
+// has no SHA1 for.
+func (be *B2Ext) missingSHA1(bh *bucketHandle) ([]rawFile, error) {
+	prefixes := []string{be.prefix}
+	if be.cas && !strings.HasPrefix(be.casPrefix, be.prefix) {
+		prefixes = append(prefixes, be.casPrefix)
+	}
+
+	var missing []rawFile
+	for _, prefix := range prefixes {
+		err := bh.listNamesWithInfo(prefix, func(f rawFile) error {
+			if f.sha1() == "" {
+				missing = append(missing, f)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+// fixSHA1 downloads f and uploads it again with its SHA1 set, returning the
+// SHA1.
+func (bh *bucketHandle) fixSHA1(f rawFile) (string, error) {
+	tmp, err := ioutil.TempFile("", "git-annex-remote-b2-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	b2file, err := bh.retrieveByID(f.FileID, tmp)
+	if err != nil {
+		return "", fmt.Errorf("couldn't download: %v", err)
+	}
+	if compressionOf(b2file) != "" {
+		// The download was decompressed, so it isn't what's stored.
+		return "", errors.New("object is compressed, and compressed objects are always stored with a SHA1")
+	}
+
+	sum, err := hashFile(tmp, sha1.New())
+	if err != nil {
+		return "", err
+	}
+	length, err := tmp.Seek(0, 1)
+	if err != nil {
+		return "", err
+	}
+	if length != f.ContentLength {
+		return "", fmt.Errorf("downloaded %v bytes, but the object is %v bytes", length, f.ContentLength)
+	}
+	_, err = tmp.Seek(0, 0)
+	if err != nil {
+		return "", err
+	}
+
+	hashed := func() ([]byte, int64, error) {
+		sha := sha1.New()
+		n, err := io.Copy(sha, tmp)
+		if err != nil {
+			return nil, 0, err
+		}
+		_, err = tmp.Seek(0, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		return sha.Sum(nil), n, nil
+	}
+
+	err = bh.store(f.FileName, tmp, f.FileInfo, noProgress, hashed)
+	if err != nil {
+		return "", err
+	}
+	return sum, nil
+}
+
+func runFixSHA1(be *B2Ext, config argsConfig, args []string) error {
+	dryRun := hasFlag(args, "--dry-run")
+	bh := be.bucket
+
+	missing, err := be.missingSHA1(bh)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, f := range missing {
+		total += f.ContentLength
+	}
+
+	if dryRun {
+		for _, f := range missing {
+			fmt.Printf("%v\t%d\n", f.FileName, f.ContentLength)
+		}
+		fmt.Printf("%v objects (%v) have no SHA1; fixing them downloads and uploads all of it\n",
+			len(missing), formatBytes(total))
+		return nil
+	}
+
+	progress := newBatchProgress("Fixing SHA1s", len(missing))
+	var failed int
+	for _, f := range missing {
+		sum, err := bh.fixSHA1(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: couldn't fix %v: %v\n", f.FileName, err)
+			failed++
+			continue
+		}
+		fmt.Printf("fixed\t%v\t%v\n", f.FileName, sum)
+		progress.add(f.ContentLength)
+	}
+	progress.finish()
+
+	infof("Fixed the SHA1 of %v of %v objects", len(missing)-failed, len(missing))
+	if failed > 0 {
+		return fmt.Errorf("%v objects couldn't be fixed", failed)
+	}
+	return nil
+}
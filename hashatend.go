@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Normally the SHA1 of a file has to be known before uploading it, which
+// means reading the file twice. With hashatend=yes, files small enough for
+// a single upload are instead hashed as they're uploaded, and the SHA1 sent
+// after the data (B2's "hex_digits_at_end"), reading the file only once.
+// go-backblaze can't do this, so these uploads go through the raw API.
+
+type uploadURL struct {
+	UploadURL          string `json:"uploadUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+type uploadResponse struct {
+	FileID      string `json:"fileId"`
+	ContentSha1 string `json:"contentSha1"`
+}
+
+// encodeFileName percent-encodes name for the X-Bz-File-Name header.
+func encodeFileName(name string) string {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		parts[i] = strings.Replace(url.PathEscape(part), "+", "%2B", -1)
+	}
+	return strings.Join(parts, "/")
+}
+
+// trailingHash reads as the hex digest of h, computed at its first read.
+type trailingHash struct {
+	h      hash.Hash
+	digest io.Reader
+}
+
+func (th *trailingHash) Read(p []byte) (int, error) {
+	if th.digest == nil {
+		th.digest = strings.NewReader(hex.EncodeToString(th.h.Sum(nil)))
+	}
+	return th.digest.Read(p)
+}
+
+// storeHashAtEnd uploads length bytes from fh as name, hashing them on the
+// way, and returns their SHA1 and the new file's ID.
+func (bh *bucketHandle) storeHashAtEnd(name string, fh io.ReadSeeker, length int64, info map[string]string,
+	progress func(io.Reader) io.Reader) ([]byte, string, error) {
+
+	var sha hash.Hash
+	var uploaded uploadResponse
+	first := true
+	err := bh.transfer("upload file", func() error {
+		if !first {
+			_, err := fh.Seek(0, 0)
+			if err != nil {
+				return err
+			}
+		}
+		first = false
+
+		var target uploadURL
+		err := bh.session.raw.call("b2_get_upload_url", map[string]string{"bucketId": bh.ID}, &target)
+		if err != nil {
+			return err
+		}
+
+		sha = sha1.New()
+		data := io.TeeReader(io.LimitReader(fh, length), sha)
+		body := io.MultiReader(bh.metrics.uploadCounter(progress(data)), &trailingHash{h: sha})
+
+		req, err := http.NewRequest("POST", target.UploadURL, body)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = length + sha1.Size*2
+		req.Header.Set("Authorization", target.AuthorizationToken)
+		req.Header.Set("X-Bz-File-Name", encodeFileName(name))
+		req.Header.Set("Content-Type", "b2/x-auto")
+		req.Header.Set("X-Bz-Content-Sha1", "hex_digits_at_end")
+		for k, v := range info {
+			req.Header.Set("X-Bz-Info-"+k, v)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		return decodeResponse(resp, &uploaded)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	sum := sha.Sum(nil)
+	if got, _ := parseContentSHA1(uploaded.ContentSha1, nil); got != hex.EncodeToString(sum) {
+		return nil, "", fmt.Errorf("uploaded %#v but B2 reports SHA1 %v instead of %v",
+			name, uploaded.ContentSha1, hex.EncodeToString(sum))
+	}
+
+	return sum, uploaded.FileID, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+)
+
+// With hashatend, the SHA1 asked for after the upload (here, by the
+// manifest) must be of the whole file, not of what's left past the upload.
+func TestHashAtEndThenHash(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f, "hashatend=yes", "manifest=yes")
+
+	data := []byte("hashed on the way up")
+	key := testKey(data)
+	if err := be.Store(nil, key, writeTestFile(t, data)); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	stored := f.latest("test-bucket", be.objectName(key))
+	if stored == nil || !bytes.Equal(stored.data, data) {
+		t.Fatalf("%v wasn't stored", key)
+	}
+
+	sum := sha1.Sum(data)
+	entry := be.manifestEntryName(manifestEntry{key: key, size: int64(len(data)), sha: hex.EncodeToString(sum[:])})
+	if f.latest("test-bucket", entry) == nil {
+		t.Fatalf("manifest entry %v is missing", entry)
+	}
+}
+
+// BenchmarkStoreHashAtEnd stores a 32MB key with and without hashatend.
+func BenchmarkStoreHashAtEnd(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 2<<20)
+	key := testKey(data)
+
+	for _, hashAtEnd := range []string{"no", "yes"} {
+		b.Run("hashatend="+hashAtEnd, func(b *testing.B) {
+			f := newFakeB2(b)
+			be := newTestRemote(b, f, "hashatend="+hashAtEnd)
+			file := writeTestFile(b, data)
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := be.Store(nil, key, file)
+				if err != nil {
+					b.Fatalf("Store: %v", err)
+				}
+				b.StopTimer()
+				if err := be.Remove(nil, key); err != nil {
+					b.Fatalf("Remove: %v", err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
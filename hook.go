@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// With poststorehook set, Store runs that shell command after each key it
+// stores successfully, to tie the remote into other systems (monitoring, a
+// catalog and the like.) The hook is best-effort: its failure is only
+// warned about, and it's killed if it runs longer than poststorehooktimeout,
+// so that it can't hold up transfers for long.
+
+// defaultPostStoreHookTimeout is how long the hook may run unless
+// poststorehooktimeout says otherwise.
+const defaultPostStoreHookTimeout = 30 * time.Second
+
+// runPostStoreHook runs the post-store hook, if there is one, for key,
+// stored as the object name (or "" for a packed key) of size bytes. The
+// hook gets them as its arguments, and as $B2_KEY, $B2_OBJECT and $B2_SIZE,
+// along with $B2_BUCKET.
+func (be *B2Ext) runPostStoreHook(key, name string, size int64) {
+	if be.postStoreHook == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), be.postStoreHookTimeout)
+	defer cancel()
+
+	sizeArg := strconv.FormatInt(size, 10)
+	cmd := exec.CommandContext(ctx, "sh", "-c", be.postStoreHook+` "$@"`, "poststorehook", key, name, sizeArg)
+	cmd.Env = append(os.Environ(),
+		"B2_KEY="+key,
+		"B2_OBJECT="+name,
+		"B2_SIZE="+sizeArg,
+		"B2_BUCKET="+be.bucket.name,
+	)
+	// Standard output carries the git-annex protocol, so the hook's output
+	// goes to standard error. Both are handed over as they are rather
+	// than through pipes, so nothing the hook leaves running can hold up
+	// waiting for it.
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("killed after poststorehooktimeout of %v", be.postStoreHookTimeout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: poststorehook failed for %v: %v\n", key, err)
+		return
+	}
+	debugf("poststorehook for %v took %v", key, time.Since(start))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// internalDir is the sub-prefix under which the remote keeps its own
+// objects (manifests, indexes, parts and the like.) git-annex keys never
+// contain a slash, so nothing under it can collide with a stored key.
+// Every internal object is named with internalName, and everything that
+// scans the prefix for keys goes through keyInPrefix, which skips them.
+const internalDir = ".git-annex-remote-b2/"
+
+// internalName returns the object name of the internal object called name.
+func (be *B2Ext) internalName(name string) string {
+	return be.prefix + internalDir + name
+}
+
+// isReserved reports whether name is in some remote's internal namespace.
+func isReserved(name string) bool {
+	return strings.Contains("/"+name, "/"+internalDir)
+}
+
+// keyInPrefix returns the key stored as object name directly under prefix
+// in the normal layout. Names of internal objects, and of anything nested
+// deeper (such as another remote's prefix inside this one), aren't keys.
+func keyInPrefix(prefix, name string) (string, bool) {
+	if !strings.HasPrefix(name, prefix) {
+		return "", false
+	}
+	key := strings.TrimPrefix(name, prefix)
+	if key == "" || strings.Contains(key, "/") {
+		return "", false
+	}
+	return key, true
+}
+
+// maxNameLength is the longest object name B2 accepts, in bytes of UTF-8.
+const maxNameLength = 1024
+
+// minKeyRoom is how much of maxNameLength a prefix must leave for keys and
+// internal names; SHA256E keys of files with long extensions approach it.
+const minKeyRoom = 256
+
+// validatePrefix makes sure prefix doesn't point into another remote's
+// internal namespace, where its keys could collide with internal objects.
+func validatePrefix(prefix string) error {
+	if isReserved(prefix) {
+		return fmt.Errorf("prefix %#v must not contain %#v, which is reserved for internal objects",
+			prefix, strings.TrimSuffix(internalDir, "/"))
+	}
+	if len(prefix) > maxNameLength-minKeyRoom {
+		return fmt.Errorf("prefix is %v bytes long, which leaves too little of B2's %v byte limit on names for keys",
+			len(prefix), maxNameLength)
+	}
+	return nil
+}
+
+// validateCASPrefix makes sure a shared casprefix doesn't point into any
+// remote's internal namespace either.
+func validateCASPrefix(casPrefix string) error {
+	if isReserved(casPrefix) {
+		return fmt.Errorf("casprefix %#v must not contain %#v, which is reserved for internal objects",
+			casPrefix, strings.TrimSuffix(internalDir, "/"))
+	}
+	return nil
+}
+
+// validateKey makes sure key can't reach outside the prefix's key namespace,
+// which also keeps it out of the internal one.
+func validateKey(key string) error {
+	if key == "" {
+		return errors.New("key is empty")
+	}
+	if strings.Contains(key, "/") {
+		return fmt.Errorf("key %#v contains a slash", key)
+	}
+	return nil
+}
+
+// checkNameLengths makes sure the names of the objects that would hold key
+// fit B2's limit, which B2 only reports with an opaque upload failure.
+func (be *B2Ext) checkNameLengths(key string) error {
+	names := []string{be.objectName(key)}
+	if be.cas {
+		names = []string{be.casIndexName(key)}
+	}
+	if be.pack {
+		names = append(names, be.internalName("packs/removed/"+key))
+	}
+	if be.journalSecret != nil {
+		names = append(names, be.longestJournalName(key))
+	}
+	for _, name := range names {
+		if len(name) > maxNameLength {
+			return fmt.Errorf("can't store %v: its object name %#v would be %v bytes long, but B2 allows at most %v; "+
+				"use a shorter prefix, or a key backend with shorter keys", key, name, len(name), maxNameLength)
+		}
+	}
+	return nil
+}
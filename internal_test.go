@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// boundaryKey returns a key whose object name in be is exactly length
+// bytes long.
+func boundaryKey(be *B2Ext, length int) string {
+	key := "SHA256E-s4--"
+	return key + strings.Repeat("a", length-len(be.objectName(key)))
+}
+
+func TestNameLengthBoundary(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f)
+	file := writeTestFile(t, []byte("data"))
+
+	key := boundaryKey(be, maxNameLength)
+	if err := be.Store(nil, key, file); err != nil {
+		t.Fatalf("storing a key with a %v byte name: %v", maxNameLength, err)
+	}
+	if f.latest("test-bucket", be.objectName(key)) == nil {
+		t.Fatalf("the key with a %v byte name wasn't stored", maxNameLength)
+	}
+
+	f.resetCalls()
+	key = boundaryKey(be, maxNameLength+1)
+	err := be.Store(nil, key, file)
+	if err == nil || !strings.Contains(err.Error(), "B2 allows at most") {
+		t.Fatalf("storing a key with a %v byte name returned %v; want a name length error", maxNameLength+1, err)
+	}
+	if n := f.callCount("upload"); n != 0 {
+		t.Fatalf("uploaded %v times for a key whose name is too long", n)
+	}
+}
+
+func TestPrefixLengthBoundary(t *testing.T) {
+	if err := validatePrefix(strings.Repeat("p", maxNameLength-minKeyRoom)); err != nil {
+		t.Fatalf("a %v byte prefix was refused: %v", maxNameLength-minKeyRoom, err)
+	}
+	if err := validatePrefix(strings.Repeat("p", maxNameLength-minKeyRoom+1)); err == nil {
+		t.Fatalf("a %v byte prefix was accepted", maxNameLength-minKeyRoom+1)
+	}
+}
+
+func TestValidatePrefix(t *testing.T) {
+	for _, test := range []struct {
+		prefix string
+		ok     bool
+	}{
+		{"", true},
+		{"annex/", true},
+		{"annex-", true},
+		{"photos/.git-annex-remote-b2-old/", true},
+		{".git-annex-remote-b2/", false},
+		{".git-annex-remote-b2/annex/", false},
+		{"annex/.git-annex-remote-b2/", false},
+		{"annex/.git-annex-remote-b2/more/", false},
+	} {
+		err := validatePrefix(test.prefix)
+		if test.ok && err != nil {
+			t.Errorf("validatePrefix(%#v) refused it: %v", test.prefix, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("validatePrefix(%#v) accepted it", test.prefix)
+		}
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	for _, test := range []struct {
+		key string
+		ok  bool
+	}{
+		{"SHA256E-s4--9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08.txt", true},
+		{"WORM-s0-m0--a", true},
+		{"", false},
+		{"/", false},
+		{"SHA256E-s4--a/b", false},
+		{"../SHA256E-s4--a", false},
+		{".git-annex-remote-b2/manifests/a", false},
+	} {
+		err := validateKey(test.key)
+		if test.ok && err != nil {
+			t.Errorf("validateKey(%#v) refused it: %v", test.key, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("validateKey(%#v) accepted it", test.key)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// With journalsecret set, the remote keeps a journal of every key it
+// stores or removes, signed with an HMAC keyed by the secret, and the
+// verifyjournal command checks the bucket against it: an object changed or
+// removed by anything other than this remote no longer matches its latest
+// entry, and an entry forged without the secret fails its HMAC. Like the
+// manifest, each entry is an empty object named
+//
+//	<prefix>.git-annex-remote-b2/journal/<key>/<time>/<op>/<size>/<sha1>/<hmac>
+//
+// so recording one is a single upload that never replaces anything, and
+// concurrent writers can't lose each other's entries. Someone with write
+// access to the bucket can still delete entries, which shows up as keys
+// whose latest entry is an older one, or that have none at all; an object
+// lock on the journal's prefix prevents that.
+
+type journalEntry struct {
+	key  string
+	at   int64 // nanoseconds since the Unix epoch
+	op   string
+	size int64
+	sha  string
+	mac  string
+}
+
+const (
+	journalStore  = "store"
+	journalRemove = "remove"
+)
+
+func (be *B2Ext) journalKeyPrefix(key string) string {
+	return be.internalName("journal/" + key + "/")
+}
+
+// journalMAC returns the HMAC of ent's contents, keyed by secret.
+func journalMAC(secret []byte, ent journalEntry) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%v\n%d\n%v\n%d\n%v\n", ent.key, ent.at, ent.op, ent.size, ent.sha)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (be *B2Ext) journalEntryName(ent journalEntry) string {
+	return fmt.Sprintf("%v%d/%v/%d/%v/%v", be.journalKeyPrefix(ent.key), ent.at, ent.op, ent.size, ent.sha, ent.mac)
+}
+
+// longestJournalName returns the longest name a journal entry for key can
+// have, for checkNameLengths.
+func (be *B2Ext) longestJournalName(key string) string {
+	return be.journalEntryName(journalEntry{
+		key:  key,
+		at:   1<<63 - 1,
+		op:   journalRemove,
+		size: 1<<63 - 1,
+		sha:  strings.Repeat("0", 2*sha1.Size),
+		mac:  strings.Repeat("0", 2*sha256.Size),
+	})
+}
+
+func (be *B2Ext) parseJournalEntry(name string) (journalEntry, bool) {
+	parts := strings.Split(strings.TrimPrefix(name, be.internalName("journal/")), "/")
+	if len(parts) != 6 {
+		return journalEntry{}, false
+	}
+	at, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return journalEntry{}, false
+	}
+	size, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return journalEntry{}, false
+	}
+	return journalEntry{key: parts[0], at: at, op: parts[2], size: size, sha: parts[4], mac: parts[5]}, true
+}
+
+// journalRecord adds an entry for op on key to the journal, if there is
+// one. size and sha describe the object stored; a removal has neither.
+func (be *B2Ext) journalRecord(op, key string, size int64, sha string) error {
+	if be.journalSecret == nil {
+		return nil
+	}
+	if sha == "" {
+		sha = "-"
+	}
+
+	ent := journalEntry{key: key, at: time.Now().UnixNano(), op: op, size: size, sha: sha}
+	ent.mac = journalMAC(be.journalSecret, ent)
+	err := be.bucket.putSmall(be.journalEntryName(ent), nil, nil)
+	if err != nil {
+		return fmt.Errorf("couldn't record the %v of %v in the journal: %v", op, key, err)
+	}
+	return nil
+}
+
+// getJournalSecret reads the journalsecret setting, or $B2_JOURNAL_SECRET,
+// which keeps the secret out of the git-annex branch.
+func getJournalSecret(e configSource) ([]byte, error) {
+	secret, err := e.GetConfig("journalsecret")
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		secret = os.Getenv("B2_JOURNAL_SECRET")
+	}
+	if secret == "" {
+		return nil, nil
+	}
+	if len(secret) < 16 {
+		return nil, errors.New("journalsecret must be at least 16 characters long")
+	}
+	addSecret(secret)
+	return []byte(secret), nil
+}
+
+// journaledObject is the current state of a key's object in the bucket.
+type journaledObject struct {
+	size int64
+	sha  string
+}
+
+// currentObjects returns the object holding each key stored in bh.
+func (be *B2Ext) currentObjects(bh *bucketHandle) (map[string]journaledObject, error) {
+	objects := make(map[string]journaledObject)
+
+	if !be.cas {
+		err := bh.listNamesWithInfo(be.prefix, func(f rawFile) error {
+			if key, ok := keyInPrefix(be.prefix, f.FileName); ok {
+				objects[key] = journaledObject{size: f.ContentLength, sha: f.sha1()}
+			}
+			return nil
+		})
+		if err != nil || bh.packs == nil {
+			return objects, err
+		}
+		err = bh.packs.keys(func(ent packEntry, packName string) error {
+			objects[ent.key] = journaledObject{size: ent.length, sha: ent.sha}
+			return nil
+		})
+		return objects, err
+	}
+
+	content := make(map[string]journaledObject)
+	err := bh.listNamesWithInfo(be.casPrefix+"objects/", func(f rawFile) error {
+		content[f.FileName] = journaledObject{size: f.ContentLength, sha: f.sha1()}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = be.storedKeys(bh, func(key, contentName string, size int64, sha string) error {
+		// Content that's gone is reported as changed.
+		obj, ok := content[contentName]
+		if !ok {
+			obj = journaledObject{size: -1}
+		}
+		objects[key] = obj
+		return nil
+	})
+	return objects, err
+}
+
+func runVerifyJournal(be *B2Ext, config argsConfig, args []string) error {
+	if be.journalSecret == nil {
+		return errors.New("verifyjournal needs journalsecret (or $B2_JOURNAL_SECRET) to be set")
+	}
+	bh := be.bucket
+
+	latest := make(map[string]journalEntry)
+	var problems int
+	report := func(status, key, detail string) {
+		problems++
+		fmt.Printf("%v\t%v\t%v\n", status, key, detail)
+	}
+
+	err := bh.listNames(be.internalName("journal/"), func(f backblaze.FileStatus) error {
+		ent, ok := be.parseJournalEntry(f.Name)
+		if !ok {
+			report("forged", f.Name, "not a journal entry")
+			return nil
+		}
+		if !hmac.Equal([]byte(ent.mac), []byte(journalMAC(be.journalSecret, ent))) {
+			report("forged", ent.key, fmt.Sprintf("entry %v has a bad HMAC", f.Name))
+			return nil
+		}
+		if prev, ok := latest[ent.key]; !ok || ent.at > prev.at {
+			latest[ent.key] = ent
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	objects, err := be.currentObjects(bh)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for key := range latest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		ent := latest[key]
+		obj, present := objects[key]
+		when := time.Unix(0, ent.at).UTC().Format(time.RFC3339)
+		switch {
+		case ent.op == journalRemove && present:
+			report("reappeared", key, fmt.Sprintf("removed at %v, but present", when))
+		case ent.op == journalStore && !present:
+			report("missing", key, fmt.Sprintf("stored at %v, but gone", when))
+		case ent.op == journalStore && (obj.sha != ent.sha || obj.size != ent.size):
+			report("changed", key, fmt.Sprintf("stored at %v with SHA1 %v and %v bytes, but now has SHA1 %#v and %v bytes",
+				when, ent.sha, ent.size, obj.sha, obj.size))
+		}
+	}
+
+	var unjournaled int
+	for key := range objects {
+		if _, ok := latest[key]; !ok {
+			unjournaled++
+			fmt.Printf("unjournaled\t%v\tpresent, but has no journal entry\n", key)
+		}
+	}
+
+	infof("checked %v journaled keys: %v problems, %v keys with no journal entry", len(latest), problems, unjournaled)
+	if problems > 0 {
+		return fmt.Errorf("the bucket doesn't match its journal in %v places", problems)
+	}
+	return nil
+}
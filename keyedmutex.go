@@ -0,0 +1,42 @@
+package main
+
+import "sync"
+
+// keyedMutex is a set of mutexes, one per name, that exist only while
+// they're held or waited for. The zero value is ready to use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks name, and returns the function that unlocks it.
+func (km *keyedMutex) lock(name string) func() {
+	km.mu.Lock()
+	if km.locks == nil {
+		km.locks = make(map[string]*keyedLock)
+	}
+	l := km.locks[name]
+	if l == nil {
+		l = &keyedLock{}
+		km.locks[name] = l
+	}
+	l.refs++
+	km.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		km.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(km.locks, name)
+		}
+		km.mu.Unlock()
+	}
+}
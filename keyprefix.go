@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// B2 application keys can be restricted to names starting with a given
+// prefix. Used outside of it, such a key gets an unhelpful 401 on every
+// request, so the configured prefix is checked against the restriction up
+// front, and initremote defaults the prefix to it. Keys can also lack
+// capabilities, such as listFiles for a read-only key, which changes how
+// presence is checked (see chooseCheckPresent).
+
+// namePrefixRestriction returns the prefix the session's application key is
+// restricted to, or "" if it isn't restricted (or the restriction can't be
+// looked up.)
+func (s *session) namePrefixRestriction() string {
+	auth, err := s.raw.authorization()
+	if err != nil {
+		debugf("couldn't look up the application key's restrictions: %v", err)
+		return ""
+	}
+	if auth.Allowed.NamePrefix == nil {
+		return ""
+	}
+	return *auth.Allowed.NamePrefix
+}
+
+// checkNamePrefix makes sure every name the remote uses is allowed by the
+// application key's name prefix restriction.
+func (be *B2Ext) checkNamePrefix() error {
+	restriction := be.bucket.session.namePrefixRestriction()
+	if restriction == "" {
+		return nil
+	}
+
+	if !strings.HasPrefix(be.prefix, restriction) {
+		return fmt.Errorf("the application key can only use names starting with %#v, but prefix is %#v; "+
+			"set a prefix within %#v, or use a key without a name prefix restriction",
+			restriction, strings.TrimSuffix(be.prefix, "/"), restriction)
+	}
+	if be.cas && !strings.HasPrefix(be.casPrefix, restriction) {
+		return fmt.Errorf("the application key can only use names starting with %#v, but casprefix is %#v",
+			restriction, strings.TrimSuffix(be.casPrefix, "/"))
+	}
+
+	return nil
+}
+
+// restrictedPrefix returns the prefix to use by default with a key
+// restricted to names starting with restriction.
+func restrictedPrefix(restriction string) string {
+	return strings.TrimSuffix(restriction, "/")
+}
+
+// hasCapability reports whether the session's application key has the
+// named capability (such as "listFiles"), and whether that could be looked
+// up at all.
+func (s *session) hasCapability(name string) (has, known bool) {
+	auth, err := s.raw.authorization()
+	if err != nil {
+		debugf("couldn't look up the application key's capabilities: %v", err)
+		return false, false
+	}
+	for _, c := range auth.Allowed.Capabilities {
+		if c == name {
+			return true, true
+		}
+	}
+	return false, true
+}
@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+// initConfig is git-annex's config of a remote being initialized.
+type initConfig struct {
+	argsConfig
+}
+
+func (c initConfig) SetConfig(name, value string) error {
+	c.argsConfig[name] = value
+	return nil
+}
+
+func (initConfig) GetUUID() (string, error) {
+	return "00000000-0000-0000-0000-000000000000", nil
+}
+
+// restrictKey makes f's application key only allow names starting with
+// namePrefix.
+func restrictKey(f *fakeB2, namePrefix string) {
+	f.auth["allowed"] = map[string]interface{}{
+		"capabilities": []string{"listBuckets", "listFiles", "readFiles", "writeFiles", "deleteFiles"},
+		"namePrefix":   namePrefix,
+	}
+}
+
+// Without a prefix, initremote with a key restricted to a name prefix uses
+// that prefix, and saves it.
+func TestInitRemoteRestrictedKey(t *testing.T) {
+	f := newFakeB2(t)
+	restrictKey(f, "team/")
+	config := initConfig{testRemoteConfig(t, f, "prefix=")}
+
+	be := &B2Ext{}
+	if err := be.initRemote(config); err != nil {
+		t.Fatalf("initremote: %v", err)
+	}
+	if be.prefix != "team/" {
+		t.Fatalf("the remote uses prefix %#v; want %#v", be.prefix, "team/")
+	}
+	if config.argsConfig["prefix"] != "team" {
+		t.Fatalf("saved prefix %#v; want %#v", config.argsConfig["prefix"], "team")
+	}
+}
+
+// A prefix outside the key's restriction is refused, and nothing is saved.
+func TestInitRemoteOutsideRestriction(t *testing.T) {
+	f := newFakeB2(t)
+	restrictKey(f, "team/")
+	config := initConfig{testRemoteConfig(t, f, "prefix=other")}
+
+	be := &B2Ext{}
+	if err := be.initRemote(config); err == nil {
+		t.Fatalf("initremote succeeded with a prefix the key can't use")
+	}
+	if config.argsConfig["prefix"] != "other" {
+		t.Fatalf("prefix was changed to %#v", config.argsConfig["prefix"])
+	}
+}
+
+// A prefix taken from the key is only saved once everything checks out.
+func TestInitRemoteRestrictedKeyFails(t *testing.T) {
+	f := newFakeB2(t)
+	restrictKey(f, "team/")
+	config := initConfig{testRemoteConfig(t, f, "prefix=", "cas=yes", "casprefix=elsewhere")}
+
+	be := &B2Ext{}
+	if err := be.initRemote(config); err == nil {
+		t.Fatalf("initremote succeeded with a casprefix the key can't use")
+	}
+	if config.argsConfig["prefix"] != "" {
+		t.Fatalf("saved prefix %#v although initremote failed", config.argsConfig["prefix"])
+	}
+}
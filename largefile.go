@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// B2 takes at most 5GB in a single upload; anything larger has to be
+// uploaded as a large file, in parts. go-backblaze doesn't support large
+// files, so they're uploaded through the raw API.
+
+const (
+	// largeFilePartSize is the size of each part of a large file.
+	largeFilePartSize = 100 << 20
+
+	// largeFileThreshold is the size above which files are uploaded as
+	// large files. Smaller files go up in one request, which is cheaper.
+	largeFileThreshold = 2 * largeFilePartSize
+)
+
+// largeFileSHA1InfoKey is the file info attribute that B2 recommends for
+// the SHA1 of a large file, which B2 doesn't compute itself (it reports a
+// content SHA1 of "none".)
+const largeFileSHA1InfoKey = "large_file_sha1"
+
+// contentSHA1 returns the hex SHA1 of b2file's content, or "" if B2
+// doesn't know it.
+func contentSHA1(b2file *backblaze.File) string {
+	sha, _ := parseContentSHA1(b2file.ContentSha1, b2file.FileInfo)
+	return sha
+}
+
+// parseContentSHA1 interprets the content SHA1 B2 reports for a file with
+// file info info: it returns the SHA1 in hex, or "" if B2 doesn't know it,
+// and whether it was verified on upload. Files whose SHA1 was only sent
+// after their content are reported as "unverified:<sha1>", and large files
+// as "none", with this remote's SHA1 for them in their info; B2 can't do
+// better for large files, so those count as verified.
+func parseContentSHA1(contentSha1 string, info map[string]string) (sha string, verified bool) {
+	if strings.HasPrefix(contentSha1, "unverified:") {
+		return strings.TrimPrefix(contentSha1, "unverified:"), false
+	}
+	if contentSha1 != "" && contentSha1 != "none" {
+		return contentSha1, true
+	}
+	sha = info[largeFileSHA1InfoKey]
+	return sha, sha != ""
+}
+
+type largeFileResponse struct {
+	FileID   string `json:"fileId"`
+	FileName string `json:"fileName"`
+}
+
+type uploadPartURL struct {
+	UploadURL          string `json:"uploadUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+// storeLarge uploads length bytes from fh as a large file called name,
+// with the given SHA1 and file info.
+func (bh *bucketHandle) storeLarge(name string, fh io.ReadSeeker, info map[string]string,
+	progress func(io.Reader) io.Reader, sha []byte, length int64) error {
+
+	fileInfo := map[string]string{largeFileSHA1InfoKey: hex.EncodeToString(sha)}
+	for k, v := range info {
+		fileInfo[k] = v
+	}
+
+	var started largeFileResponse
+	err := bh.call("start large file", func() error {
+		return bh.session.raw.call("b2_start_large_file", map[string]interface{}{
+			"bucketId":    bh.ID,
+			"fileName":    name,
+			"contentType": "b2/x-auto",
+			"fileInfo":    fileInfo,
+		}, &started)
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't start large file: %v", err)
+	}
+	debugf("started large file %v for %v", started.FileID, name)
+
+	partSHAs, partSizes, err := bh.uploadParts(started.FileID, fh, progress, length)
+	if err == nil {
+		err = bh.finishLargeFile(name, started.FileID, partSHAs)
+	}
+	if err != nil {
+		cancelErr := bh.call("cancel large file", func() error {
+			return bh.session.raw.call("b2_cancel_large_file", map[string]string{
+				"fileId": started.FileID,
+			}, nil)
+		})
+		if cancelErr != nil {
+			debugf("couldn't cancel large file %v: %v", started.FileID, cancelErr)
+		}
+		return err
+	}
+
+	if bh.copyParts {
+		bh.recordParts(started.FileID, partSHAs, partSizes)
+	}
+
+	return nil
+}
+
+// hashPart returns the SHA1 of the size bytes of fh at offset.
+func hashPart(fh io.ReadSeeker, offset, size int64) (string, error) {
+	_, err := fh.Seek(offset, 0)
+	if err != nil {
+		return "", err
+	}
+	hash := sha1.New()
+	_, err = io.CopyN(hash, fh, size)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// uploadParts uploads the parts of the large file fileID from fh (or
+// copies them, with copyparts), and returns their SHA1s and sizes.
+func (bh *bucketHandle) uploadParts(fileID string, fh io.ReadSeeker,
+	progress func(io.Reader) io.Reader, length int64) ([]string, []int64, error) {
+
+	sink := newProgressSink(progress)
+	defer sink.Close()
+
+	copyParts := bh.copyParts && bh.canCopyParts()
+
+	var partURL *uploadPartURL
+	var partSHAs []string
+	var partSizes []int64
+	for part, offset := 1, int64(0); offset < length; part++ {
+		size := bh.partSizer.next(part, offset, length)
+		partSHA, err := hashPart(fh, offset, size)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't hash part %v: %v", part, err)
+		}
+
+		if copyParts {
+			if src, ok := bh.findPart(partSHA, size); ok {
+				err = bh.copyPart(fileID, part, src, partSHA)
+				if err == nil {
+					debugf("copied part %v from %v instead of uploading it", part, src.fileID)
+					sink.add(int(size))
+					partSHAs = append(partSHAs, partSHA)
+					partSizes = append(partSizes, size)
+					offset += size
+					continue
+				}
+				debugf("couldn't copy part %v from %v, uploading it: %v", part, src.fileID, err)
+			}
+		}
+
+		var started time.Time
+		err = bh.transfer("upload part", func() error {
+			// A part that timed out is retried at the smaller size
+			// the part sizer has since chosen.
+			if newSize := bh.partSizer.next(part, offset, length); newSize != size {
+				newSHA, err := hashPart(fh, offset, newSize)
+				if err != nil {
+					return err
+				}
+				size, partSHA = newSize, newSHA
+			}
+
+			if partURL == nil {
+				partURL = &uploadPartURL{}
+				err := bh.session.raw.call("b2_get_upload_part_url", map[string]string{
+					"fileId": fileID,
+				}, partURL)
+				if err != nil {
+					partURL = nil
+					return err
+				}
+			}
+
+			_, err := fh.Seek(offset, 0)
+			if err != nil {
+				return err
+			}
+			body := bh.metrics.uploadCounter(io.TeeReader(io.LimitReader(fh, size), sink))
+
+			started = time.Now()
+			err = uploadPart(partURL, part, body, size, partSHA)
+			if err != nil {
+				// B2 asks for a new upload URL after any failure.
+				partURL = nil
+				bh.partSizer.failed(size, err)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't upload part %v: %v", part, err)
+		}
+		if offset+size < length {
+			// The last part is usually short, which says little
+			// about the connection.
+			bh.partSizer.uploaded(size, time.Since(started))
+		}
+
+		partSHAs = append(partSHAs, partSHA)
+		partSizes = append(partSizes, size)
+		offset += size
+	}
+
+	return partSHAs, partSizes, nil
+}
+
+// finishLargeFileTimeout bounds each attempt at finishing a large file.
+const finishLargeFileTimeout = 5 * time.Minute
+
+// finishLargeFile finishes the large file fileID. Finishing a file with
+// many parts can take long enough for the request to time out even though
+// B2 went on to finish the file, and finishing it again then fails with a
+// confusing error; so after any failure, the file's listing is checked to
+// see whether it was finished after all.
+func (bh *bucketHandle) finishLargeFile(name, fileID string, partSHAs []string) error {
+	err := bh.call("finish large file", func() error {
+		err := bh.session.raw.callTimeout("b2_finish_large_file", map[string]interface{}{
+			"fileId":        fileID,
+			"partSha1Array": partSHAs,
+		}, nil, finishLargeFileTimeout)
+		if err == nil {
+			return nil
+		}
+
+		finished, checkErr := bh.largeFileFinished(name, fileID)
+		if checkErr != nil {
+			debugf("couldn't check whether large file %v was finished: %v", fileID, checkErr)
+			return err
+		}
+		if finished {
+			debugf("finishing large file %v failed (%v), but it was finished anyway", fileID, err)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't finish large file: %v", err)
+	}
+	return nil
+}
+
+// largeFileFinished reports whether fileID is the latest version of name,
+// which it only becomes once it's finished.
+func (bh *bucketHandle) largeFileFinished(name, fileID string) (bool, error) {
+	var page rawFileList
+	err := bh.session.raw.call("b2_list_file_names", map[string]interface{}{
+		"bucketId":      bh.ID,
+		"startFileName": name,
+		"maxFileCount":  1,
+	}, &page)
+	if err != nil {
+		return false, err
+	}
+
+	return len(page.Files) > 0 && page.Files[0].FileName == name && page.Files[0].FileID == fileID, nil
+}
+
+func uploadPart(partURL *uploadPartURL, part int, body io.Reader, size int64, sha string) error {
+	req, err := http.NewRequest("POST", partURL.UploadURL, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Authorization", partURL.AuthorizationToken)
+	req.Header.Set("X-Bz-Part-Number", strconv.Itoa(part))
+	req.Header.Set("X-Bz-Content-Sha1", sha)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return decodeResponse(resp, nil)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+)
+
+// storeTestLarge uploads data to name in be's bucket as a large file in
+// parts of 4 bytes.
+func storeTestLarge(t *testing.T, be *B2Ext, name string, data []byte) error {
+	t.Helper()
+	be.bucket.partSizer = newPartSizer(4, 4, 4, false)
+	sha := sha1.Sum(data)
+	return be.bucket.storeLarge(name, bytes.NewReader(data), nil, noProgress, sha[:], int64(len(data)))
+}
+
+// Finishing a large file can time out after B2 has finished it; the upload
+// has still succeeded, and mustn't be cancelled or reported as failed.
+func TestFinishLargeFileTimeout(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f, "retries=0")
+
+	data := []byte("ten bytes!")
+	f.failAfter("b2_finish_large_file", 408, "request_timeout")
+	if err := storeTestLarge(t, be, "large", data); err != nil {
+		t.Fatalf("storeLarge: %v", err)
+	}
+
+	if n := f.callCount("b2_finish_large_file"); n != 1 {
+		t.Errorf("b2_finish_large_file called %v times; want 1", n)
+	}
+	if n := f.callCount("b2_cancel_large_file"); n != 0 {
+		t.Errorf("b2_cancel_large_file called %v times; want 0", n)
+	}
+	latest := f.latest("test-bucket", "large")
+	if latest == nil || !bytes.Equal(latest.data, data) {
+		t.Fatalf("large file wasn't stored")
+	}
+}
+
+// If finishing a large file really did fail, the upload fails and the
+// unfinished file is cancelled.
+func TestFinishLargeFileFailure(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f, "retries=0")
+
+	f.fail("b2_finish_large_file", 408, "request_timeout")
+	if err := storeTestLarge(t, be, "large", []byte("ten bytes!")); err == nil {
+		t.Fatalf("storeLarge succeeded although finishing failed")
+	}
+
+	if n := f.callCount("b2_cancel_large_file"); n != 1 {
+		t.Errorf("b2_cancel_large_file called %v times; want 1", n)
+	}
+	if f.latest("test-bucket", "large") != nil {
+		t.Fatalf("large file was stored although finishing failed")
+	}
+}
+
+// An object with no SHA1 B2 knows of, or one it hasn't verified, is
+// uploaded again even if it holds the right content; one with this
+// remote's SHA1 for a large file isn't.
+func TestStoreOverUnknownSHA1(t *testing.T) {
+	data := []byte("content with a doubtful SHA1")
+	sum := sha1.Sum(data)
+	sha := hex.EncodeToString(sum[:])
+
+	for _, c := range []struct {
+		name        string
+		contentSha1 string
+		info        map[string]string
+		reupload    bool
+	}{
+		{"none", "none", nil, true},
+		{"unverified", "unverified:" + sha, nil, true},
+		{"large file", "none", map[string]string{largeFileSHA1InfoKey: sha}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			f := newFakeB2(t)
+			be := newTestRemote(t, f)
+			key := testKey(data)
+			name := be.objectName(key)
+			f.put("test-bucket", name, data, c.contentSha1, c.info)
+
+			if err := be.Store(nil, key, writeTestFile(t, data)); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			if got := f.callCount("upload") > 0; got != c.reupload {
+				t.Fatalf("uploaded again: %v; want %v", got, c.reupload)
+			}
+			versions := f.versions("test-bucket", name)
+			if len(versions) != 1 {
+				t.Fatalf("%v has %v versions; want 1", name, len(versions))
+			}
+			if c.reupload && versions[0].sha != sha {
+				t.Fatalf("the new version has SHA1 %v; want %v", versions[0].sha, sha)
+			}
+		})
+	}
+}
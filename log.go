@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// quiet suppresses informational messages on stderr. Warnings and errors
+// are always printed, and progress sent to git-annex over the protocol is
+// unaffected.
+var quiet = os.Getenv("GIT_ANNEX_EXTERNAL_B2_QUIET") != ""
+
+// logJSON, set by logformat=json, writes log messages to stderr as JSON
+// objects, one per line, and adds one for every protocol request and B2
+// API call, for log pipelines.
+var logJSON bool
+
+func debugEnabled() bool {
+	return os.Getenv("GIT_ANNEX_EXTERNAL_B2_DEBUG") != ""
+}
+
+// debugf logs a diagnostic message to stderr when
+// GIT_ANNEX_EXTERNAL_B2_DEBUG is set in the environment.
+func debugf(format string, args ...interface{}) {
+	if !debugEnabled() {
+		return
+	}
+	if logJSON {
+		writeLogEvent(logEvent{Level: "debug", Msg: fmt.Sprintf(format, args...)})
+		return
+	}
+	fmt.Fprintf(os.Stderr, "git-annex-remote-b2: "+redact(format)+"\n", redactArgs(args)...)
+}
+
+// infof prints an informational message to stderr unless quiet is set.
+func infof(format string, args ...interface{}) {
+	if quiet {
+		return
+	}
+	if logJSON {
+		writeLogEvent(logEvent{Level: "info", Msg: fmt.Sprintf(format, args...)})
+		return
+	}
+	fmt.Fprintf(os.Stderr, redact(format)+"\n", redactArgs(args)...)
+}
+
+// logEvent is one line of JSON log output.
+type logEvent struct {
+	Time       string `json:"time"`
+	Level      string `json:"level"`
+	Msg        string `json:"msg,omitempty"`
+	Op         string `json:"op,omitempty"`
+	Key        string `json:"key,omitempty"`
+	Object     string `json:"object,omitempty"`
+	Bytes      int64  `json:"bytes,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+	Result     string `json:"result,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+var logMu sync.Mutex
+
+func writeLogEvent(ev logEvent) {
+	ev.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	ev.Msg = redact(ev.Msg)
+	ev.Error = redact(ev.Error)
+
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	os.Stderr.Write(append(line, '\n'))
+}
+
+// logOp records a finished operation: a protocol request (op is the
+// request's name, such as "TRANSFER STORE") or a B2 API call. With
+// logformat=json it's always logged; otherwise only when debugging.
+func logOp(op, key, object string, bytes int64, took time.Duration, err error) {
+	result := "ok"
+	errText := ""
+	if err != nil {
+		result = "error"
+		errText = err.Error()
+	}
+
+	if logJSON {
+		writeLogEvent(logEvent{
+			Level:      "info",
+			Op:         op,
+			Key:        key,
+			Object:     object,
+			Bytes:      bytes,
+			DurationMS: int64(took / time.Millisecond),
+			Result:     result,
+			Error:      errText,
+		})
+		return
+	}
+
+	subject := strings.TrimSpace(op + " " + key + " " + object)
+	if err != nil {
+		debugf("%v failed after %v: %v", subject, took, err)
+	} else {
+		debugf("%v took %v", subject, took)
+	}
+}
+
+// secrets are strings that must never appear in logs, such as the
+// application key and authorization tokens.
+var (
+	secretsMu sync.Mutex
+	secrets   []string
+)
+
+// addSecret keeps s out of all log output from now on.
+func addSecret(s string) {
+	if s == "" {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets = append(secrets, s)
+}
+
+func redact(s string) string {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, "[REDACTED]", -1)
+	}
+	return s
+}
+
+func redactArgs(args []interface{}) []interface{} {
+	redacted := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			redacted[i] = redact(v)
+		case error:
+			redacted[i] = redact(v.Error())
+		default:
+			redacted[i] = arg
+		}
+	}
+	return redacted
+}
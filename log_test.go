@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Secrets are kept out of informational messages as well as debug ones.
+func TestInfofRedacts(t *testing.T) {
+	wasQuiet, wasJSON := quiet, logJSON
+	secretsMu.Lock()
+	wasSecrets := secrets
+	secretsMu.Unlock()
+	t.Cleanup(func() {
+		quiet, logJSON = wasQuiet, wasJSON
+		secretsMu.Lock()
+		secrets = wasSecrets
+		secretsMu.Unlock()
+	})
+	quiet = false
+
+	const secret = "K001sUpErSeCrEtToKeN"
+	addSecret(secret)
+
+	for _, json := range []bool{false, true} {
+		logJSON = json
+		out := captureStderr(t, func() {
+			infof("token " + secret + " in the format")
+			infof("token %v in a string", secret)
+			infof("token %v in an error", errors.New("bad auth "+secret))
+		})
+		if strings.Contains(out, secret) {
+			t.Errorf("with logJSON=%v, infof wrote the secret: %q", json, out)
+		}
+		if n := strings.Count(out, "[REDACTED]"); n != 3 {
+			t.Errorf("with logJSON=%v, infof redacted %v times, want 3: %q", json, n, out)
+		}
+	}
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/encryptio/go-git-annex-external/external"
@@ -16,278 +18,1541 @@ import (
 )
 
 type B2Ext struct {
-	bucket *backblaze.Bucket
+	bucket *bucketHandle
 	prefix string
 
-	lastList struct {
-		setAt time.Time
-		file  string
-		found bool
-		id    string
+	// caseFold is "lower" or "upper" to fold keys to that case in object
+	// names, or "" to use keys exactly as git-annex gives them.
+	caseFold string
+
+	// cas selects the content-addressed layout (see cas.go), with content
+	// stored under casPrefix.
+	cas       bool
+	casPrefix string
+
+	// mirror is a second bucket that receives a copy of every stored key,
+	// or nil if no mirror bucket is configured.
+	mirror       *bucketHandle
+	mirrorStrict bool
+
+	retry   *retrier
+	metrics *metrics
+
+	// retrieveExisting is what Retrieve does with data already in the
+	// destination file: "resume", "overwrite" or "refuse".
+	retrieveExisting string
+
+	// downloadConcurrency is the number of connections Retrieve splits
+	// large downloads across.
+	downloadConcurrency int
+
+	// manifest keeps the manifest (see manifest.go) updated on every store
+	// and remove.
+	manifest bool
+
+	// strictOwnership makes a foreign owner marker an error rather than a
+	// warning.
+	strictOwnership bool
+
+	// compress is the compression ("gzip" or "zstd") applied to newly
+	// stored objects, or "" for none.
+	compress      string
+	compressLevel int
+	// compressDir is where compressed copies of files are staged: git-annex's
+	// own temporary directory, or "" for next to the file outside a
+	// repository.
+	compressDir string
+
+	// showRate prints the transfer rate and ETA of each transfer to stderr.
+	showRate bool
+
+	// maxSize is the largest file Store will upload, or 0 for no limit.
+	maxSize int64
+
+	// recordFilename records the original file name of each stored key
+	// (see filename.go).
+	recordFilename bool
+
+	// recordCommit and uploadTag record the repository state each key was
+	// stored from (see audit.go).
+	recordCommit bool
+	uploadTag    string
+
+	// batchID tags stored objects for removebatch (see batch.go).
+	batchID string
+
+	// postStoreHook is a shell command run after each store (see hook.go),
+	// for at most postStoreHookTimeout.
+	postStoreHook        string
+	postStoreHookTimeout time.Duration
+
+	// journalSecret keys the HMACs of the journal of stores and removals
+	// (see journal.go), or is nil for no journal.
+	journalSecret []byte
+
+	// hashAtEnd hashes stored files while uploading them (see
+	// hashatend.go).
+	hashAtEnd bool
+
+	// cache is the local cache of retrieved keys, or nil (see cache.go).
+	cache *retrieveCache
+
+	// bloom makes Prepare build a bloom filter of the bucket's presence
+	// objects, for CheckPresent to consult first (see bloom.go).
+	bloom       bool
+	bloomFPRate float64
+
+	// checkPresent is how CheckPresent looks for keys: "list",
+	// "download", or "auto" to list unless the application key can't.
+	checkPresent string
+
+	// expireAfter is how long stored objects are meant to be kept (see
+	// expiry.go), or 0 to keep them indefinitely.
+	expireAfter     time.Duration
+	expireLifecycle bool
+
+	// pack stores keys of up to packThreshold bytes in packs (see pack.go)
+	// instead of as objects of their own.
+	pack          bool
+	packThreshold int64
+
+	// cleanupUnfinishedAge is the age past which Prepare cancels
+	// unfinished large files (see unfinished.go), or 0 to leave them.
+	cleanupUnfinishedAge time.Duration
+
+	// maxTransferTime caps how long a Store or Retrieve may run (see
+	// deadline.go), or is 0 for no cap.
+	maxTransferTime time.Duration
+
+	// fileMode is the permissions Retrieve gives the files it writes, or
+	// 0 to leave them to the umask.
+	fileMode os.FileMode
+
+	// storing serializes concurrent stores of the same key, so that the
+	// later ones find the first one's upload and skip their own, rather
+	// than racing it to leave two versions.
+	storing keyedMutex
+}
+
+// lookupCredential finds a credential by trying, in order, the git-annex
+// remote config setting, the environment variable, and the config file. It
+// returns the value and a description of the source that supplied it.
+func lookupCredential(e configSource, cf *configFile, setting, envVar string) (value, source string, err error) {
+	value, err = e.GetConfig(setting)
+	if err != nil {
+		return "", "", err
+	}
+	if value != "" {
+		return value, fmt.Sprintf("git-annex config %#v", setting), nil
+	}
+
+	value = os.Getenv(envVar)
+	if value != "" {
+		return value, "environment variable $" + envVar, nil
+	}
+
+	value = cf.get(setting)
+	if value != "" {
+		return value, "configfile " + cf.path, nil
+	}
+
+	checked := fmt.Sprintf("git-annex config %#v and environment variable $%v", setting, envVar)
+	if cf != nil {
+		checked = fmt.Sprintf("git-annex config %#v, environment variable $%v and configfile %v",
+			setting, envVar, cf.path)
+	}
+	return "", "", fmt.Errorf("%v is not set; checked %v", setting, checked)
+}
+
+// looksLikeAccountID reports whether s has the shape of a B2 account ID
+// (12 hex digits).
+func looksLikeAccountID(s string) bool {
+	if len(s) != 12 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// credentialHints returns advice about common mistakes in the given
+// credentials, or "" if nothing looks wrong.
+func credentialHints(accountID, appKey string) string {
+	var hints []string
+	if looksLikeAccountID(appKey) && !looksLikeAccountID(accountID) {
+		hints = append(hints, "appkey looks like an account id; are accountid and appkey swapped?")
+	}
+	if strings.TrimSpace(accountID) != accountID {
+		hints = append(hints, "accountid has leading or trailing whitespace")
+	}
+	if strings.TrimSpace(appKey) != appKey {
+		hints = append(hints, "appkey has leading or trailing whitespace")
+	}
+	return strings.Join(hints, "; ")
+}
+
+// authenticate authorizes with B2, using retry to ride out transient
+// failures such as a brief DNS outage.
+func authenticate(e configSource, cf *configFile, retry *retrier) (*session, error) {
+	accountID, accountIDSource, err := lookupCredential(e, cf, "accountid", "B2_ACCOUNT_ID")
+	if err != nil {
+		return nil, err
+	}
+	debugf("using accountid from %v", accountIDSource)
+
+	appKey, appKeySource, err := lookupCredential(e, cf, "appkey", "B2_APP_KEY")
+	if err != nil {
+		return nil, err
+	}
+	debugf("using appkey from %v", appKeySource)
+	addSecret(appKey)
+
+	hints := credentialHints(accountID, appKey)
+	if hints != "" {
+		debugf("credential hints: %v", hints)
+	}
+
+	creds := backblaze.Credentials{
+		AccountID:      accountID,
+		ApplicationKey: appKey,
+	}
+	var b2 *backblaze.B2
+	err = retry.do("authorize account", func() (err error) {
+		b2, err = backblaze.NewB2(creds)
+		return err
+	})
+	if err != nil {
+		if isClockSkew(err) {
+			return nil, fmt.Errorf("Couldn't authorize: %v", clockSkewError(err))
+		}
+		msg := fmt.Sprintf("Couldn't authorize with accountid from %v and appkey from %v: %v",
+			accountIDSource, appKeySource, err)
+		if hints != "" {
+			msg += " (hint: " + hints + ")"
+		}
+		return nil, errors.New(msg)
+	}
+
+	return newSession(b2, creds), nil
+}
+
+func getBucketConfig(e configSource) (bucket string, prefix string, err error) {
+	bucket, err = e.GetConfig("bucket")
+	if err != nil {
+		return "", "", err
+	}
+	if bucket == "" {
+		return "", "", errors.New("You must set bucket to the bucket name")
+	}
+
+	prefix, err = e.GetConfig("prefix")
+	if err != nil {
+		return "", "", err
+	}
+	if override, ok := os.LookupEnv("B2_PREFIX_OVERRIDE"); ok {
+		fmt.Fprintf(os.Stderr, "WARNING: B2_PREFIX_OVERRIDE is set; using prefix %#v instead of the configured %#v. "+
+			"Keys stored or removed under it won't be where git-annex expects them\n", override, prefix)
+		prefix = override
+	}
+	if strings.ContainsAny(prefix, "{}") {
+		return "", "", fmt.Errorf("prefix %#v contains a template, which is only expanded by initremote", prefix)
+	}
+	// prefix == "" is ok.
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+
+	err = validatePrefix(prefix)
+	if err != nil {
+		return "", "", err
+	}
+
+	return bucket, prefix, nil
+}
+
+func getCaseFoldConfig(e configSource) (string, error) {
+	caseFold, err := e.GetConfig("casefold")
+	if err != nil {
+		return "", err
+	}
+
+	switch caseFold {
+	case "", "no":
+		return "", nil
+	case "lower", "upper":
+		return caseFold, nil
+	default:
+		return "", fmt.Errorf("casefold must be \"lower\", \"upper\" or \"no\", not %#v", caseFold)
+	}
+}
+
+// foldKey applies the casefold setting to key.
+func (be *B2Ext) foldKey(key string) string {
+	switch be.caseFold {
+	case "lower":
+		return strings.ToLower(key)
+	case "upper":
+		return strings.ToUpper(key)
+	}
+	return key
+}
+
+// objectName returns the name of the B2 object that holds key in the
+// normal layout.
+func (be *B2Ext) objectName(key string) string {
+	return be.prefix + be.foldKey(key)
+}
+
+// presenceName returns the name of the B2 object whose existence means
+// that key is present.
+func (be *B2Ext) presenceName(key string) string {
+	if be.cas {
+		return be.casIndexName(key)
+	}
+	return be.objectName(key)
+}
+
+// contentName returns the name of the B2 object holding the content of key
+// in bh.
+func (be *B2Ext) contentName(bh *bucketHandle, key string) (string, error) {
+	if be.cas {
+		sha, err := be.casLookup(bh, key)
+		if err != nil {
+			return "", err
+		}
+		return be.casObjectName(sha), nil
+	}
+	return be.objectName(key), nil
+}
+
+func (be *B2Ext) setup(e configSource, canCreateBucket bool) error {
+	if be.bucket != nil {
+		// already done!
+		return nil
+	}
+
+	cf, err := openConfigFile(e)
+	if err != nil {
+		return err
+	}
+	if cf != nil {
+		debugf("reading settings from configfile %v", cf.path)
+		e = withConfigFile{base: e, file: cf}
+	}
+
+	err = configureTransport(e)
+	if err != nil {
+		return err
+	}
+
+	retries, err := getIntConfig(e, "retries", 3)
+	if err != nil {
+		return err
+	}
+
+	retryBudget, err := getDurationConfig(e, "retrybudget", 5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	maxFailures, err := getIntConfig(e, "maxconsecutivefailures", 10)
+	if err != nil {
+		return err
+	}
+
+	retryOn, err := e.GetConfig("retryon")
+	if err != nil {
+		return err
+	}
+	retryPolicy, err := parseRetryOn(retryOn)
+	if err != nil {
+		return err
+	}
+
+	retry := newRetrier(retries, retryBudget, maxFailures, retryPolicy)
+	installRetryAfterTransport(retry)
+
+	err = installTestTransport()
+	if err != nil {
+		return err
+	}
+
+	sess, err := authenticate(e, cf, retry)
+	if err != nil {
+		return err
+	}
+
+	bucketName, prefix, err := getBucketConfig(e)
+	if err != nil {
+		return err
+	}
+
+	mirrorName, err := e.GetConfig("mirrorbucket")
+	if err != nil {
+		return err
+	}
+	if mirrorName == bucketName {
+		return errors.New("mirrorbucket must be different from bucket")
+	}
+
+	caseFold, err := getCaseFoldConfig(e)
+	if err != nil {
+		return err
+	}
+
+	cas, err := getBoolConfig(e, "cas")
+	if err != nil {
+		return err
+	}
+
+	casPrefix, err := e.GetConfig("casprefix")
+	if err != nil {
+		return err
+	}
+	if casPrefix != "" && !strings.HasSuffix(casPrefix, "/") {
+		casPrefix += "/"
+	}
+	err = validateCASPrefix(casPrefix)
+	if err != nil {
+		return err
+	}
+
+	logFormat, err := e.GetConfig("logformat")
+	if err != nil {
+		return err
+	}
+	switch logFormat {
+	case "", "text":
+	case "json":
+		logJSON = true
+	default:
+		return fmt.Errorf("logformat must be \"text\" or \"json\", not %#v", logFormat)
+	}
+
+	quietConfig, err := getBoolConfig(e, "quiet")
+	if err != nil {
+		return err
+	}
+	if quietConfig {
+		quiet = true
+	}
+
+	manifest, err := getBoolConfig(e, "manifest")
+	if err != nil {
+		return err
+	}
+
+	compress, err := e.GetConfig("compress")
+	if err != nil {
+		return err
+	}
+	compressLevel, err := getIntConfig(e, "compresslevel", 0)
+	if err != nil {
+		return err
+	}
+	err = validateCompression(compress, compressLevel)
+	if err != nil {
+		return err
+	}
+	compressDir := ""
+	if compress != "" {
+		compressDir = annexTmpDir()
+	}
+
+	indexCompression, err := e.GetConfig("compressindex")
+	if err != nil {
+		return err
+	}
+	switch indexCompression {
+	case "", "gzip", "zstd":
+	default:
+		return fmt.Errorf("compressindex must be \"gzip\" or \"zstd\", not %#v", indexCompression)
+	}
+
+	recordFilename, err := getBoolConfig(e, "recordfilename")
+	if err != nil {
+		return err
+	}
+
+	recordCommit, err := getBoolConfig(e, "recordcommit")
+	if err != nil {
+		return err
+	}
+
+	uploadTag, err := e.GetConfig("uploadtag")
+	if err != nil {
+		return err
+	}
+
+	presenceVersions, err := getPresenceSourceConfig(e)
+	if err != nil {
+		return err
+	}
+
+	postStoreHook, err := e.GetConfig("poststorehook")
+	if err != nil {
+		return err
+	}
+	postStoreHookTimeout, err := getDurationConfig(e, "poststorehooktimeout", defaultPostStoreHookTimeout)
+	if err != nil {
+		return err
+	}
+	if postStoreHookTimeout <= 0 {
+		return fmt.Errorf("poststorehooktimeout must be positive")
+	}
+
+	journalSecret, err := getJournalSecret(e)
+	if err != nil {
+		return err
+	}
+
+	batchID, err := getBatchID(e)
+	if err != nil {
+		return err
+	}
+	if batchID != "" && cas {
+		return fmt.Errorf("batchid can't be used with cas=yes, since objects are shared between keys")
+	}
+
+	strictOwnership, err := getBoolConfig(e, "strictownership")
+	if err != nil {
+		return err
+	}
+
+	showRate, err := getBoolConfig(e, "showrate")
+	if err != nil {
+		return err
+	}
+
+	mirrorStrict, err := getBoolConfig(e, "mirrorstrict")
+	if err != nil {
+		return err
+	}
+
+	keepVersions, err := getBoolConfig(e, "keepversions")
+	if err != nil {
+		return err
+	}
+
+	staleDelete, err := e.GetConfig("staledeletefailure")
+	if err != nil {
+		return err
+	}
+	switch staleDelete {
+	case "", "fail", "keep":
+	default:
+		return fmt.Errorf("staledeletefailure must be \"fail\" or \"keep\", not %#v", staleDelete)
+	}
+
+	maxSize, err := getSizeConfig(e, "maxsize")
+	if err != nil {
+		return err
+	}
+
+	expireAfter, err := getDurationConfig(e, "expireafter", 0)
+	if err != nil {
+		return err
+	}
+	if expireAfter < 0 {
+		return fmt.Errorf("expireafter must not be negative")
+	}
+	if expireAfter > 0 && cas {
+		return fmt.Errorf("expireafter can't be used with cas=yes, since objects are shared between keys")
+	}
+
+	expireLifecycle := true
+	if v, err := e.GetConfig("expirelifecycle"); err != nil {
+		return err
+	} else if v != "" {
+		expireLifecycle, err = getBoolConfig(e, "expirelifecycle")
+		if err != nil {
+			return err
+		}
+	}
+
+	retrieveExisting, err := e.GetConfig("retrieveexisting")
+	if err != nil {
+		return err
+	}
+	switch retrieveExisting {
+	case "":
+		retrieveExisting = "resume"
+	case "resume", "overwrite", "refuse":
+	default:
+		return fmt.Errorf("retrieveexisting must be \"resume\", \"overwrite\" or \"refuse\", not %#v",
+			retrieveExisting)
+	}
+
+	copyParts, err := getBoolConfig(e, "copyparts")
+	if err != nil {
+		return err
+	}
+	if copyParts && !cas {
+		return fmt.Errorf("copyparts needs cas=yes")
+	}
+
+	partSizer, err := getPartSizerConfig(e, sess)
+	if err != nil {
+		return err
+	}
+
+	cleanupUnfinishedAge, err := getDurationConfig(e, "cleanupunfinished", 0)
+	if err != nil {
+		return err
+	}
+
+	maxTransferTime, err := getDurationConfig(e, "maxtransfertime", 0)
+	if err != nil {
+		return err
+	}
+
+	fileMode, err := getFileModeConfig(e, "filemode")
+	if err != nil {
+		return err
+	}
+
+	pack, err := getBoolConfig(e, "pack")
+	if err != nil {
+		return err
+	}
+	if pack && cas {
+		return fmt.Errorf("pack can't be used with cas=yes")
+	}
+	if pack && journalSecret != nil {
+		return fmt.Errorf("journalsecret can't be used with pack=yes, since packed keys have no objects of their own")
+	}
+	if pack && expireAfter > 0 {
+		return fmt.Errorf("expireafter can't be used with pack=yes, since packed keys have no objects of their own")
+	}
+	packThreshold, err := getSizeConfig(e, "packthreshold")
+	if err != nil {
+		return err
+	}
+	if packThreshold == 0 {
+		packThreshold = defaultPackThreshold
+	}
+	packSize, err := getSizeConfig(e, "packsize")
+	if err != nil {
+		return err
+	}
+	if packSize == 0 {
+		packSize = defaultPackSize
+	}
+	if packThreshold > packSize {
+		return fmt.Errorf("packthreshold must not be larger than packsize")
+	}
+
+	hashAtEnd, err := getBoolConfig(e, "hashatend")
+	if err != nil {
+		return err
+	}
+
+	cacheDir, err := e.GetConfig("cachedir")
+	if err != nil {
+		return err
+	}
+	var cache *retrieveCache
+	if cacheDir != "" {
+		cacheSize, err := getSizeConfig(e, "cachesize")
+		if err != nil {
+			return err
+		}
+		if cacheSize == 0 {
+			cacheSize = 1e9
+		}
+		err = os.MkdirAll(cacheDir, 0777)
+		if err != nil {
+			return fmt.Errorf("couldn't create cachedir: %v", err)
+		}
+		cache = &retrieveCache{dir: cacheDir, maxSize: cacheSize, mode: fileMode, clock: realClock{}}
+	}
+
+	bloom, err := getBoolConfig(e, "bloom")
+	if err != nil {
+		return err
+	}
+	bloomFPRate, err := getFPRateConfig(e)
+	if err != nil {
+		return err
+	}
+
+	checkPresent, err := e.GetConfig("checkpresent")
+	if err != nil {
+		return err
+	}
+	switch checkPresent {
+	case "":
+		checkPresent = "auto"
+	case "auto", "list", "download":
+	default:
+		return fmt.Errorf("checkpresent must be \"auto\", \"list\" or \"download\", not %#v", checkPresent)
+	}
+
+	downloadConcurrency, err := getIntConfig(e, "downloadconcurrency", 1)
+	if err != nil {
+		return err
+	}
+	if downloadConcurrency < 1 {
+		downloadConcurrency = 1
+	}
+
+	metricsFile, err := e.GetConfig("metricsfile")
+	if err != nil {
+		return err
+	}
+	var m *metrics
+	if metricsFile != "" {
+		m = newMetrics(metricsFile)
+	}
+
+	uploadConcurrency, err := getIntConfig(e, "uploadconcurrency", 1)
+	if err != nil {
+		return err
+	}
+	if uploadConcurrency < 1 {
+		uploadConcurrency = 1
+	}
+	// Each upload needs an upload URL and token of its own; go-backblaze
+	// hands them out from a mutex-guarded pool, fetching a new one whenever
+	// none is idle (or one is rejected), and keeps up to MaxIdleUploads of
+	// them for reuse. Sizing it to the number of concurrent uploads means
+	// every uploader can reuse a URL instead of asking B2 for a new one.
+	sess.b2.MaxIdleUploads = uploadConcurrency
+
+	poolSize := uploadConcurrency
+	if downloadConcurrency > poolSize {
+		poolSize = downloadConcurrency
+	}
+	sizeConnectionPool(poolSize)
+
+	err = installDownloadTransport(e, sess, compress)
+	if err != nil {
+		return err
+	}
+
+	adaptive, err := getBoolConfig(e, "adaptiveconcurrency")
+	if err != nil {
+		return err
+	}
+	var limiter *adaptiveLimiter
+	if adaptive {
+		minConcurrency, err := getIntConfig(e, "minconcurrency", 1)
+		if err != nil {
+			return err
+		}
+		defMax := uploadConcurrency
+		if downloadConcurrency > defMax {
+			defMax = downloadConcurrency
+		}
+		maxConcurrency, err := getIntConfig(e, "maxconcurrency", defMax)
+		if err != nil {
+			return err
+		}
+		limiter = newAdaptiveLimiter(minConcurrency, maxConcurrency)
+	}
+
+	minRequestInterval, err := getDurationConfig(e, "minrequestinterval", 0)
+	if err != nil {
+		return err
+	}
+	sess.pacer = newRequestPacer(minRequestInterval)
+
+	listConcurrency, err := getIntConfig(e, "listconcurrency", defaultListConcurrency)
+	if err != nil {
+		return err
+	}
+	sess.lists = newListLimiter(listConcurrency)
+
+	listPageSize, err := getIntConfig(e, "listpagesize", defaultListPageSize)
+	if err != nil {
+		return err
+	}
+	if listPageSize < 1 || listPageSize > maxListPageSize {
+		return fmt.Errorf("listpagesize must be between 1 and %v, not %v", maxListPageSize, listPageSize)
+	}
+
+	verifyAfterStore, err := getBoolConfig(e, "verifyafterstore")
+	if err != nil {
+		return err
+	}
+
+	listCacheTTL, err := getDurationConfig(e, "listcachettl", defaultListCacheTTL)
+	if err != nil {
+		return err
+	}
+
+	strictNames, err := getBoolConfig(e, "strictnames")
+	if err != nil {
+		return err
+	}
+
+	atomicPublish, err := getBoolConfig(e, "atomicpublish")
+	if err != nil {
+		return err
+	}
+
+	bucket, err := openBucket(sess, bucketName, canCreateBucket)
+	if err != nil {
+		return err
+	}
+
+	bucket.keepVersions = keepVersions
+	bucket.keepStaleOnDeleteFailure = staleDelete == "keep"
+	bucket.retry = retry
+	bucket.limiter = limiter
+	bucket.listPageSize = listPageSize
+	bucket.listCacheTTL = listCacheTTL
+	bucket.strictNames = strictNames
+	bucket.presenceVersions = presenceVersions
+	bucket.verifyAfterStore = verifyAfterStore
+	bucket.hashAtEnd = hashAtEnd
+	bucket.copyParts = copyParts
+	bucket.partSizer = partSizer
+	bucket.indexCompression = indexCompression
+	bucket.metrics = m
+
+	var mirror *bucketHandle
+	if mirrorName != "" {
+		mirror, err = openBucket(sess, mirrorName, canCreateBucket)
+		if err != nil {
+			return err
+		}
+		mirror.keepVersions = keepVersions
+		mirror.keepStaleOnDeleteFailure = staleDelete == "keep"
+		mirror.retry = retry
+		mirror.limiter = limiter
+		mirror.listPageSize = listPageSize
+		mirror.listCacheTTL = listCacheTTL
+		mirror.strictNames = strictNames
+		mirror.presenceVersions = presenceVersions
+		mirror.verifyAfterStore = verifyAfterStore
+		mirror.hashAtEnd = hashAtEnd
+		mirror.copyParts = copyParts
+		mirror.partSizer = partSizer
+		mirror.indexCompression = indexCompression
+		mirror.metrics = m
+	}
+
+	be.bucket = bucket
+	be.prefix = prefix
+	be.caseFold = caseFold
+	be.cas = cas
+	be.casPrefix = casPrefix
+	if be.casPrefix == "" {
+		be.casPrefix = be.internalName("cas/")
+	}
+	be.mirror = mirror
+	be.mirrorStrict = mirrorStrict
+	be.maxSize = maxSize
+	be.expireAfter = expireAfter
+	be.expireLifecycle = expireLifecycle
+	be.showRate = showRate
+	be.manifest = manifest
+	be.strictOwnership = strictOwnership
+	be.compress = compress
+	be.compressLevel = compressLevel
+	be.compressDir = compressDir
+	be.retry = retry
+	be.metrics = m
+	be.retrieveExisting = retrieveExisting
+	be.downloadConcurrency = downloadConcurrency
+	be.checkPresent = checkPresent
+	be.bloom = bloom
+	be.bloomFPRate = bloomFPRate
+	be.cache = cache
+	be.hashAtEnd = hashAtEnd
+	be.bucket.partsPrefix = be.internalName("parts/")
+	if be.mirror != nil {
+		be.mirror.partsPrefix = be.internalName("parts/")
+	}
+	if atomicPublish {
+		be.bucket.publishPrefix = be.internalName("publishing/")
+		if be.mirror != nil {
+			be.mirror.publishPrefix = be.internalName("publishing/")
+		}
+	}
+	be.pack = pack
+	be.packThreshold = packThreshold
+	be.cleanupUnfinishedAge = cleanupUnfinishedAge
+	be.maxTransferTime = maxTransferTime
+	be.fileMode = fileMode
+	if pack {
+		be.bucket.packs = newPacker(be.bucket, be.internalName("packs/"), packThreshold, packSize)
+		if be.mirror != nil {
+			be.mirror.packs = newPacker(be.mirror, be.internalName("packs/"), packThreshold, packSize)
+		}
+	}
+	be.recordFilename = recordFilename
+	be.recordCommit = recordCommit
+	be.uploadTag = uploadTag
+	be.batchID = batchID
+	be.journalSecret = journalSecret
+	be.postStoreHook = postStoreHook
+	be.postStoreHookTimeout = postStoreHookTimeout
+
+	return nil
+}
+
+func (be *B2Ext) InitRemote(e *external.External) error {
+	return be.initRemote(e)
+}
+
+func (be *B2Ext) initRemote(e remoteConfig) error {
+	err := expandPrefixTemplate(e)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{"casefold", "cas", "casprefix", "pack"} {
+		err := pinConfig(e, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = be.setup(e, true)
+	if err != nil {
+		return err
+	}
+
+	derivedPrefix := ""
+	if be.prefix == "" {
+		if restriction := be.bucket.session.namePrefixRestriction(); restriction != "" {
+			// Without a prefix, every request would be refused; use the
+			// key's own, and set everything up again to follow it. It's
+			// only saved once it has been checked.
+			derivedPrefix = restrictedPrefix(restriction)
+			infof("The application key is restricted to names starting with %#v; using prefix=%v",
+				restriction, derivedPrefix)
+			be.bucket = nil
+			err = be.setup(overriddenConfig{base: e, name: "prefix", value: derivedPrefix}, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = be.checkNamePrefix()
+	if err != nil {
+		return err
+	}
+	if derivedPrefix != "" {
+		err = e.SetConfig("prefix", derivedPrefix)
+		if err != nil {
+			return err
+		}
+	}
+
+	if be.prefix == "" {
+		fmt.Fprintf(os.Stderr, "Warning: no prefix is set, so this remote uses the whole of bucket %#v; "+
+			"don't share the bucket with anything else\n", be.bucket.name)
+	}
+
+	if be.expireAfter > 0 && be.expireLifecycle {
+		if be.prefix == "" {
+			return fmt.Errorf("expireafter needs a prefix for its lifecycle rules, or they would expire everything "+
+				"in bucket %#v; set prefix, or pass expirelifecycle=no and run the expire command instead", be.bucket.name)
+		}
+		err = be.setExpiryLifecycle()
+		if err != nil {
+			return err
+		}
+	}
+
+	return be.prepareOwnership(e)
+}
+
+func (be *B2Ext) Prepare(e *external.External) error {
+	err := be.setup(e, false)
+	if err != nil {
+		return err
+	}
+
+	err = be.checkNamePrefix()
+	if err != nil {
+		return err
+	}
+
+	be.chooseCheckPresent()
+
+	// Opening the bucket doesn't prove the key can use it, so list a
+	// single name under the prefix now, rather than have the first
+	// transfer of a long run find out. Keys without listFiles can't do
+	// this, so it's skipped for them unless asked for.
+	canList, known := be.bucket.session.hasCapability("listFiles")
+	probe := canList || !known
+	if v, err := e.GetConfig("probe"); err != nil {
+		return err
+	} else if v != "" {
+		probe, err = getBoolConfig(e, "probe")
+		if err != nil {
+			return err
+		}
+	}
+	if probe {
+		_, err = be.bucket.anyWithPrefix(be.prefix)
+		if err != nil {
+			return fmt.Errorf("bucket %#v isn't usable: %v", be.bucket.name, err)
+		}
+	}
+
+	if be.cleanupUnfinishedAge > 0 {
+		be.cleanupUnfinished()
+	}
+
+	if be.bloom {
+		err = be.buildBloom(be.bucket)
+		if err != nil {
+			// Without the filter, every check just asks B2.
+			fmt.Fprintf(os.Stderr, "Warning: couldn't build the bloom filter: %v\n", err)
+		}
 	}
+
+	return be.prepareOwnership(e)
 }
 
-func authenticate(e *external.External) (*backblaze.B2, error) {
-	accountID, err := e.GetConfig("accountid")
+func (be *B2Ext) prepareOwnership(e remoteConfig) error {
+	uuid, err := e.GetUUID()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	return be.checkOwnership(uuid)
+}
+
+// transferProgress returns the progress wrapper for a transfer of total
+// bytes (or -1 if unknown): progress is always reported to git-annex, and
+// also shown on stderr if showrate is set. With no git-annex (e is nil),
+// it's only shown on stderr.
+func (be *B2Ext) transferProgress(e *external.External, label string, total int64) func(io.Reader) io.Reader {
+	if e == nil {
+		// Maintenance commands have no git-annex to report to.
+		return statusProgress(label, total)
+	}
+	protocol := func(r io.Reader) io.Reader {
+		return external.NewProgressReader(r, e)
 	}
-	if accountID == "" {
-		accountID = os.Getenv("B2_ACCOUNT_ID")
+	if !be.showRate {
+		return protocol
 	}
-	if accountID == "" {
-		return nil, errors.New("You must set accountid to the backblaze account id")
+	return chainProgress(protocol, statusProgress(label, total))
+}
+
+var errCanceled = errors.New("canceled")
+
+// cancelableReader reads from r until cancel is closed.
+type cancelableReader struct {
+	r      io.Reader
+	cancel <-chan struct{}
+}
+
+func (cr *cancelableReader) Read(p []byte) (int, error) {
+	select {
+	case <-cr.cancel:
+		return 0, errCanceled
+	default:
+		return cr.r.Read(p)
 	}
+}
 
-	appKey, err := e.GetConfig("appkey")
+// checkUnchanged makes sure that fh, hashed as length bytes, is still
+// usable and still that long. git-annex doesn't change files while storing
+// them, but uploading something other than what was hashed must not go
+// unnoticed.
+func checkUnchanged(fh *os.File, length int64) error {
+	fi, err := fh.Stat()
 	if err != nil {
-		return nil, err
-	}
-	if appKey == "" {
-		appKey = os.Getenv("B2_APP_KEY")
+		return fmt.Errorf("file is no longer usable: %v", err)
 	}
-	if appKey == "" {
-		return nil, errors.New("You must set appkey to the backblaze application key")
+	if fi.Size() != length {
+		return fmt.Errorf("file changed size from %v to %v bytes while being stored", length, fi.Size())
 	}
+	return nil
+}
 
-	b2, err := backblaze.NewB2(backblaze.Credentials{
-		AccountID:      accountID,
-		ApplicationKey: appKey,
-	})
+func (be *B2Ext) Store(e *external.External, key, file string) error {
+	err := validateKey(key)
+	if err != nil {
+		return err
+	}
+	err = be.checkNameLengths(key)
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't authorize: %v", err)
+		return err
 	}
 
-	return b2, nil
-}
+	defer be.storing.lock(be.presenceName(key))()
 
-func getBucketConfig(e *external.External) (bucket string, prefix string, err error) {
-	bucket, err = e.GetConfig("bucket")
+	fh, err := os.Open(file)
 	if err != nil {
-		return "", "", err
-	}
-	if bucket == "" {
-		return "", "", errors.New("You must set bucket to the bucket name")
+		return err
 	}
+	defer fh.Close()
 
-	prefix, err = e.GetConfig("prefix")
-	// prefix == "" is ok.
-	if prefix != "" && !strings.HasSuffix(prefix, "/") {
-		prefix = prefix + "/"
+	fi, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	if be.maxSize > 0 && fi.Size() > be.maxSize {
+		return fmt.Errorf("refusing to store %v: its size of %v bytes exceeds maxsize of %v bytes",
+			key, fi.Size(), be.maxSize)
 	}
 
-	return bucket, prefix, nil
-}
+	// body is what's uploaded: the file itself, or a compressed copy of it.
+	body := fh
+	total := fi.Size()
+	var info map[string]string
+	var hashed func() ([]byte, int64, error)
 
-func (be *B2Ext) listFileCached(file string) (found bool, fileID string, err error) {
-	// Caching the last result of ListFileNames is no less safe than not caching
-	// it; the race condition of two concurrent git annex copy --to b2 processes
-	// sending the same file can result in a file with two identical versions in
-	// both cases.
-	//
-	// However, caching this reduces the number of ListFileNames to half of what
-	// it is during uploads (since git-annex always calls checkpresent which
-	// uses ListFileNames before uploading, but when uploading we also do
-	// upload elision by calling ListFileNames.)
+	// Small keys are packed (see pack.go) as they are, with none of the
+	// file info an object of their own would carry.
+	var packed []byte
+	isPacked := be.pack && fi.Size() <= be.packThreshold
 
-	if be.lastList.file != file || time.Since(be.lastList.setAt) > time.Second*15 {
-		res, err := be.bucket.ListFileNames(file, 1)
+	if isPacked {
+		packed, err = ioutil.ReadAll(fh)
+		if err != nil {
+			return fmt.Errorf("couldn't read local file %v: %v", file, err)
+		}
+		sum := sha1.Sum(packed)
+		hashed = func() ([]byte, int64, error) {
+			return sum[:], int64(len(packed)), nil
+		}
+	} else if be.compress != "" {
+		dir := be.compressDir
+		if dir == "" {
+			dir = filepath.Dir(file)
+		}
+		tmp, sha, length, err := compressToTemp(be.compress, be.compressLevel, dir, fh)
 		if err != nil {
-			return false, "", err
+			return err
 		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
 
-		be.lastList.setAt = time.Now()
-		if len(res.Files) == 0 || res.Files[0].Name != file {
-			be.lastList.file = file
-			be.lastList.found = false
-			be.lastList.id = ""
-		} else {
-			be.lastList.file = file
-			be.lastList.found = true
-			be.lastList.id = res.Files[0].ID
+		body = tmp
+		total = length
+		info = map[string]string{compressionInfoKey: be.compress}
+		hashed = func() ([]byte, int64, error) {
+			return sha, length, nil
 		}
-	}
+		debugf("compressed %v from %v to %v bytes with %v", key, fi.Size(), length, be.compress)
+	} else if be.hashAtEnd {
+		// The file is hashed as it's uploaded; it's only hashed
+		// separately if something asks for the SHA1, which may be after
+		// the upload has left fh at its end.
+		var haveSHA []byte
+		var contentLength int64
+		var shaError error
+		var once sync.Once
+		hashed = func() ([]byte, int64, error) {
+			once.Do(func() {
+				_, shaError = fh.Seek(0, 0)
+				if shaError != nil {
+					return
+				}
+				sha := sha1.New()
+				contentLength, shaError = io.Copy(sha, fh)
+				if shaError == nil {
+					haveSHA = sha.Sum(nil)
+					_, shaError = fh.Seek(0, 0)
+				}
+			})
+			if shaError != nil {
+				return nil, 0, fmt.Errorf("couldn't hash local file %v: %v", file, shaError)
+			}
+			err := checkUnchanged(fh, contentLength)
+			if err != nil {
+				return nil, 0, fmt.Errorf("local file %v: %v", file, err)
+			}
+			return haveSHA, contentLength, nil
+		}
+	} else {
+		shaReady := make(chan struct{})
+		var haveSHA []byte
+		var contentLength int64
+		var shaError error
 
-	return be.lastList.found, be.lastList.id, nil
-}
+		// If Store returns early, stop hashing rather than keep reading
+		// what may be a huge file, and wait for the hashing to stop before
+		// fh is closed.
+		cancelHash := make(chan struct{})
+		defer func() {
+			close(cancelHash)
+			<-shaReady
+		}()
 
-func (be *B2Ext) clearListFileCache() {
-	be.lastList.setAt = time.Time{}
-	be.lastList.file = ""
-	be.lastList.found = false
-	be.lastList.id = ""
-}
+		go func() {
+			defer close(shaReady)
 
-func (be *B2Ext) setup(e *external.External, canCreateBucket bool) error {
-	if be.bucket != nil {
-		// already done!
-		return nil
+			sha := sha1.New()
+			contentLength, shaError = io.Copy(sha, &cancelableReader{r: fh, cancel: cancelHash})
+			if shaError != nil {
+				return
+			}
+
+			haveSHA = sha.Sum(nil)
+
+			_, shaError = fh.Seek(0, 0)
+		}()
+
+		hashed = func() ([]byte, int64, error) {
+			<-shaReady
+			if shaError != nil {
+				return nil, 0, fmt.Errorf("couldn't hash local file %v: %v", file, shaError)
+			}
+			err := checkUnchanged(fh, contentLength)
+			if err != nil {
+				return nil, 0, fmt.Errorf("local file %v: %v", file, err)
+			}
+			return haveSHA, contentLength, nil
+		}
 	}
 
-	b2, err := authenticate(e)
-	if err != nil {
-		return err
+	if !be.cas {
+		for name, value := range be.keyInfo(key) {
+			info = setInfo(info, name, value)
+		}
 	}
+	if be.expireAfter > 0 {
+		info = setInfo(info, expiresInfoKey, be.expiryInfo())
+		be.warnUncovered(key)
+	}
+	if be.recordFilename {
+		if name := filenameInfo(key, file); name != "" {
+			info = setInfo(info, filenameInfoKey, name)
+		}
+	}
+	if be.recordCommit {
+		if head := gitHead(); head != "" {
+			info = setInfo(info, gitHeadInfoKey, head)
+		}
+	}
+	if be.uploadTag != "" {
+		info = setInfo(info, tagInfoKey, tagInfo(be.uploadTag))
+	}
+	if be.batchID != "" {
+		info = setInfo(info, batchInfoKey, batchInfo(be.batchID))
+	}
+	info = fitFileInfo(key, info)
 
-	bucketName, prefix, err := getBucketConfig(e)
+	progress := be.withDeadline(be.transferProgress(e, "Uploading "+key, total))
+
+	storeIn := func(bh *bucketHandle, progress func(io.Reader) io.Reader) error {
+		if isPacked {
+			return bh.packs.store(key, packed)
+		}
+		err := be.checkFoldedCollision(bh, key)
+		if err != nil {
+			return err
+		}
+		if be.cas {
+			return be.casStore(bh, key, body, info, progress, hashed)
+		}
+		return bh.store(be.objectName(key), body, info, progress, hashed)
+	}
+
+	err = storeIn(be.bucket, progress)
 	if err != nil {
 		return err
 	}
 
-	bucket, err := b2.Bucket(bucketName)
-	if err != nil {
-		return fmt.Errorf("couldn't open bucket %#v: %v", bucketName, err)
+	if !isPacked {
+		setURLsPresent(e, key, be.publicURLs(key), true)
 	}
 
-	if bucket == nil {
-		if !canCreateBucket {
-			return fmt.Errorf("bucket %#v does not exist anymore", bucketName)
+	if be.manifest {
+		sha, size, err := hashed()
+		if err == nil {
+			err = be.manifestRecord(be.bucket, manifestEntry{key: key, size: size, sha: hex.EncodeToString(sha)})
 		}
+		if err != nil {
+			return fmt.Errorf("stored %v but couldn't record it in the manifest: %v", key, err)
+		}
+	}
 
-		fmt.Fprintf(os.Stderr, "Creating private B2 bucket %#v\n", bucketName)
+	if be.journalSecret != nil {
+		sha, size, err := hashed()
+		if err == nil {
+			err = be.journalRecord(journalStore, key, size, hex.EncodeToString(sha))
+		}
+		if err != nil {
+			return err
+		}
+	}
 
-		bucket, err = b2.CreateBucket(bucketName, backblaze.AllPrivate)
+	if be.mirror != nil {
+		// The mirror shares the SHA1 computed above; only the file position
+		// needs resetting.
+		_, err = body.Seek(0, 0)
+		if err == nil {
+			err = storeIn(be.mirror, noProgress)
+		}
 		if err != nil {
-			return fmt.Errorf("couldn't create bucket %#v: %v", bucketName, err)
+			if be.mirrorStrict {
+				return fmt.Errorf("couldn't store to mirror bucket %#v: %v", be.mirror.name, err)
+			}
+			fmt.Fprintf(os.Stderr, "Warning: couldn't store %v to mirror bucket %#v: %v\n",
+				key, be.mirror.name, err)
 		}
 	}
 
-	be.bucket = bucket
-	be.prefix = prefix
+	if be.postStoreHook != "" {
+		var name string
+		switch {
+		case isPacked:
+		case be.cas:
+			sha, _, err := hashed()
+			if err == nil {
+				name = be.casObjectName(hex.EncodeToString(sha))
+			}
+		default:
+			name = be.objectName(key)
+		}
+		be.runPostStoreHook(key, name, fi.Size())
+	}
 
 	return nil
 }
 
-func (be *B2Ext) InitRemote(e *external.External) error {
-	return be.setup(e, true)
-}
-
-func (be *B2Ext) Prepare(e *external.External) error {
-	return be.setup(e, false)
-}
-
-func (be *B2Ext) Store(e *external.External, key, file string) error {
-	fh, err := os.Open(file)
+func (be *B2Ext) Retrieve(e *external.External, key, file string) error {
+	fh, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
-		return err
+		return fmt.Errorf("couldn't open %v for writing: %v", file, err)
 	}
 	defer fh.Close()
 
-	shaReady := make(chan struct{})
-	var haveSHA []byte
-	var contentLength int64
-	var shaError error
-	go func() {
-		defer close(shaReady)
-
-		sha := sha1.New()
-		contentLength, shaError = io.Copy(sha, fh)
-		if shaError != nil {
-			return
+	if be.fileMode != 0 {
+		// Set exactly, rather than through the umask as creating it does.
+		err = fh.Chmod(be.fileMode)
+		if err != nil {
+			return fmt.Errorf("couldn't set the permissions of %v: %v", file, err)
 		}
+	}
 
-		haveSHA = sha.Sum(nil)
-
-		_, shaError = fh.Seek(0, 0)
-	}()
-
-	found, fileID, err := be.listFileCached(be.prefix + key)
+	fi, err := fh.Stat()
 	if err != nil {
-		return fmt.Errorf("couldn't list filenames: %v", err)
+		return err
+	}
+	if fi.Size() > 0 && be.retrieveExisting == "refuse" {
+		return fmt.Errorf("refusing to overwrite %v, which already has %v bytes in it", file, fi.Size())
 	}
+	resume := be.retrieveExisting == "resume"
 
-	if found {
-		// file probably already stored; make sure using the SHA1
-		b2file, err := be.bucket.GetFileInfo(fileID)
+	if be.cache != nil {
+		hit, err := be.cache.get(be.cacheKey(key), fh)
 		if err != nil {
-			return fmt.Errorf("couldn't get file info for %#v: %v", fileID, err)
+			return err
 		}
-		if b2file != nil {
-			<-shaReady
+		if hit {
+			debugf("retrieved %v from the cache", key)
+			return nil
+		}
+	}
 
-			wantSHA, err := hex.DecodeString(b2file.ContentSha1)
-			if err == nil && bytes.Equal(haveSHA, wantSHA) {
-				// File already exists with correct data.
-				return nil
+	progress := be.withDeadline(be.transferProgress(e, "Downloading "+key, -1))
+
+	// b2file describes the object downloaded, if it wasn't packed.
+	var b2file *backblaze.File
+	retrieveFrom := func(bh *bucketHandle) error {
+		if be.pack {
+			found, err := bh.packs.retrieve(key, fh)
+			if err != nil || found {
+				return err
 			}
+		}
 
-			// File exists but is the incorrect data. Delete the old version
-			// first; B2 will keep the old version around otherwise.
-			_, err = be.bucket.DeleteFileVersion(be.prefix+key, b2file.ID)
-			if err != nil {
-				return fmt.Errorf("couldn't delete old file version: %v", err)
+		name, err := be.contentName(bh, key)
+		if err != nil {
+			return err
+		}
+		if be.downloadConcurrency > 1 && (fi.Size() == 0 || !resume) {
+			b2file, err = bh.retrieveSegmented(name, fh, be.downloadConcurrency, progress)
+		} else {
+			b2file, err = bh.retrieve(name, fh, resume, progress)
+		}
+		return err
+	}
+
+	err = retrieveFrom(be.bucket)
+	if err != nil {
+		// A permission problem must not be papered over by quietly using
+		// the mirror, or it would look like the data had gone missing.
+		if isTransferTimeout(err) {
+			// Leave nothing half-downloaded behind, unless it's
+			// meant to be resumed.
+			if !resume {
+				fh.Truncate(0)
 			}
+			return err
+		}
+
+		class := classifyError(err)
+		err = describeDownloadError(key, be.bucket, err)
+		if class == errorAuth || be.mirror == nil {
+			return err
+		}
+
+		mirrorErr := retrieveFrom(be.mirror)
+		if mirrorErr != nil {
+			return fmt.Errorf("%v (mirror: %v)", err, describeDownloadError(key, be.mirror, mirrorErr))
+		}
+	}
+
+	if be.cache != nil {
+		err = be.cacheRetrieved(b2file, key, fh)
+		if err != nil {
+			// Don't leave bad content to be resumed from.
+			fh.Truncate(0)
+			return fmt.Errorf("couldn't retrieve %v: %v", key, err)
 		}
 	}
 
-	<-shaReady
-	if shaError != nil {
-		return fmt.Errorf("couldn't hash local file %v: %v", file, shaError)
+	return nil
+}
+
+// describeDownloadError explains a failure to download key from bh,
+// distinguishing a missing object from a lack of permission to read it.
+func describeDownloadError(key string, bh *bucketHandle, err error) error {
+	switch classifyError(err) {
+	case errorNotFound:
+		return fmt.Errorf("%v is not present in bucket %#v", key, bh.name)
+	case errorAuth:
+		return fmt.Errorf("access denied downloading %v from bucket %#v; check that the application key "+
+			"has the readFiles capability and can access this bucket: %v", key, bh.name, err)
+	default:
+		return fmt.Errorf("couldn't download %v from bucket %#v: %v", key, bh.name, err)
 	}
+}
 
-	_, err = be.bucket.UploadHashedFile(
-		be.prefix+key,
-		nil,
-		external.NewProgressReader(fh, e),
-		hex.EncodeToString(haveSHA),
-		contentLength)
+func (be *B2Ext) CheckPresent(e *external.External, key string) (bool, error) {
+	found, err := be.present(be.bucket, key)
+	if err == nil && found {
+		return true, nil
+	}
 
-	be.clearListFileCache()
+	if be.mirror != nil {
+		mirrorFound, mirrorErr := be.present(be.mirror, key)
+		if mirrorErr == nil && mirrorFound {
+			return true, nil
+		}
+	}
 
 	if err != nil {
-		return fmt.Errorf("couldn't upload file: %v", err)
+		return false, err
 	}
 
-	return nil
+	return false, nil
 }
 
-func (be *B2Ext) Retrieve(e *external.External, key, file string) error {
-	fh, err := os.Create(file)
-	if err != nil {
-		return fmt.Errorf("couldn't open %v for writing: %v", file, err)
+// present reports whether key is in bh, using the method chosen by the
+// checkpresent setting.
+func (be *B2Ext) present(bh *bucketHandle, key string) (bool, error) {
+	if be.pack {
+		found, err := bh.packs.present(key)
+		if err != nil || found {
+			return found, err
+		}
 	}
-	defer fh.Close()
 
-	_, rc, err := be.bucket.DownloadFileByName(be.prefix + key)
-	if rc != nil {
-		defer rc.Close()
+	if !bh.bloom.mayContain(be.presenceName(key)) {
+		return false, nil
 	}
-	if err != nil {
-		return err
+
+	if be.checkPresent != "download" {
+		found, holder, err := bh.lookupKey(be.presenceName(key))
+		if err == nil {
+			if found && be.caseFold != "" && holder != "" && holder != key {
+				debugf("%v is absent; its object holds %v instead", key, holder)
+				return false, nil
+			}
+			return found, nil
+		}
+		if be.checkPresent != "auto" || classifyError(err) != errorAuth {
+			return false, fmt.Errorf("couldn't list filenames: %v", err)
+		}
+		debugf("listing isn't allowed (%v); checking presence by downloading instead", err)
+		be.checkPresent = "download"
 	}
 
-	_, err = io.Copy(fh, external.NewProgressReader(rc, e))
+	found, err := bh.fetchable(be.presenceName(key))
 	if err != nil {
-		return err
+		return false, fmt.Errorf("couldn't download %v: %v", key, err)
 	}
+	return found, nil
+}
 
-	return nil
+// chooseCheckPresent settles checkpresent=auto from the application key's
+// capabilities: a key that can read files but not list them checks
+// presence by downloading.
+func (be *B2Ext) chooseCheckPresent() {
+	if be.checkPresent != "auto" {
+		return
+	}
+	canList, known := be.bucket.session.hasCapability("listFiles")
+	if !known || canList {
+		return
+	}
+	if canRead, _ := be.bucket.session.hasCapability("readFiles"); canRead {
+		debugf("the application key can't list files; checking presence by downloading")
+		be.checkPresent = "download"
+	}
 }
 
-func (be *B2Ext) CheckPresent(e *external.External, key string) (bool, error) {
-	found, _, err := be.listFileCached(be.prefix + key)
+// removeKey removes key from bh.
+func (be *B2Ext) removeKey(bh *bucketHandle, key string) error {
+	if be.pack {
+		// A key may have been stored both ways, if packthreshold changed
+		// in between, so the object is removed as well.
+		_, err := bh.packs.remove(key)
+		if err != nil {
+			return err
+		}
+	}
+	holder, err := be.foldedHolder(bh, key)
 	if err != nil {
-		return false, fmt.Errorf("couldn't list filenames: %v", err)
+		return err
 	}
-
-	return found, nil
+	if holder != "" {
+		debugf("not removing the object of %v, which holds %v instead", key, holder)
+		return nil
+	}
+	if be.cas {
+		return be.casRemove(bh, key)
+	}
+	return bh.remove(be.objectName(key))
 }
 
 func (be *B2Ext) Remove(e *external.External, key string) error {
-	found, fileID, err := be.listFileCached(be.prefix + key)
+	// The URLs have to be found before the key is removed, since in the
+	// content-addressed layout they can't be found after.
+	urls := be.publicURLs(key)
+
+	err := be.removeKey(be.bucket, key)
 	if err != nil {
-		return fmt.Errorf("couldn't list filenames: %v", err)
+		return err
 	}
+	setURLsPresent(e, key, urls, false)
 
-	if !found {
-		// File already non-existent, nothing to remove
-		return nil
+	err = be.journalRecord(journalRemove, key, 0, "")
+	if err != nil {
+		return err
 	}
 
-	_, err = be.bucket.DeleteFileVersion(be.prefix+key, fileID)
-	be.clearListFileCache()
-	if err != nil {
-		return fmt.Errorf("couldn't delete file version: %v", err)
+	if be.cache != nil {
+		be.cache.remove(be.cacheKey(key))
+	}
+
+	if be.manifest {
+		err = be.manifestForget(be.bucket, key)
+		if err != nil {
+			return fmt.Errorf("removed %v but couldn't remove it from the manifest: %v", key, err)
+		}
+	}
+
+	if be.mirror != nil {
+		err = be.removeKey(be.mirror, key)
+		if err != nil {
+			return fmt.Errorf("couldn't remove from mirror bucket %#v: %v", be.mirror.name, err)
+		}
 	}
 
 	return nil
@@ -301,11 +1566,133 @@ func (be *B2Ext) GetAvailability(e *external.External) (external.Availability, e
 	return external.AvailabilityGlobal, nil
 }
 
+// downloadURLs returns the B2 download URLs for key: the primary bucket's
+// first, then the mirror's if there is one.
+func (be *B2Ext) downloadURLs(key string) ([]string, error) {
+	buckets := []*bucketHandle{be.bucket}
+	if be.mirror != nil {
+		buckets = append(buckets, be.mirror)
+	}
+
+	var urls []string
+	for _, bh := range buckets {
+		name, err := be.contentName(bh, key)
+		if err != nil {
+			return nil, err
+		}
+		url, err := bh.FileURL(name)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get download URL from bucket %#v: %v", bh.name, err)
+		}
+		urls = append(urls, url)
+	}
+
+	return urls, nil
+}
+
+// publicURLs returns the download URLs of key in each public bucket. Only
+// those are worth telling git-annex about, so that it can fall back to
+// fetching the key over plain HTTP; URLs of private buckets can't be used
+// without credentials. Failures are only warned about, since the URLs are a
+// convenience.
+func (be *B2Ext) publicURLs(key string) []string {
+	buckets := []*bucketHandle{be.bucket}
+	if be.mirror != nil {
+		buckets = append(buckets, be.mirror)
+	}
+
+	var urls []string
+	for _, bh := range buckets {
+		if !bh.isPublic() {
+			continue
+		}
+
+		name, err := be.contentName(bh, key)
+		var url string
+		if err == nil {
+			url, err = bh.FileURL(name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: couldn't get URL of %v in bucket %#v: %v\n", key, bh.name, err)
+			continue
+		}
+		urls = append(urls, url)
+	}
+
+	return urls
+}
+
+// setURLsPresent tells git-annex that key is (or no longer is) available
+// at urls.
+func setURLsPresent(e *external.External, key string, urls []string, present bool) {
+	if e == nil {
+		// Maintenance commands have no git-annex to tell.
+		return
+	}
+	for _, url := range urls {
+		var err error
+		if present {
+			err = e.SetURLPresent(key, url)
+		} else {
+			err = e.SetURLMissing(key, url)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: couldn't update URL %v of %v: %v\n", url, key, err)
+		}
+	}
+}
+
 func (be *B2Ext) WhereIs(e *external.External, key string) (string, error) {
-	return "", external.ErrUnsupportedRequest
+	urls, err := be.downloadURLs(key)
+	if err != nil {
+		return "", err
+	}
+
+	where := strings.Join(urls, " ")
+
+	// The file ID identifies the exact version stored, for reference in
+	// support requests or with other B2 tools.
+	name, err := be.contentName(be.bucket, key)
+	if err != nil {
+		return "", err
+	}
+	found, fileID, err := be.bucket.listFileCached(name)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		where += fmt.Sprintf(" (file ID %v)", fileID)
+	}
+
+	if be.recordFilename || be.recordCommit || be.uploadTag != "" {
+		info, err := be.recordedInfo(be.bucket, key)
+		if err != nil {
+			return "", err
+		}
+		if filename := infoValue(info, filenameInfoKey); filename != "" {
+			where += fmt.Sprintf(" (original file name %#v)", filename)
+		}
+		if head := info[gitHeadInfoKey]; head != "" {
+			where += fmt.Sprintf(" (stored at commit %v)", head)
+		}
+		if tag := infoValue(info, tagInfoKey); tag != "" {
+			where += fmt.Sprintf(" (tag %#v)", tag)
+		}
+	}
+
+	return where, nil
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		err := runMaintenance(os.Args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	h := &B2Ext{}
 
 	var (
@@ -319,7 +1706,13 @@ func main() {
 		out = io.MultiWriter(out, os.Stderr)
 	}
 
-	err := external.RunLoop(in, out, h)
+	err := external.RunLoop(in, out, loggingHandler{h})
+
+	// Metrics are best-effort; failing to write them never fails the run.
+	if metricsErr := h.metrics.writeFile(); metricsErr != nil {
+		fmt.Fprintf(os.Stderr, "Warning: couldn't write metrics file: %v\n", metricsErr)
+	}
+
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
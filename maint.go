@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// argsConfig supplies settings to maintenance commands. Settings given as
+// name=value arguments take precedence over $B2_<NAME> environment
+// variables (for example, bucket=foo or $B2_BUCKET.)
+type argsConfig map[string]string
+
+func (ac argsConfig) GetConfig(name string) (string, error) {
+	if value, ok := ac[name]; ok {
+		return value, nil
+	}
+	return os.Getenv("B2_" + strings.ToUpper(name)), nil
+}
+
+type maintCommand struct {
+	name  string
+	usage string
+	help  string
+	run   func(be *B2Ext, config argsConfig, args []string) error
+}
+
+var maintCommands []maintCommand
+
+func init() {
+	maintCommands = []maintCommand{
+		{
+			name:  "emptyremote",
+			usage: "emptyremote --force [--whole-bucket]",
+			help:  "delete every version of every object under the prefix",
+			run:   runEmptyRemote,
+		},
+		{
+			name:  "writemanifest",
+			usage: "writemanifest",
+			help:  "bring the manifest of stored keys up to date with the bucket",
+			run:   runWriteManifest,
+		},
+		{
+			name:  "showmanifest",
+			usage: "showmanifest",
+			help:  "print the manifest: key, size and SHA1 separated by tabs",
+			run:   runShowManifest,
+		},
+		{
+			name:  "report",
+			usage: "report",
+			help:  "print each stored key with its object name, size and SHA1, as JSON lines",
+			run:   runReport,
+		},
+		{
+			name:  "usage",
+			usage: "usage [--refresh]",
+			help:  "print the number and total size of the objects stored",
+			run:   runUsage,
+		},
+		{
+			name:  "expire",
+			usage: "expire",
+			help:  "remove keys stored with expireafter whose expiry has passed",
+			run:   runExpire,
+		},
+		{
+			name:  "migrate",
+			usage: "migrate from=<prefix> [--dry-run] [--delete]",
+			help:  "copy keys stored under an old prefix to the configured one",
+			run:   runMigrate,
+		},
+		{
+			name:  "rename",
+			usage: "rename <old key> <new key> [--delete]",
+			help:  "copy a key's object to a new key inside B2, for git annex migrate",
+			run:   runRename,
+		},
+		{
+			name:  "cat",
+			usage: "cat <key>",
+			help:  "write a key's content to standard output, checking it against the key",
+			run:   runCat,
+		},
+		{
+			name:  "store",
+			usage: "store <key> < content",
+			help:  "store a key with content read from standard input",
+			run:   runStore,
+		},
+		{
+			name:  "bulkstore",
+			usage: "bulkstore <list file>",
+			help:  "store the keys in a list of keys and files, resumably",
+			run:   runBulkStore,
+		},
+		{
+			name:  "retrieveversion",
+			usage: "retrieveversion <key> <fileid> <file>",
+			help:  "download an older version of a key's object into file, checking it against the key",
+			run:   runRetrieveVersion,
+		},
+		{
+			name:  "repair",
+			usage: "repair <key>... | repair -",
+			help:  "download and check keys, replacing bad ones with good copies from the cache or mirror",
+			run:   runRepair,
+		},
+		{
+			name:  "fixsha1",
+			usage: "fixsha1 [--dry-run]",
+			help:  "download and re-upload objects B2 has no SHA1 for, so they can be verified",
+			run:   runFixSHA1,
+		},
+		{
+			name:  "removebatch",
+			usage: "removebatch <batch id> [--dry-run]",
+			help:  "remove every key stored with the given batchid",
+			run:   runRemoveBatch,
+		},
+		{
+			name:  "verifyjournal",
+			usage: "verifyjournal",
+			help:  "check the bucket against the journal kept with journalsecret",
+			run:   runVerifyJournal,
+		},
+		{
+			name:  "estimate",
+			usage: "estimate [--refresh]",
+			help:  "estimate the remote's monthly B2 bill, roughly",
+			run:   runEstimate,
+		},
+	}
+}
+
+func maintUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: git-annex-remote-b2 <command> [name=value...] [arguments...]\n\n")
+	fmt.Fprintf(os.Stderr, "With no command, speaks the git-annex external special remote protocol.\n")
+	fmt.Fprintf(os.Stderr, "Settings (bucket, prefix, ...) are given as name=value arguments or\n")
+	fmt.Fprintf(os.Stderr, "$B2_<NAME> environment variables.\n\nCommands:\n")
+	for _, cmd := range maintCommands {
+		fmt.Fprintf(os.Stderr, "  %-30s %v\n", cmd.usage, cmd.help)
+	}
+}
+
+// runMaintenance runs the maintenance command named by args[0].
+func runMaintenance(args []string) error {
+	switch args[0] {
+	case "help", "-h", "--help":
+		maintUsage()
+		return nil
+	}
+
+	var cmd *maintCommand
+	for i := range maintCommands {
+		if maintCommands[i].name == args[0] {
+			cmd = &maintCommands[i]
+		}
+	}
+	if cmd == nil {
+		maintUsage()
+		return fmt.Errorf("unknown command %#v", args[0])
+	}
+
+	config := make(argsConfig)
+	var rest []string
+	for _, arg := range args[1:] {
+		if i := strings.Index(arg, "="); i > 0 && !strings.HasPrefix(arg, "-") {
+			config[arg[:i]] = arg[i+1:]
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+
+	be := &B2Ext{}
+	err := be.setup(config, false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if metricsErr := be.metrics.writeFile(); metricsErr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: couldn't write metrics file: %v\n", metricsErr)
+		}
+	}()
+
+	err = cmd.run(be, config, rest)
+	if flushErr := be.flushPacks(); flushErr != nil && err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// hasFlag reports whether flag is among args.
+func hasFlag(args []string, flag string) bool {
+	for _, arg := range args {
+		if arg == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func runEmptyRemote(be *B2Ext, config argsConfig, args []string) error {
+	if !hasFlag(args, "--force") {
+		return errors.New("emptyremote deletes everything under the prefix; pass --force to confirm")
+	}
+	if be.prefix == "" && !hasFlag(args, "--whole-bucket") {
+		return fmt.Errorf("no prefix is set, so emptyremote would delete everything in bucket %#v; "+
+			"pass --whole-bucket as well to confirm", be.bucket.name)
+	}
+
+	concurrency, err := getIntConfig(config, "deleteconcurrency", 10)
+	if err != nil {
+		return err
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	buckets := []*bucketHandle{be.bucket}
+	if be.mirror != nil {
+		buckets = append(buckets, be.mirror)
+	}
+
+	var failed int64
+	for _, bh := range buckets {
+		progress := newBatchProgress(fmt.Sprintf("Deleting from bucket %#v", bh.name), -1)
+		deleted, errs := bh.deleteAllVersions(be.prefix, concurrency, progress)
+		progress.finish()
+		infof("Deleted %v file versions from bucket %#v", deleted, bh.name)
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		failed += int64(len(errs))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%v deletions failed", failed)
+	}
+	return nil
+}
+
+// deleteAllVersions deletes every version of every file under prefix using
+// concurrency parallel workers, adding each to progress. It returns the
+// number of versions deleted and the errors encountered along the way.
+func (bh *bucketHandle) deleteAllVersions(prefix string, concurrency int, progress *batchProgress) (int64, []error) {
+	var (
+		deleted int64
+		errsMu  sync.Mutex
+		errs    []error
+		wg      sync.WaitGroup
+	)
+
+	work := make(chan backblaze.FileStatus)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range work {
+				f := f
+				err := bh.call("delete file version", func() error {
+					_, err := bh.DeleteFileVersion(f.Name, f.ID)
+					return err
+				})
+				if err != nil {
+					errsMu.Lock()
+					errs = append(errs, fmt.Errorf("couldn't delete %v (version %v): %v", f.Name, f.ID, err))
+					errsMu.Unlock()
+					continue
+				}
+				atomic.AddInt64(&deleted, 1)
+				progress.add(int64(f.Size))
+			}
+		}()
+	}
+
+	listErr := bh.listVersions(prefix, func(f backblaze.FileStatus) error {
+		work <- f
+		return nil
+	})
+	close(work)
+	wg.Wait()
+
+	bh.clearListFileCache()
+
+	if listErr != nil {
+		errs = append(errs, listErr)
+	}
+
+	return deleted, errs
+}
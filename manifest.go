@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// The manifest records every key stored in the remote with its size and
+// SHA1, so that the bucket describes itself even if the git-annex
+// repository is lost. Each entry is an empty object named
+//
+//	<prefix>.git-annex-remote-b2/manifest/<key>/<size>/<sha1>
+//
+// so the whole manifest can be read with a listing, without downloading
+// anything, and concurrent stores never contend for a single object.
+
+type manifestEntry struct {
+	key  string
+	size int64
+	sha  string
+}
+
+func (be *B2Ext) manifestKeyPrefix(key string) string {
+	return be.internalName("manifest/" + key + "/")
+}
+
+func (be *B2Ext) manifestEntryName(ent manifestEntry) string {
+	return fmt.Sprintf("%v%d/%v", be.manifestKeyPrefix(ent.key), ent.size, ent.sha)
+}
+
+func (be *B2Ext) parseManifestEntry(name string) (manifestEntry, bool) {
+	parts := strings.Split(strings.TrimPrefix(name, be.internalName("manifest/")), "/")
+	if len(parts) != 3 {
+		return manifestEntry{}, false
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return manifestEntry{}, false
+	}
+	return manifestEntry{key: parts[0], size: size, sha: parts[2]}, true
+}
+
+// manifestRecord makes ent the manifest entry for its key in bh, replacing
+// any older entries for the key.
+func (be *B2Ext) manifestRecord(bh *bucketHandle, ent manifestEntry) error {
+	want := be.manifestEntryName(ent)
+
+	var have bool
+	err := bh.listNames(be.manifestKeyPrefix(ent.key), func(f backblaze.FileStatus) error {
+		if f.Name == want {
+			have = true
+			return nil
+		}
+		return bh.remove(f.Name)
+	})
+	if err != nil {
+		return err
+	}
+	if have {
+		return nil
+	}
+
+	return bh.putSmall(want, nil, nil)
+}
+
+// manifestForget removes the manifest entries for key from bh.
+func (be *B2Ext) manifestForget(bh *bucketHandle, key string) error {
+	return bh.listNames(be.manifestKeyPrefix(key), func(f backblaze.FileStatus) error {
+		return bh.remove(f.Name)
+	})
+}
+
+// storedKeys calls fn for every key stored in bh, with the name of the
+// object holding its content (a pack, for packed keys), its size, or -1 if
+// that isn't known, and its SHA1, or "" if that isn't known without asking
+// B2.
+func (be *B2Ext) storedKeys(bh *bucketHandle, fn func(key, contentName string, size int64, sha string) error) error {
+	if be.cas {
+		indexPrefix := be.internalName("index/")
+		return bh.listNames(indexPrefix, func(f backblaze.FileStatus) error {
+			key := strings.TrimPrefix(f.Name, indexPrefix)
+			sha, err := be.casLookup(bh, key)
+			if err != nil {
+				return err
+			}
+			return fn(key, be.casObjectName(sha), -1, sha)
+		})
+	}
+
+	err := bh.listNames(be.prefix, func(f backblaze.FileStatus) error {
+		key, ok := keyInPrefix(be.prefix, f.Name)
+		if !ok {
+			return nil
+		}
+		return fn(key, f.Name, int64(f.Size), "")
+	})
+	if err != nil || bh.packs == nil {
+		return err
+	}
+
+	return bh.packs.keys(func(ent packEntry, packName string) error {
+		return fn(ent.key, packName, ent.length, ent.sha)
+	})
+}
+
+func runWriteManifest(be *B2Ext, config argsConfig, args []string) error {
+	bh := be.bucket
+
+	existing := make(map[string]manifestEntry)
+	err := bh.listNames(be.internalName("manifest/"), func(f backblaze.FileStatus) error {
+		if ent, ok := be.parseManifestEntry(f.Name); ok {
+			existing[ent.key] = ent
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	var added int
+	err = be.storedKeys(bh, func(key, contentName string, size int64, sha string) error {
+		seen[key] = true
+		if _, ok := existing[key]; ok {
+			return nil
+		}
+
+		if size >= 0 && sha != "" {
+			added++
+			return bh.putSmall(be.manifestEntryName(manifestEntry{key: key, size: size, sha: sha}), nil, nil)
+		}
+
+		found, fileID, err := bh.listFileCached(contentName)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("content of %v (%v) is missing", key, contentName)
+		}
+		var b2file *backblaze.File
+		err = bh.call("get file info", func() (err error) {
+			b2file, err = bh.GetFileInfo(fileID)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't get file info for %v: %v", contentName, err)
+		}
+		sha = contentSHA1(b2file)
+		if _, err := hex.DecodeString(sha); err != nil || sha == "" {
+			return fmt.Errorf("%v has no SHA1 in B2", contentName)
+		}
+
+		added++
+		return bh.putSmall(be.manifestEntryName(manifestEntry{
+			key:  key,
+			size: b2file.ContentLength,
+			sha:  sha,
+		}), nil, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	var removed int
+	for key := range existing {
+		if !seen[key] {
+			removed++
+			err = be.manifestForget(bh, key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	infof("Manifest updated: %v keys, %v added, %v stale entries removed", len(seen), added, removed)
+	return nil
+}
+
+func runShowManifest(be *B2Ext, config argsConfig, args []string) error {
+	return be.bucket.listNames(be.internalName("manifest/"), func(f backblaze.FileStatus) error {
+		if ent, ok := be.parseManifestEntry(f.Name); ok {
+			fmt.Printf("%v\t%d\t%v\n", ent.key, ent.size, ent.sha)
+		}
+		return nil
+	})
+}
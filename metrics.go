@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// metrics counts the B2 requests and bytes transferred by this process, so
+// they can be written out in the Prometheus textfile format when it exits.
+// All methods are safe to call on a nil *metrics, which counts nothing.
+type metrics struct {
+	path string
+
+	mu         sync.Mutex
+	requests   map[string]*requestStats
+	uploaded   int64
+	downloaded int64
+}
+
+type requestStats struct {
+	count    int64
+	errors   int64
+	duration time.Duration
+}
+
+func newMetrics(path string) *metrics {
+	return &metrics{
+		path:     path,
+		requests: make(map[string]*requestStats),
+	}
+}
+
+// observeRequest records one B2 request (a single attempt, not including
+// retries) of type op.
+func (m *metrics) observeRequest(op string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := m.requests[op]
+	if stats == nil {
+		stats = &requestStats{}
+		m.requests[op] = stats
+	}
+	stats.count++
+	stats.duration += d
+	if err != nil {
+		stats.errors++
+	}
+}
+
+func (m *metrics) addUploaded(n int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.uploaded += n
+	m.mu.Unlock()
+}
+
+func (m *metrics) addDownloaded(n int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.downloaded += n
+	m.mu.Unlock()
+}
+
+// uploadCounter wraps r so that bytes read from it count as uploaded.
+func (m *metrics) uploadCounter(r io.Reader) io.Reader {
+	if m == nil {
+		return r
+	}
+	return &countingReader{r: r, add: m.addUploaded}
+}
+
+type countingReader struct {
+	r   io.Reader
+	add func(int64)
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.add(int64(n))
+	return n, err
+}
+
+func (m *metrics) format() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var buf bytes.Buffer
+
+	ops := make([]string, 0, len(m.requests))
+	for op := range m.requests {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	fmt.Fprintf(&buf, "# HELP git_annex_remote_b2_requests_total B2 API requests made, including retries.\n")
+	fmt.Fprintf(&buf, "# TYPE git_annex_remote_b2_requests_total counter\n")
+	for _, op := range ops {
+		fmt.Fprintf(&buf, "git_annex_remote_b2_requests_total{op=%q} %d\n", op, m.requests[op].count)
+	}
+
+	fmt.Fprintf(&buf, "# HELP git_annex_remote_b2_request_errors_total B2 API requests that failed.\n")
+	fmt.Fprintf(&buf, "# TYPE git_annex_remote_b2_request_errors_total counter\n")
+	for _, op := range ops {
+		fmt.Fprintf(&buf, "git_annex_remote_b2_request_errors_total{op=%q} %d\n", op, m.requests[op].errors)
+	}
+
+	fmt.Fprintf(&buf, "# HELP git_annex_remote_b2_request_duration_seconds_total Time spent in B2 API requests.\n")
+	fmt.Fprintf(&buf, "# TYPE git_annex_remote_b2_request_duration_seconds_total counter\n")
+	for _, op := range ops {
+		fmt.Fprintf(&buf, "git_annex_remote_b2_request_duration_seconds_total{op=%q} %g\n",
+			op, m.requests[op].duration.Seconds())
+	}
+
+	fmt.Fprintf(&buf, "# HELP git_annex_remote_b2_uploaded_bytes_total Bytes uploaded to B2.\n")
+	fmt.Fprintf(&buf, "# TYPE git_annex_remote_b2_uploaded_bytes_total counter\n")
+	fmt.Fprintf(&buf, "git_annex_remote_b2_uploaded_bytes_total %d\n", m.uploaded)
+
+	fmt.Fprintf(&buf, "# HELP git_annex_remote_b2_downloaded_bytes_total Bytes downloaded from B2.\n")
+	fmt.Fprintf(&buf, "# TYPE git_annex_remote_b2_downloaded_bytes_total counter\n")
+	fmt.Fprintf(&buf, "git_annex_remote_b2_downloaded_bytes_total %d\n", m.downloaded)
+
+	fmt.Fprintf(&buf, "# HELP git_annex_remote_b2_last_run_timestamp_seconds When this process finished.\n")
+	fmt.Fprintf(&buf, "# TYPE git_annex_remote_b2_last_run_timestamp_seconds gauge\n")
+	fmt.Fprintf(&buf, "git_annex_remote_b2_last_run_timestamp_seconds %d\n", time.Now().Unix())
+
+	return buf.Bytes()
+}
+
+// writeFile writes the metrics to the configured path, replacing it
+// atomically so a collector never reads a partial file.
+func (m *metrics) writeFile() error {
+	if m == nil || m.path == "" {
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(m.path), ".tmp-"+filepath.Base(m.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(m.format())
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), m.path)
+}
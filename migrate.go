@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// The migrate command moves keys stored under an old prefix (given as
+// from=) to where the remote's current settings put them, copying each
+// object inside B2 with b2_copy_file so that nothing is downloaded. With
+// --dry-run, it only reports what it would do and what that would cost.
+
+// migration is one key to move.
+type migration struct {
+	key    string
+	source backblaze.FileStatus
+	target string
+	exists bool
+}
+
+// planMigration maps each key stored under from in bh to its object name in
+// the current layout, noting whether an object of the same size is already
+// there.
+func (be *B2Ext) planMigration(bh *bucketHandle, from string) ([]migration, error) {
+	existing := make(map[string]int64)
+	err := bh.listNames(be.prefix, func(f backblaze.FileStatus) error {
+		existing[f.Name] = int64(f.Size)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var plan []migration
+	err = bh.listNames(from, func(f backblaze.FileStatus) error {
+		key, ok := keyInPrefix(from, f.Name)
+		if !ok {
+			return nil
+		}
+		target := be.objectName(key)
+		if target == f.Name {
+			return nil
+		}
+		size, ok := existing[target]
+		plan = append(plan, migration{
+			key:    key,
+			source: f,
+			target: target,
+			exists: ok && size == int64(f.Size),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// copyFile copies the file version sourceID to name, with the same content
+// and file info, and returns the new file.
+func (bh *bucketHandle) copyFile(sourceID, name string) (rawFile, error) {
+	var copied rawFile
+	err := bh.call("copy file", func() error {
+		return bh.session.raw.call("b2_copy_file", map[string]interface{}{
+			"sourceFileId":      sourceID,
+			"fileName":          name,
+			"metadataDirective": "COPY",
+		}, &copied)
+	})
+	bh.clearListFileCache()
+	return copied, err
+}
+
+func runMigrate(be *B2Ext, config argsConfig, args []string) error {
+	if be.cas {
+		return errors.New("migrate only moves keys between prefixes of the normal layout, not with cas=yes")
+	}
+
+	from, err := config.GetConfig("from")
+	if err != nil {
+		return err
+	}
+	if from == "" {
+		return errors.New("usage: migrate from=<old prefix> [--dry-run] [--delete]")
+	}
+	if from == "/" {
+		from = ""
+	} else if !strings.HasSuffix(from, "/") {
+		from += "/"
+	}
+
+	dryRun := hasFlag(args, "--dry-run")
+	deleteSource := hasFlag(args, "--delete")
+	bh := be.bucket
+
+	plan, err := be.planMigration(bh, from)
+	if err != nil {
+		return err
+	}
+
+	var toCopy, present int
+	var copyBytes int64
+	for _, m := range plan {
+		if m.exists {
+			present++
+		} else {
+			toCopy++
+			copyBytes += int64(m.source.Size)
+		}
+	}
+
+	if dryRun {
+		for _, m := range plan {
+			action := "copy"
+			if m.exists {
+				action = "exists"
+			}
+			fmt.Printf("%v\t%v\t%v\t%d\n", action, m.source.Name, m.target, m.source.Size)
+		}
+
+		fmt.Printf("%v keys to copy (%v), %v already in place\n", toCopy, formatBytes(copyBytes), present)
+		requests := fmt.Sprintf("%v copy requests", toCopy)
+		if deleteSource {
+			requests += fmt.Sprintf(" and %v delete requests", len(plan))
+		}
+		fmt.Printf("migrating would make %v; copies happen inside B2, so nothing is downloaded\n", requests)
+		return nil
+	}
+
+	progress := newBatchProgress("Migrating keys", len(plan))
+	var failed int
+	for _, m := range plan {
+		if !m.exists {
+			_, err := bh.copyFile(m.source.ID, m.target)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: couldn't copy %v to %v: %v\n", m.source.Name, m.target, err)
+				failed++
+				continue
+			}
+		}
+
+		if deleteSource {
+			err := bh.call("delete file version", func() error {
+				_, err := bh.DeleteFileVersion(m.source.Name, m.source.ID)
+				return err
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: copied %v but couldn't delete it: %v\n", m.source.Name, err)
+				failed++
+				continue
+			}
+		}
+
+		progress.add(int64(m.source.Size))
+	}
+	progress.finish()
+
+	infof("Migrated %v keys from %#v to %#v", len(plan)-failed, from, be.prefix)
+	if failed > 0 {
+		return fmt.Errorf("%v keys failed to migrate", failed)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Each remote records its git-annex UUID in an owner marker object inside
+// its prefix. If two remotes are accidentally configured with the same
+// bucket and prefix, the second one finds the first one's UUID there and
+// complains, before the two start clobbering each other's objects.
+
+func (be *B2Ext) ownerMarkerName() string {
+	return be.internalName("owner")
+}
+
+// checkOwnership makes sure the owner marker in each bucket names uuid,
+// creating it where it's missing. A marker naming some other UUID is an
+// error if strictownership is set, and a warning otherwise. So is failing
+// to read or create the marker, as an application key that can only read
+// or only write does.
+func (be *B2Ext) checkOwnership(uuid string) error {
+	buckets := []*bucketHandle{be.bucket}
+	if be.mirror != nil {
+		buckets = append(buckets, be.mirror)
+	}
+
+	for _, bh := range buckets {
+		data, err := bh.getSmall(be.ownerMarkerName())
+		if err != nil {
+			if classifyError(err) != errorNotFound {
+				err = be.ownershipProblem(fmt.Sprintf("couldn't read the owner marker in bucket %#v: %v", bh.name, err))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			debugf("creating owner marker in bucket %#v", bh.name)
+			err = bh.putSmall(be.ownerMarkerName(), []byte(uuid+"\n"), nil)
+			if err != nil {
+				err = be.ownershipProblem(fmt.Sprintf("couldn't create the owner marker in bucket %#v: %v", bh.name, err))
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		owner := strings.TrimSpace(string(data))
+		if owner == uuid {
+			continue
+		}
+
+		err = be.ownershipProblem(fmt.Sprintf("prefix %#v of bucket %#v belongs to the git-annex remote with UUID %v, "+
+			"not this one (%v); two remotes sharing a prefix will clobber each other's objects", be.prefix, bh.name, owner, uuid))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ownershipProblem returns msg as an error if strictownership is set, and
+// otherwise warns about it.
+func (be *B2Ext) ownershipProblem(msg string) error {
+	if be.strictOwnership {
+		return fmt.Errorf("%v", msg)
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %v\n", msg)
+	return nil
+}
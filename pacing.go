@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// requestPacer spaces B2 requests at least interval apart, across all of
+// the goroutines making them. A nil requestPacer doesn't wait.
+type requestPacer struct {
+	interval time.Duration
+	clock    clock
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newRequestPacer(interval time.Duration) *requestPacer {
+	if interval <= 0 {
+		return nil
+	}
+	return &requestPacer{interval: interval, clock: realClock{}}
+}
+
+// wait blocks until the next request may be made.
+func (p *requestPacer) wait() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	now := p.clock.Now()
+	at := p.next
+	if at.Before(now) {
+		at = now
+	}
+	p.next = at.Add(p.interval)
+	p.mu.Unlock()
+
+	if d := at.Sub(now); d > 0 {
+		p.clock.Sleep(d)
+	}
+}
+
+// defaultListConcurrency is how many listing requests may run at once by
+// default.
+const defaultListConcurrency = 4
+
+// listLimiter bounds how many listing requests (class C transactions) run
+// at once, separately from transfers. A nil listLimiter doesn't limit.
+type listLimiter chan struct{}
+
+func newListLimiter(n int) listLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(listLimiter, n)
+}
+
+// do runs fn once fewer than the limit of listings are running.
+func (l listLimiter) do(fn func() error) error {
+	if l == nil {
+		return fn()
+	}
+	l <- struct{}{}
+	defer func() { <-l }()
+	return fn()
+}
@@ -0,0 +1,765 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// With pack=yes, keys no larger than packthreshold aren't stored as objects
+// of their own, but packed together with others. A key isn't reported as
+// stored until the pack holding it has been uploaded, since git-annex may
+// drop its own copy then; git-annex stores one key at a time, so each of
+// its stores uploads a pack of its own. Bulk stores (see bulkstore.go),
+// which only report keys once their pack is uploaded, instead stage keys in
+// memory and upload those staged so far as a new pack once they reach
+// packsize, once no more have come along for packFlushDelay, or when the
+// run ends. In a repository of many small files, this turns a great many
+// objects and uploads into a few. Under the remote's internal directory:
+//
+//	packs/<id>            the packed content, one key after another
+//	packs/<id>.idx        "<offset> <length> <sha1> <key>" for each packed key
+//	packs/removed/<key>   a marker that key has been removed
+//
+// A pack is uploaded once and never changed, so removing a key doesn't
+// rewrite its pack; it adds a removal marker instead. Once a pack has been
+// left alone for a while and most of it has been removed, it's rewritten
+// without its removed keys.
+
+const (
+	defaultPackThreshold = 64 << 10
+	defaultPackSize      = 8 << 20
+
+	// packMaxEntries keeps a pack's index small enough for getSmall.
+	packMaxEntries = 2000
+
+	// packFlushDelay is how long staged keys wait for more to join them
+	// before they're uploaded anyway.
+	packFlushDelay = 30 * time.Second
+
+	// packRefreshInterval is how often a key that isn't in the packs as
+	// last loaded makes them be loaded again, in case another process has
+	// packed it since.
+	packRefreshInterval = time.Minute
+
+	// packIdleAge is how long a pack must go unchanged before it can be
+	// rewritten, so that a pack whose keys are being removed one by one
+	// isn't rewritten over and over as they go.
+	packIdleAge = 24 * time.Hour
+)
+
+type packEntry struct {
+	key            string
+	offset, length int64
+	sha            string
+}
+
+// packIndex describes one pack and its index object.
+type packIndex struct {
+	id                    string
+	packFileID, idxFileID string
+	updated               time.Time
+	entries               []packEntry
+}
+
+func (pi *packIndex) size() int64 {
+	if len(pi.entries) == 0 {
+		return 0
+	}
+	last := pi.entries[len(pi.entries)-1]
+	return last.offset + last.length
+}
+
+func (pi *packIndex) entry(key string) (packEntry, bool) {
+	for i := len(pi.entries) - 1; i >= 0; i-- {
+		if pi.entries[i].key == key {
+			return pi.entries[i], true
+		}
+	}
+	return packEntry{}, false
+}
+
+func formatPackIndex(entries []packEntry) []byte {
+	var buf bytes.Buffer
+	for _, ent := range entries {
+		fmt.Fprintf(&buf, "%d %d %v %v\n", ent.offset, ent.length, ent.sha, ent.key)
+	}
+	return buf.Bytes()
+}
+
+func parsePackIndex(data []byte) ([]packEntry, error) {
+	var entries []packEntry
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("malformed pack index line %#v", line)
+		}
+		offset, err1 := strconv.ParseInt(fields[0], 10, 64)
+		length, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("malformed pack index line %#v", line)
+		}
+		entries = append(entries, packEntry{key: fields[3], offset: offset, length: length, sha: fields[2]})
+	}
+	return entries, nil
+}
+
+// packer keeps the packs of one bucket.
+type packer struct {
+	bh        *bucketHandle
+	dir       string
+	threshold int64
+	maxSize   int64
+
+	mu       sync.Mutex
+	loaded   bool
+	loadedAt time.Time
+	packs    map[string]*packIndex
+	byKey    map[string][]*packIndex
+	removed  map[string]string // key -> file ID of its removal marker
+
+	// staged are the keys stored since the last flush, with offsets into
+	// stagedData, which holds their content.
+	staged     []packEntry
+	stagedData []byte
+	flushTimer timer
+
+	// deferFlush makes store leave keys staged, for a caller that only
+	// counts them as stored once isStaged says they no longer are.
+	// Otherwise store uploads each key's pack before returning.
+	deferFlush bool
+}
+
+func newPacker(bh *bucketHandle, dir string, threshold, maxSize int64) *packer {
+	return &packer{bh: bh, dir: dir, threshold: threshold, maxSize: maxSize}
+}
+
+func (p *packer) packName(id string) string {
+	return p.dir + id
+}
+
+func (p *packer) indexName(id string) string {
+	return p.dir + id + ".idx"
+}
+
+func (p *packer) markerName(key string) string {
+	return p.dir + "removed/" + key
+}
+
+// load reads the packs and removal markers in the bucket, downloading only
+// the indexes that changed since the last load.
+func (p *packer) load() error {
+	packs := make(map[string]*packIndex)
+	removed := make(map[string]string)
+	packFileIDs := make(map[string]string)
+	changed := !p.loaded
+
+	err := p.bh.listNamesWithInfo(p.dir, func(f rawFile) error {
+		name := strings.TrimPrefix(f.FileName, p.dir)
+		switch {
+		case strings.HasPrefix(name, "removed/"):
+			removed[strings.TrimPrefix(name, "removed/")] = f.FileID
+		case strings.HasSuffix(name, ".idx"):
+			id := strings.TrimSuffix(name, ".idx")
+			if pi, ok := p.packs[id]; ok && pi.idxFileID == f.FileID {
+				packs[id] = pi
+				return nil
+			}
+
+			data, err := p.bh.getSmall(f.FileName)
+			if err != nil {
+				return fmt.Errorf("couldn't read pack index %#v: %v", f.FileName, err)
+			}
+			entries, err := parsePackIndex(data)
+			if err != nil {
+				return fmt.Errorf("%#v: %v", f.FileName, err)
+			}
+			packs[id] = &packIndex{
+				id:        id,
+				idxFileID: f.FileID,
+				updated:   time.Unix(0, f.UploadTimestamp*int64(time.Millisecond)),
+				entries:   entries,
+			}
+			changed = true
+		default:
+			packFileIDs[name] = f.FileID
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for id, pi := range packs {
+		pi.packFileID = packFileIDs[id]
+	}
+	if len(packs) != len(p.packs) {
+		changed = true
+	}
+
+	p.packs = packs
+	p.removed = removed
+	p.loaded = true
+	p.loadedAt = p.bh.clock.Now()
+	if changed {
+		p.byKey = make(map[string][]*packIndex)
+		for _, pi := range packs {
+			p.addToKeys(pi, pi.entries)
+		}
+	}
+
+	return nil
+}
+
+func (p *packer) addToKeys(pi *packIndex, entries []packEntry) {
+	for _, ent := range entries {
+		p.byKey[ent.key] = append(p.byKey[ent.key], pi)
+	}
+}
+
+// lookup finds key in the packs. If refresh is set and key isn't in what
+// was loaded before, the packs are loaded again in case another process
+// has packed it since, unless they were loaded within packRefreshInterval.
+func (p *packer) lookup(key string, refresh bool) (*packIndex, packEntry, error) {
+	if !p.loaded {
+		err := p.load()
+		if err != nil {
+			return nil, packEntry{}, err
+		}
+	}
+
+	pi, ent := p.find(key)
+	if pi == nil && refresh && since(p.bh.clock, p.loadedAt) >= packRefreshInterval {
+		err := p.load()
+		if err != nil {
+			return nil, packEntry{}, err
+		}
+		pi, ent = p.find(key)
+	}
+	return pi, ent, nil
+}
+
+// find finds key in the packs as loaded.
+func (p *packer) find(key string) (*packIndex, packEntry) {
+	if _, gone := p.removed[key]; gone {
+		return nil, packEntry{}
+	}
+	pis := p.byKey[key]
+	if len(pis) == 0 {
+		return nil, packEntry{}
+	}
+	ent, _ := pis[len(pis)-1].entry(key)
+	return pis[len(pis)-1], ent
+}
+
+// stagedEntry finds key among the staged keys.
+func (p *packer) stagedEntry(key string) (packEntry, bool) {
+	for i := len(p.staged) - 1; i >= 0; i-- {
+		if p.staged[i].key == key {
+			return p.staged[i], true
+		}
+	}
+	return packEntry{}, false
+}
+
+// present reports whether key is staged or in a pack.
+func (p *packer) present(key string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.stagedEntry(key); ok {
+		return true, nil
+	}
+	pi, _, err := p.lookup(key, true)
+	return pi != nil, err
+}
+
+// retrieve writes key's content into fh, which is truncated first. It
+// reports whether key was found in a pack.
+func (p *packer) retrieve(key string, fh *os.File) (bool, error) {
+	data, found, err := p.read(key)
+	if err != nil || !found {
+		return found, err
+	}
+
+	err = fh.Truncate(0)
+	if err == nil {
+		_, err = fh.Seek(0, 0)
+	}
+	if err == nil {
+		_, err = fh.Write(data)
+	}
+	return true, err
+}
+
+// read returns key's content, and reports whether key was found in a pack.
+func (p *packer) read(key string) ([]byte, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ent, ok := p.stagedEntry(key); ok {
+		data := append([]byte(nil), p.stagedData[ent.offset:ent.offset+ent.length]...)
+		return data, true, nil
+	}
+
+	var data []byte
+	for attempt := 0; ; attempt++ {
+		pi, ent, err := p.lookup(key, true)
+		if err != nil || pi == nil {
+			return nil, false, err
+		}
+
+		data = nil
+		if ent.length > 0 {
+			data, err = p.bh.readRange(p.packName(pi.id), ent.offset, ent.length)
+		}
+		if err == nil && int64(len(data)) != ent.length {
+			err = fmt.Errorf("pack %v ends before %v", pi.id, key)
+		}
+		if err == nil {
+			sum := sha1.Sum(data)
+			if hex.EncodeToString(sum[:]) != ent.sha {
+				return nil, true, fmt.Errorf("packed content of %v has the wrong SHA1", key)
+			}
+			break
+		}
+
+		// The pack may have just been rewritten by another process.
+		if classifyError(err) != errorNotFound || attempt > 0 {
+			return nil, true, fmt.Errorf("couldn't read %v from pack %v: %v", key, pi.id, err)
+		}
+		p.loaded = false
+	}
+
+	return data, true, nil
+}
+
+// store packs key, whose content is data, uploading it in a pack of its
+// own right away; with deferFlush, it's staged for this process's next
+// pack instead, and the staged keys are uploaded now if that fills it.
+func (p *packer) store(key string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sum := sha1.Sum(data)
+	sha := hex.EncodeToString(sum[:])
+
+	if ent, ok := p.stagedEntry(key); ok && ent.sha == sha {
+		return nil
+	}
+
+	pi, ent, err := p.lookup(key, false)
+	if err != nil {
+		return err
+	}
+	if pi != nil && ent.sha == sha {
+		// Already packed, unless another process has removed it since the
+		// packs were loaded, which only its removal marker in the bucket
+		// shows.
+		found, markerID, err := p.bh.listFileCached(p.markerName(key))
+		if err != nil {
+			return fmt.Errorf("couldn't check whether packed key %v has been removed: %v", key, err)
+		}
+		if !found {
+			return nil
+		}
+		p.removed[key] = markerID
+	}
+
+	if len(p.staged) > 0 && int64(len(p.stagedData)+len(data)) > p.maxSize {
+		err = p.flushLocked()
+		if err != nil {
+			return err
+		}
+	}
+
+	p.staged = append(p.staged, packEntry{key: key, offset: int64(len(p.stagedData)), length: int64(len(data)), sha: sha})
+	p.stagedData = append(p.stagedData, data...)
+
+	if !p.deferFlush {
+		err = p.flushLocked()
+		if err != nil {
+			// The key wasn't stored, so it mustn't go up with a later
+			// pack either.
+			p.unstage(key)
+		}
+		return err
+	}
+	if int64(len(p.stagedData)) >= p.maxSize || len(p.staged) >= packMaxEntries {
+		return p.flushLocked()
+	}
+	if p.flushTimer == nil {
+		p.flushTimer = p.bh.clock.AfterFunc(packFlushDelay, p.flushLater)
+	}
+	return nil
+}
+
+// flush uploads the staged keys as a new pack.
+func (p *packer) flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.flushLocked()
+}
+
+// flushLater is flush, for when no more keys have been staged for
+// packFlushDelay. If it fails, the keys stay staged for the next try.
+func (p *packer) flushLater() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.flushTimer = nil
+	err := p.flushLocked()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: couldn't upload %v packed keys yet: %v\n", len(p.staged), err)
+		p.flushTimer = p.bh.clock.AfterFunc(packFlushDelay, p.flushLater)
+	}
+}
+
+func (p *packer) flushLocked() error {
+	if p.flushTimer != nil {
+		p.flushTimer.Stop()
+		p.flushTimer = nil
+	}
+	if len(p.staged) == 0 {
+		return nil
+	}
+	if !p.loaded {
+		err := p.load()
+		if err != nil {
+			return err
+		}
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return err
+	}
+	entries := p.staged
+
+	// The pack goes first, so that its index is never listed without its
+	// content.
+	pi := &packIndex{id: id, entries: entries}
+	pi.packFileID, err = p.upload(p.packName(id), p.stagedData, nil)
+	if err != nil {
+		return err
+	}
+	pi.idxFileID, err = p.uploadIndex(id, entries)
+	if err != nil {
+		p.deleteVersion(p.packName(id), pi.packFileID)
+		return err
+	}
+	pi.updated = p.bh.clock.Now()
+	debugf("uploaded pack %v of %v keys (%v bytes)", id, len(entries), len(p.stagedData))
+
+	p.packs[id] = pi
+	p.addToKeys(pi, entries)
+	p.staged, p.stagedData = nil, nil
+
+	return p.clearMarkers(entries)
+}
+
+// clearMarkers deletes the removal markers of the keys just packed,
+// including any another process added since the packs were loaded, with a
+// single listing of the markers.
+func (p *packer) clearMarkers(entries []packEntry) error {
+	packed := make(map[string]bool, len(entries))
+	for _, ent := range entries {
+		packed[ent.key] = true
+	}
+
+	markers := make(map[string]string)
+	err := p.bh.listNames(p.dir+"removed/", func(f backblaze.FileStatus) error {
+		if key := strings.TrimPrefix(f.Name, p.dir+"removed/"); packed[key] {
+			markers[key] = f.ID
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("packed %v keys but couldn't list their removal markers: %v", len(entries), err)
+	}
+
+	for key, markerID := range markers {
+		err = p.deleteFile(p.markerName(key), markerID)
+		if err != nil {
+			return fmt.Errorf("packed %v but couldn't clear its removal marker: %v", key, err)
+		}
+	}
+	for key := range packed {
+		delete(p.removed, key)
+	}
+	return nil
+}
+
+// unstage drops key from the staged keys, reporting whether it was staged.
+func (p *packer) unstage(key string) bool {
+	if _, ok := p.stagedEntry(key); !ok {
+		return false
+	}
+
+	var entries []packEntry
+	var data []byte
+	for _, ent := range p.staged {
+		if ent.key == key {
+			continue
+		}
+		content := p.stagedData[ent.offset : ent.offset+ent.length]
+		entries = append(entries, packEntry{key: ent.key, offset: int64(len(data)), length: ent.length, sha: ent.sha})
+		data = append(data, content...)
+	}
+	p.staged, p.stagedData = entries, data
+	return true
+}
+
+// keys calls fn with the entry of each key in the packs, and the name of
+// its pack, after loading them afresh. Staged keys aren't in the bucket
+// yet, so they're left out.
+func (p *packer) keys(fn func(ent packEntry, packName string) error) error {
+	p.mu.Lock()
+	err := p.load()
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	var names []string
+	var entries []packEntry
+	for key := range p.byKey {
+		if pi, ent := p.find(key); pi != nil {
+			names = append(names, p.packName(pi.id))
+			entries = append(entries, ent)
+		}
+	}
+	p.mu.Unlock()
+
+	for i, ent := range entries {
+		err := fn(ent, names[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove marks key as removed from the packs, reporting whether it was in
+// any of them, and rewrites packs that are left mostly removed.
+func (p *packer) remove(key string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	staged := p.unstage(key)
+	pi, _, err := p.lookup(key, true)
+	if err != nil || pi == nil {
+		return staged, err
+	}
+
+	markerID, err := p.upload(p.markerName(key), nil, nil)
+	if err != nil {
+		return true, err
+	}
+	p.removed[key] = markerID
+
+	for _, pi := range append([]*packIndex(nil), p.byKey[key]...) {
+		err = p.repack(pi)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: couldn't repack pack %v: %v\n", pi.id, err)
+		}
+	}
+
+	return true, nil
+}
+
+// repack rewrites pi without its removed keys, if it has been left alone
+// for packIdleAge and less than half of it is still in use.
+func (p *packer) repack(pi *packIndex) error {
+	if since(p.bh.clock, pi.updated) < packIdleAge || p.packs[pi.id] != pi {
+		return nil
+	}
+
+	var live []packEntry
+	var liveBytes int64
+	for _, ent := range pi.entries {
+		if _, gone := p.removed[ent.key]; !gone {
+			live = append(live, ent)
+			liveBytes += ent.length
+		}
+	}
+	if liveBytes*2 > pi.size() {
+		return nil
+	}
+
+	if len(live) > 0 {
+		var old []byte
+		if pi.size() > 0 {
+			var err error
+			old, err = p.bh.readRange(p.packName(pi.id), 0, pi.size())
+			if err != nil {
+				return err
+			}
+		}
+		if int64(len(old)) != pi.size() {
+			return fmt.Errorf("pack %v is shorter than its index says", pi.id)
+		}
+
+		id, err := randomID()
+		if err != nil {
+			return err
+		}
+		var data []byte
+		entries := make([]packEntry, 0, len(live))
+		for _, ent := range live {
+			content := old[ent.offset : ent.offset+ent.length]
+			entries = append(entries, packEntry{key: ent.key, offset: int64(len(data)), length: ent.length, sha: ent.sha})
+			data = append(data, content...)
+		}
+
+		repacked := &packIndex{id: id, updated: p.bh.clock.Now(), entries: entries}
+		repacked.packFileID, err = p.upload(p.packName(id), data, nil)
+		if err != nil {
+			return err
+		}
+		repacked.idxFileID, err = p.uploadIndex(id, entries)
+		if err != nil {
+			return err
+		}
+		p.packs[id] = repacked
+		p.addToKeys(repacked, entries)
+		debugf("repacked %v (%v bytes) into %v (%v bytes)", pi.id, pi.size(), id, len(data))
+	}
+
+	// The index goes first, so that the old pack is never listed without
+	// its content.
+	err := p.deleteFile(p.indexName(pi.id), pi.idxFileID)
+	if err != nil {
+		return err
+	}
+	p.deleteVersion(p.packName(pi.id), pi.packFileID)
+	delete(p.packs, pi.id)
+
+	// Removal markers are only needed while some pack still holds the key.
+	for _, ent := range pi.entries {
+		pis := p.byKey[ent.key][:0]
+		for _, other := range p.byKey[ent.key] {
+			if other != pi {
+				pis = append(pis, other)
+			}
+		}
+		if len(pis) > 0 {
+			p.byKey[ent.key] = pis
+			continue
+		}
+		delete(p.byKey, ent.key)
+
+		if markerID, ok := p.removed[ent.key]; ok {
+			if p.deleteFile(p.markerName(ent.key), markerID) == nil {
+				delete(p.removed, ent.key)
+			}
+		}
+	}
+
+	return nil
+}
+
+// upload uploads data as name and returns the new version's file ID.
+func (p *packer) upload(name string, data []byte, info map[string]string) (string, error) {
+	sum := sha1.Sum(data)
+	var uploaded *backblaze.File
+	err := p.bh.transfer("upload file", func() (err error) {
+		uploaded, err = p.bh.UploadHashedFile(name, info, bytes.NewReader(data),
+			hex.EncodeToString(sum[:]), int64(len(data)))
+		return err
+	})
+	p.bh.clearListFileCache()
+	if err != nil {
+		return "", fmt.Errorf("couldn't upload %#v: %v", name, err)
+	}
+	if uploaded == nil {
+		return "", fmt.Errorf("no file info returned for %#v", name)
+	}
+	p.bh.metrics.addUploaded(int64(len(data)))
+	return uploaded.ID, nil
+}
+
+// uploadIndex uploads the index of pack id, compressed if compressindex is
+// set, and returns the new version's file ID.
+func (p *packer) uploadIndex(id string, entries []packEntry) (string, error) {
+	data, info, err := p.bh.compressSidecar(formatPackIndex(entries))
+	if err != nil {
+		return "", fmt.Errorf("couldn't compress the index of pack %v: %v", id, err)
+	}
+	return p.upload(p.indexName(id), data, info)
+}
+
+func (p *packer) deleteFile(name, fileID string) error {
+	err := p.bh.call("delete file version", func() error {
+		_, err := p.bh.DeleteFileVersion(name, fileID)
+		return err
+	})
+	p.bh.clearListFileCache()
+	return err
+}
+
+// deleteVersion deletes an old version of name that is no longer needed.
+// Failing to is only worth a warning, since it costs storage, not data.
+func (p *packer) deleteVersion(name, fileID string) {
+	if fileID == "" {
+		return
+	}
+	err := p.deleteFile(name, fileID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: couldn't delete old version %v of %#v: %v\n", fileID, name, err)
+	}
+}
+
+// randomID returns a random identifier, for names that mustn't collide
+// with any other process's.
+func randomID() (string, error) {
+	var buf [8]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// isStaged reports whether key is staged to be packed, in either bucket,
+// rather than uploaded.
+func (be *B2Ext) isStaged(key string) bool {
+	for _, bh := range []*bucketHandle{be.bucket, be.mirror} {
+		if bh == nil || bh.packs == nil {
+			continue
+		}
+		bh.packs.mu.Lock()
+		_, staged := bh.packs.stagedEntry(key)
+		bh.packs.mu.Unlock()
+		if staged {
+			return true
+		}
+	}
+	return false
+}
+
+// flushPacks uploads the keys staged in each bucket's packer, which only
+// bulk stores leave there. It's called before the process exits.
+func (be *B2Ext) flushPacks() error {
+	for _, bh := range []*bucketHandle{be.bucket, be.mirror} {
+		if bh == nil || bh.packs == nil {
+			continue
+		}
+		err := bh.packs.flush()
+		if err != nil {
+			return fmt.Errorf("couldn't upload the keys packed in bucket %#v: %v", bh.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// A packed key is only reported as stored once its pack is uploaded: if
+// the upload fails, so does the store, and the key isn't left staged to
+// turn up later.
+func TestPackedStoreWaitsForUpload(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f, "pack=yes", "retries=0")
+
+	data := []byte("a small key")
+	key := testKey(data)
+	file := writeTestFile(t, data)
+
+	f.fail("upload", 503, "service_unavailable")
+	if err := be.Store(nil, key, file); err == nil {
+		t.Fatalf("Store succeeded although its pack couldn't be uploaded")
+	}
+	if be.isStaged(key) {
+		t.Fatalf("the key is still staged after its store failed")
+	}
+	if present, err := be.CheckPresent(nil, key); err != nil || present {
+		t.Fatalf("CheckPresent after the failed store returned %v, %v; want false", present, err)
+	}
+
+	if err := be.Store(nil, key, file); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if be.isStaged(key) {
+		t.Fatalf("Store returned with the key still staged")
+	}
+
+	// Another process finds it in the bucket.
+	other := newTestRemote(t, f, "pack=yes")
+	out := filepath.Join(t.TempDir(), "out")
+	if err := other.Retrieve(nil, key, out); err != nil {
+		t.Fatalf("Retrieve from another process: %v", err)
+	}
+	got, err := ioutil.ReadFile(out)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("retrieved %q (%v); want %q", got, err, data)
+	}
+}
+
+// bulkstore stages packed keys, so that they share packs.
+func TestDeferredPackFlush(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f, "pack=yes")
+	be.bucket.packs.deferFlush = true
+
+	var keys []string
+	for _, s := range []string{"one", "two", "three"} {
+		key := testKey([]byte(s))
+		if err := be.Store(nil, key, writeTestFile(t, []byte(s))); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		if !be.isStaged(key) {
+			t.Fatalf("%v wasn't staged", key)
+		}
+		keys = append(keys, key)
+	}
+	if err := be.flushPacks(); err != nil {
+		t.Fatalf("flushPacks: %v", err)
+	}
+	for _, key := range keys {
+		if be.isStaged(key) {
+			t.Fatalf("%v is still staged after flushing", key)
+		}
+	}
+	// One pack and its index.
+	if n := f.callCount("upload"); n != 2 {
+		t.Fatalf("made %v uploads; want 2", n)
+	}
+}
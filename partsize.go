@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+const (
+	// minPartSize and maxPartSize are the bounds B2 puts on the size of
+	// each part of a large file but the last. B2 reports its current
+	// minimum when authorizing (see partSizeLimits); this is the fallback.
+	minPartSize = 5 * 1000 * 1000
+	maxPartSize = 5 * 1000 * 1000 * 1000
+
+	// maxParts is the most parts a large file can have.
+	maxParts = 10000
+
+	// defaultMaxAdaptivePartSize is the size adaptive part sizing grows
+	// parts to at most, unless told otherwise.
+	defaultMaxAdaptivePartSize = 1000 * 1000 * 1000
+
+	// With adaptive part sizing, parts are doubled after taking less than
+	// partGrowBelow to upload, and halved after taking more than
+	// partShrinkAbove or timing out.
+	partGrowBelow   = 15 * time.Second
+	partShrinkAbove = 2 * time.Minute
+)
+
+// partSizer picks the size of the parts of large files. Unless it's
+// adaptive, that's always the same size. An adaptive partSizer adjusts the
+// size to the connection, as seen from how long parts take to upload, so
+// that parts are big enough not to waste round trips on fast links and
+// small enough not to time out on slow ones. It stays within [min, max],
+// and is shared by all of a process's uploads. A nil partSizer uses
+// largeFilePartSize.
+type partSizer struct {
+	min, max int64
+	adaptive bool
+
+	mu   sync.Mutex
+	size int64
+}
+
+func newPartSizer(size, min, max int64, adaptive bool) *partSizer {
+	if size < min {
+		size = min
+	}
+	if size > max {
+		size = max
+	}
+	return &partSizer{min: min, max: max, adaptive: adaptive, size: size}
+}
+
+// next returns the size of part number part of a large file of length
+// bytes, starting at offset.
+func (ps *partSizer) next(part int, offset, length int64) int64 {
+	size := int64(largeFilePartSize)
+	if ps != nil {
+		ps.mu.Lock()
+		size = ps.size
+		ps.mu.Unlock()
+	}
+
+	// Shrinking mustn't leave more of the file than the remaining parts
+	// can hold.
+	remaining := length - offset
+	partsLeft := int64(maxParts - part + 1)
+	if least := (remaining + partsLeft - 1) / partsLeft; size < least {
+		size = least
+	}
+	if part == 1 && size >= remaining {
+		// Large files have at least two parts.
+		size = (remaining + 1) / 2
+	}
+	if size > remaining {
+		size = remaining
+	}
+	return size
+}
+
+// uploaded adjusts the part size after a part of size bytes took took to
+// upload.
+func (ps *partSizer) uploaded(size int64, took time.Duration) {
+	if ps == nil || !ps.adaptive {
+		return
+	}
+
+	switch {
+	case took < partGrowBelow:
+		ps.resize(size, 2*size)
+	case took > partShrinkAbove:
+		ps.resize(size, size/2)
+	}
+}
+
+// failed adjusts the part size after a part of size bytes failed to upload
+// with err, and reports whether it changed.
+func (ps *partSizer) failed(size int64, err error) bool {
+	if ps == nil || !ps.adaptive || !isPartTimeout(err) {
+		return false
+	}
+	return ps.resize(size, size/2)
+}
+
+// resize changes the part size to size, within bounds, if it's still from
+// when a part of from bytes was sized; parts uploading at once shouldn't
+// each double or halve it. It reports whether the size changed.
+func (ps *partSizer) resize(from, size int64) bool {
+	if size < ps.min {
+		size = ps.min
+	}
+	if size > ps.max {
+		size = ps.max
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if (size > from && ps.size > from) || (size < from && ps.size < from) || ps.size == size {
+		return false
+	}
+	debugf("changing the part size of large files from %v to %v bytes", ps.size, size)
+	ps.size = size
+	return true
+}
+
+// isPartTimeout reports whether err means a part took too long to upload.
+func isPartTimeout(err error) bool {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	b2err, ok := err.(*backblaze.B2Error)
+	return ok && b2err.Status == 408
+}
+
+// partSizeLimits returns the part size B2 recommends for large files, and
+// the smallest it accepts, as given in the session's authorization. They
+// fall back to largeFilePartSize and minPartSize if B2 doesn't say.
+func (s *session) partSizeLimits() (recommended, minimum int64) {
+	recommended, minimum = largeFilePartSize, minPartSize
+	auth, err := s.raw.authorization()
+	if err != nil {
+		debugf("couldn't look up B2's part sizes: %v", err)
+		return recommended, minimum
+	}
+	if auth.RecommendedPartSize > 0 {
+		recommended = auth.RecommendedPartSize
+	}
+	if auth.AbsoluteMinimumPartSize > 0 {
+		minimum = auth.AbsoluteMinimumPartSize
+	}
+	return recommended, minimum
+}
+
+// getPartSizerConfig reads the partsize, adaptivepartsize, minpartsize and
+// maxpartsize settings. partsize defaults to the size B2 recommends, and
+// sizes below B2's minimum are raised to it: the minimum may change after
+// the remote was set up, and refusing to run would be worse.
+func getPartSizerConfig(e configSource, s *session) (*partSizer, error) {
+	adaptive, err := getBoolConfig(e, "adaptivepartsize")
+	if err != nil {
+		return nil, err
+	}
+
+	recommended, minimum := s.partSizeLimits()
+	debugf("B2 recommends parts of %v bytes, and accepts parts of at least %v bytes", recommended, minimum)
+
+	sizes := []struct {
+		name string
+		def  int64
+		size int64
+	}{
+		{name: "partsize", def: recommended},
+		{name: "minpartsize", def: minimum},
+		{name: "maxpartsize", def: defaultMaxAdaptivePartSize},
+	}
+	for i := range sizes {
+		size, err := getSizeConfig(e, sizes[i].name)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			size = sizes[i].def
+		}
+		if size > maxPartSize {
+			return nil, fmt.Errorf("%v must be at most 5GB", sizes[i].name)
+		}
+		if size < minimum {
+			fmt.Fprintf(os.Stderr, "Warning: %v is %v bytes, but B2 needs parts of at least %v bytes; using %v\n",
+				sizes[i].name, size, minimum, minimum)
+			size = minimum
+		}
+		sizes[i].size = size
+	}
+	size, min, max := sizes[0].size, sizes[1].size, sizes[2].size
+
+	if !adaptive {
+		debugf("uploading large files in parts of %v bytes", size)
+		return newPartSizer(size, size, size, false), nil
+	}
+	if min > max {
+		return nil, fmt.Errorf("minpartsize must not be larger than maxpartsize")
+	}
+	ps := newPartSizer(size, min, max, true)
+	debugf("uploading large files in parts of %v bytes to start with, adjusted between %v and %v bytes",
+		ps.size, min, max)
+	return ps, nil
+}
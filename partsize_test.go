@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+// Part sizes default to the sizes B2 reports when authorizing, and sizes
+// below its minimum are raised to it.
+func TestPartSizesFromAuthorization(t *testing.T) {
+	for _, c := range []struct {
+		name                 string
+		recommended, minimum int64
+		settings             []string
+		size, min            int64
+	}{
+		{"defaults", 50 << 20, 10 << 20, nil, 50 << 20, 50 << 20},
+		{"adaptive", 50 << 20, 10 << 20, []string{"adaptivepartsize=yes"}, 50 << 20, 10 << 20},
+		{"below minimum", 50 << 20, 10 << 20, []string{"partsize=6MB"}, 10 << 20, 10 << 20},
+		{"not reported", 0, 0, nil, largeFilePartSize, largeFilePartSize},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			f := newFakeB2(t)
+			f.auth["recommendedPartSize"] = c.recommended
+			f.auth["absoluteMinimumPartSize"] = c.minimum
+			be := newTestRemote(t, f, c.settings...)
+
+			ps := be.bucket.partSizer
+			if ps.size != c.size || ps.min != c.min {
+				t.Fatalf("parts of %v bytes, at least %v; want %v, at least %v", ps.size, ps.min, c.size, c.min)
+			}
+		})
+	}
+}
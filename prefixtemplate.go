@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The prefix may contain {uuid}, {remotename} and {description}, which are
+// expanded once, at INITREMOTE, and the expanded prefix saved in place of
+// the template; later runs (and other clones) use the saved prefix as is.
+
+var prefixTemplateRe = regexp.MustCompile(`\{[^{}]*\}`)
+
+// unsafePrefixRe matches runs of characters that aren't allowed into an
+// object name from an expanded template value.
+var unsafePrefixRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// sanitizePrefixValue makes value safe to use as one path component of a
+// prefix.
+func sanitizePrefixValue(value string) string {
+	value = strings.Trim(unsafePrefixRe.ReplaceAllString(value, "-"), "-")
+	if value == "" || value == "." || value == ".." {
+		return "unnamed"
+	}
+	return value
+}
+
+// expandPrefixTemplate expands the templates in the prefix setting, if it
+// has any, and saves the result as the prefix.
+func expandPrefixTemplate(e remoteConfig) error {
+	prefix, err := e.GetConfig("prefix")
+	if err != nil {
+		return err
+	}
+	if !strings.ContainsAny(prefix, "{}") {
+		return nil
+	}
+
+	var expandErr error
+	expanded := prefixTemplateRe.ReplaceAllStringFunc(prefix, func(tmpl string) string {
+		value, err := prefixTemplateValue(e, tmpl[1:len(tmpl)-1])
+		if err != nil && expandErr == nil {
+			expandErr = err
+		}
+		return sanitizePrefixValue(value)
+	})
+	if expandErr != nil {
+		return expandErr
+	}
+	if strings.ContainsAny(expanded, "{}") {
+		return fmt.Errorf("prefix %#v has unbalanced braces", prefix)
+	}
+
+	infof("expanded prefix %#v to %#v", prefix, expanded)
+	return e.SetConfig("prefix", expanded)
+}
+
+func prefixTemplateValue(e remoteConfig, name string) (string, error) {
+	switch name {
+	case "uuid":
+		return e.GetUUID()
+	case "remotename":
+		// git-annex passes the remote's name along with the rest of its
+		// config.
+		return e.GetConfig("name")
+	case "description":
+		return localDescription()
+	default:
+		return "", fmt.Errorf("unknown template {%v} in prefix; "+
+			"{uuid}, {remotename} and {description} are supported", name)
+	}
+}
+
+// localDescription returns the description of the git-annex repository the
+// remote is being run from, as recorded in the git-annex branch.
+func localDescription() (string, error) {
+	out, err := exec.Command("git", "config", "annex.uuid").Output()
+	if err != nil {
+		return "", fmt.Errorf("couldn't find this repository's UUID for {description}: %v", err)
+	}
+	uuid := strings.TrimSpace(string(out))
+
+	out, err = exec.Command("git", "cat-file", "blob", "git-annex:uuid.log").Output()
+	if err != nil {
+		return "", fmt.Errorf("couldn't read repository descriptions for {description}: %v", err)
+	}
+
+	// Each line is a UUID, its description, and a timestamp; the line
+	// with the latest timestamp for a UUID wins, wherever it is in the
+	// file (lines from merged branches aren't in time order.)
+	var description string
+	var latest float64
+	found := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, uuid+" ") {
+			continue
+		}
+		line = strings.TrimPrefix(line, uuid+" ")
+		var timestamp float64
+		if i := strings.LastIndex(line, " timestamp="); i >= 0 {
+			value := strings.TrimSuffix(line[i+len(" timestamp="):], "s")
+			timestamp, _ = strconv.ParseFloat(value, 64)
+			line = line[:i]
+		}
+		if found && timestamp < latest {
+			continue
+		}
+		description = line
+		latest = timestamp
+		found = true
+	}
+	if !found {
+		return "", fmt.Errorf("this repository (%v) has no description for {description}", uuid)
+	}
+
+	return description, nil
+}
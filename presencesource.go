@@ -0,0 +1,83 @@
+package main
+
+import "fmt"
+
+// By default, presence is checked with b2_list_file_names, which lists only
+// the latest version of each file and leaves hidden files out altogether.
+// With presencesource=versions, it's checked with b2_list_file_versions
+// instead, which sees every version: the latest one decides, so a hide
+// marker means the key is absent however many uploads lie under it, and
+// keys with several versions are noticed. Both are class C transactions;
+// listing versions returns more entries for files with many versions, but
+// is still a single request.
+
+// presenceVersionPage is how many versions are listed to find a file's
+// latest one. Unfinished large files are listed among them, and skipped.
+const presenceVersionPage = 10
+
+// rawFileVersionList is a page of b2_list_file_versions results.
+type rawFileVersionList struct {
+	Files []rawFile `json:"files"`
+}
+
+// listLatestVersion lists the latest version of file, like a listing of
+// file names starting at file: the result starts with file's latest
+// version (which may be a hide marker) if it has one, and otherwise with
+// whatever name sorts after it.
+func (bh *bucketHandle) listLatestVersion(file string) (rawFileList, error) {
+	var page rawFileVersionList
+	err := bh.list("list file versions", func() error {
+		return bh.session.raw.call("b2_list_file_versions", map[string]interface{}{
+			"bucketId":      bh.ID,
+			"startFileName": file,
+			"maxFileCount":  presenceVersionPage,
+		}, &page)
+	})
+	if err != nil {
+		return rawFileList{}, err
+	}
+
+	// Versions of a name are listed newest first.
+	var latest *rawFile
+	var versions int
+	for i, f := range page.Files {
+		if f.FileName != file {
+			if latest == nil && versions == 0 {
+				return rawFileList{Files: page.Files[i : i+1]}, nil
+			}
+			break
+		}
+		if f.Action == "start" {
+			continue
+		}
+		versions++
+		if latest == nil {
+			latest = &page.Files[i]
+		}
+	}
+
+	if latest == nil {
+		return rawFileList{}, nil
+	}
+	if versions > 1 {
+		debugf("%#v has at least %v versions; the latest is a %#v", file, versions, latest.Action)
+	}
+	return rawFileList{Files: []rawFile{*latest}}, nil
+}
+
+// getPresenceSourceConfig reads presencesource, returning whether presence
+// is checked by listing versions.
+func getPresenceSourceConfig(e configSource) (bool, error) {
+	source, err := e.GetConfig("presencesource")
+	if err != nil {
+		return false, err
+	}
+	switch source {
+	case "", "names":
+		return false, nil
+	case "versions":
+		return true, nil
+	default:
+		return false, fmt.Errorf("presencesource must be \"names\" or \"versions\", not %#v", source)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+// Both presence sources agree on which keys are present, and each lists
+// what it's meant to.
+func TestPresenceSources(t *testing.T) {
+	for _, c := range []struct {
+		source, api string
+	}{
+		{"names", "b2_list_file_names"},
+		{"versions", "b2_list_file_versions"},
+	} {
+		t.Run(c.source, func(t *testing.T) {
+			f := newFakeB2(t)
+			be := newTestRemote(t, f, "presencesource="+c.source, "listcachettl=0")
+
+			present := testKey([]byte("present"))
+			f.put("test-bucket", be.objectName(present), []byte("present"), "", nil)
+
+			versioned := testKey([]byte("versioned"))
+			f.put("test-bucket", be.objectName(versioned), []byte("old"), "", nil)
+			f.put("test-bucket", be.objectName(versioned), []byte("versioned"), "", nil)
+
+			// absent has a neighbour whose name starts with its own.
+			absent := testKey([]byte("absent"))
+			f.put("test-bucket", be.objectName(absent)+".ext", []byte("absent"), "", nil)
+
+			for key, want := range map[string]bool{present: true, versioned: true, absent: false} {
+				f.resetCalls()
+				got, err := be.CheckPresent(nil, key)
+				if err != nil || got != want {
+					t.Errorf("CheckPresent(%v) returned %v, %v; want %v", key, got, err, want)
+				}
+				if f.callCount(c.api) != 1 {
+					t.Errorf("CheckPresent(%v) made %v calls to %v; want 1", key, f.callCount(c.api), c.api)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	statusInterval = time.Second
+	// rateSmoothing is the weight of the newest sample in the moving
+	// average of the transfer rate.
+	rateSmoothing = 0.3
+)
+
+// statusReader prints a status line with the transfer rate and, when the
+// total size is known, the estimated time remaining, as data is read
+// through it. It is separate from the PROGRESS messages sent to git-annex.
+type statusReader struct {
+	r     io.Reader
+	w     io.Writer
+	clock clock
+	label string
+	total int64 // -1 if unknown
+
+	done       int64
+	lastDone   int64
+	lastUpdate time.Time
+	rate       float64
+	finished   bool
+}
+
+// statusProgress returns a progress wrapper that prints a status line for
+// label to stderr, or one that does nothing if quiet is set. total is the
+// expected number of bytes, or -1 if unknown.
+func statusProgress(label string, total int64) func(io.Reader) io.Reader {
+	if quiet {
+		return noProgress
+	}
+	return func(r io.Reader) io.Reader {
+		c := realClock{}
+		return &statusReader{
+			r:          r,
+			w:          os.Stderr,
+			clock:      c,
+			label:      label,
+			total:      total,
+			lastUpdate: c.Now(),
+		}
+	}
+}
+
+// chainProgress returns a progress wrapper applying each of wrappers in
+// turn.
+func chainProgress(wrappers ...func(io.Reader) io.Reader) func(io.Reader) io.Reader {
+	return func(r io.Reader) io.Reader {
+		for _, wrap := range wrappers {
+			r = wrap(r)
+		}
+		return r
+	}
+}
+
+func (sr *statusReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.done += int64(n)
+
+	now := sr.clock.Now()
+	if dt := now.Sub(sr.lastUpdate); dt >= statusInterval {
+		sample := float64(sr.done-sr.lastDone) / dt.Seconds()
+		if sr.rate == 0 {
+			sr.rate = sample
+		} else {
+			sr.rate = rateSmoothing*sample + (1-rateSmoothing)*sr.rate
+		}
+		sr.lastDone = sr.done
+		sr.lastUpdate = now
+		sr.print("\r")
+	}
+
+	if err == io.EOF && !sr.finished {
+		sr.finished = true
+		sr.print("\r")
+		fmt.Fprintf(sr.w, "\n")
+	}
+
+	return n, err
+}
+
+func (sr *statusReader) print(prefix string) {
+	line := fmt.Sprintf("%v: %v", sr.label, formatBytes(sr.done))
+	if sr.total >= 0 {
+		line += " / " + formatBytes(sr.total)
+	}
+	if sr.rate > 0 {
+		line += fmt.Sprintf(", %v/s", formatBytes(int64(sr.rate)))
+		if sr.total > sr.done {
+			eta := time.Duration(float64(sr.total-sr.done) / sr.rate * float64(time.Second))
+			line += ", ETA " + eta.Round(time.Second).String()
+		}
+	}
+	fmt.Fprintf(sr.w, "%v%-70v", prefix, line)
+}
+
+// batchProgress prints running totals of the files a maintenance command
+// has processed and their size, across the whole command rather than per
+// file. A nil batchProgress (as returned when quiet is set) prints nothing.
+type batchProgress struct {
+	w     io.Writer
+	clock clock
+	label string
+	total int // -1 if unknown
+
+	// totalBytes, if known, is the size of the whole batch, for estimating
+	// the time left.
+	totalBytes int64
+	start      time.Time
+
+	mu         sync.Mutex
+	files      int
+	bytes      int64
+	lastUpdate time.Time
+}
+
+// newBatchProgress returns a batchProgress for a batch of total files (or
+// -1 if unknown), labelled with label.
+func newBatchProgress(label string, total int) *batchProgress {
+	if quiet {
+		return nil
+	}
+	c := realClock{}
+	now := c.Now()
+	return &batchProgress{
+		w:          os.Stderr,
+		clock:      c,
+		label:      label,
+		total:      total,
+		start:      now,
+		lastUpdate: now,
+	}
+}
+
+// expectBytes sets the size of the whole batch, so that the time left can
+// be estimated from how fast it's going.
+func (bp *batchProgress) expectBytes(n int64) {
+	if bp == nil {
+		return
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.totalBytes = n
+}
+
+// add records one more file of size bytes as done. It's safe to call from
+// several goroutines.
+func (bp *batchProgress) add(size int64) {
+	if bp == nil {
+		return
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	bp.files++
+	bp.bytes += size
+	if now := bp.clock.Now(); now.Sub(bp.lastUpdate) >= statusInterval {
+		bp.lastUpdate = now
+		bp.print()
+	}
+}
+
+// finish prints the final totals.
+func (bp *batchProgress) finish() {
+	if bp == nil {
+		return
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	bp.print()
+	fmt.Fprintf(bp.w, "\n")
+}
+
+func (bp *batchProgress) print() {
+	line := fmt.Sprintf("%v: %v", bp.label, bp.files)
+	if bp.total >= 0 {
+		line += fmt.Sprintf(" / %v", bp.total)
+	}
+	line += fmt.Sprintf(" files, %v", formatBytes(bp.bytes))
+	if bp.totalBytes > 0 {
+		line += fmt.Sprintf(" / %v", formatBytes(bp.totalBytes))
+		if bp.bytes > 0 && bp.bytes < bp.totalBytes {
+			elapsed := bp.clock.Now().Sub(bp.start)
+			left := time.Duration(float64(elapsed) * float64(bp.totalBytes-bp.bytes) / float64(bp.bytes))
+			line += fmt.Sprintf(", about %v left", left/time.Second*time.Second)
+		}
+	}
+	fmt.Fprintf(bp.w, "\r%-70v", line)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
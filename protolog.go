@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/encryptio/go-git-annex-external/external"
+)
+
+// loggingHandler logs each protocol request handled by h (see logOp).
+type loggingHandler struct {
+	h *B2Ext
+}
+
+func fileSize(file string) int64 {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+func (lh loggingHandler) InitRemote(e *external.External) error {
+	start := time.Now()
+	err := lh.h.InitRemote(e)
+	logOp("INITREMOTE", "", "", 0, time.Since(start), err)
+	return err
+}
+
+func (lh loggingHandler) Prepare(e *external.External) error {
+	start := time.Now()
+	err := lh.h.Prepare(e)
+	logOp("PREPARE", "", "", 0, time.Since(start), err)
+	return err
+}
+
+func (lh loggingHandler) Store(e *external.External, key, file string) error {
+	start := time.Now()
+	err := lh.h.Store(e, key, file)
+	logOp("TRANSFER STORE", key, lh.objectName(key), fileSize(file), time.Since(start), err)
+	return err
+}
+
+func (lh loggingHandler) Retrieve(e *external.External, key, file string) error {
+	start := time.Now()
+	err := lh.h.Retrieve(e, key, file)
+	logOp("TRANSFER RETRIEVE", key, lh.objectName(key), fileSize(file), time.Since(start), err)
+	return err
+}
+
+func (lh loggingHandler) CheckPresent(e *external.External, key string) (bool, error) {
+	start := time.Now()
+	found, err := lh.h.CheckPresent(e, key)
+	logOp("CHECKPRESENT", key, lh.objectName(key), 0, time.Since(start), err)
+	return found, err
+}
+
+func (lh loggingHandler) Remove(e *external.External, key string) error {
+	start := time.Now()
+	err := lh.h.Remove(e, key)
+	logOp("REMOVE", key, lh.objectName(key), 0, time.Since(start), err)
+	return err
+}
+
+func (lh loggingHandler) GetCost(e *external.External) (int, error) {
+	return lh.h.GetCost(e)
+}
+
+func (lh loggingHandler) GetAvailability(e *external.External) (external.Availability, error) {
+	return lh.h.GetAvailability(e)
+}
+
+func (lh loggingHandler) WhereIs(e *external.External, key string) (string, error) {
+	start := time.Now()
+	where, err := lh.h.WhereIs(e, key)
+	logOp("WHEREIS", key, lh.objectName(key), 0, time.Since(start), err)
+	return where, err
+}
+
+// objectName returns the name of the object whose existence means key is
+// present, once the remote is set up.
+func (lh loggingHandler) objectName(key string) string {
+	if lh.h.bucket == nil {
+		return ""
+	}
+	return lh.h.presenceName(key)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// With atomicpublish=yes, store uploads each single-part object under a
+// temporary name, and then copies it to its real name inside B2 with
+// b2_copy_file, deleting the temporary object afterwards. The object at the
+// real name is only ever replaced by a finished, checked copy, for buckets
+// serving content to readers while it's being updated.
+
+// publishingName returns a new temporary name to upload an object to.
+func (bh *bucketHandle) publishingName() (string, error) {
+	id, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	return bh.publishPrefix + id, nil
+}
+
+// publish copies the uploaded file tmpID, called tmpName, to name, and
+// deletes it. sha is the SHA1 the copy must have.
+func (bh *bucketHandle) publish(tmpName, tmpID, name, sha string) error {
+	if tmpID == "" {
+		return fmt.Errorf("no file ID returned for %#v", tmpName)
+	}
+
+	copied, err := bh.copyFile(tmpID, name)
+	if err == nil && copied.sha1() != sha {
+		err = fmt.Errorf("copy has SHA1 %#v instead of %v", copied.sha1(), sha)
+	}
+
+	deleteErr := bh.call("delete file version", func() error {
+		_, err := bh.DeleteFileVersion(tmpName, tmpID)
+		return err
+	})
+	if deleteErr != nil {
+		fmt.Fprintf(os.Stderr, "Warning: couldn't delete temporary object %#v: %v\n", tmpName, deleteErr)
+	}
+
+	if err != nil {
+		return fmt.Errorf("uploaded %#v but couldn't publish it as %#v: %v", tmpName, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// The retrieveversion command downloads one specific version of a key,
+// given its file ID (as shown by b2 list-file-versions), for recovering
+// content that was overwritten or hidden. Retrieve always gets the latest
+// version, so this isn't part of the normal git-annex flow. The download is
+// checked against both the SHA1 B2 has for it and the key itself.
+
+// retrieveByID downloads the file version fileID into fh, which is
+// truncated first, and returns B2's description of it.
+func (bh *bucketHandle) retrieveByID(fileID string, fh *os.File) (*backblaze.File, error) {
+	var b2file *backblaze.File
+	err := bh.transfer("download file by id", func() error {
+		var (
+			rc  io.ReadCloser
+			err error
+		)
+		b2file, rc, err = bh.session.b2.DownloadFileByID(fileID)
+		if rc != nil {
+			defer rc.Close()
+		}
+		if err != nil {
+			return err
+		}
+		return bh.writeDownload(fileID, b2file, rc, fh, 0, noProgress)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if b2file == nil {
+		return nil, fmt.Errorf("no file info returned for %#v", fileID)
+	}
+	if b2file.BucketID != "" && b2file.BucketID != bh.ID {
+		return nil, fmt.Errorf("file %#v is in a different bucket", fileID)
+	}
+
+	if compressionOf(b2file) == "" && contentSHA1(b2file) != "" {
+		sum, err := hashFile(fh, sha1.New())
+		if err != nil {
+			return nil, err
+		}
+		if sum != contentSHA1(b2file) {
+			return nil, fmt.Errorf("downloaded %#v has SHA1 %v, but B2 has %v", fileID, sum, contentSHA1(b2file))
+		}
+	}
+
+	return b2file, nil
+}
+
+// hashFile returns the hex digest of the content of fh under h.
+func hashFile(fh io.ReadSeeker, h hash.Hash) (string, error) {
+	_, err := fh.Seek(0, 0)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(h, fh)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// keyHashes are the git-annex backends whose keys name the hash of their
+// content, and can be checked against it.
+var keyHashes = map[string]func() hash.Hash{
+	"MD5":    md5.New,
+	"SHA1":   sha1.New,
+	"SHA256": sha256.New,
+	"SHA512": sha512.New,
+}
+
+// parseKey splits a git-annex key (BACKEND-sSIZE-...--NAME) into its
+// backend, its size (or -1 if it has none) and its name.
+func parseKey(key string) (backend string, size int64, name string) {
+	size = -1
+	i := strings.Index(key, "--")
+	if i < 0 {
+		return "", -1, ""
+	}
+	fields, name := strings.Split(key[:i], "-"), key[i+2:]
+	for _, field := range fields[1:] {
+		if strings.HasPrefix(field, "s") {
+			if n, err := strconv.ParseInt(field[1:], 10, 64); err == nil {
+				size = n
+			}
+		}
+	}
+	return fields[0], size, name
+}
+
+// keyHash returns a new hash of the kind key's backend names, and the
+// digest (in hex) that key names, or ok false if the backend doesn't name
+// a hash of the content.
+func keyHash(key string) (h hash.Hash, want string, ok bool) {
+	backend, _, name := parseKey(key)
+	newHash, ok := keyHashes[strings.TrimSuffix(backend, "E")]
+	if !ok {
+		return nil, "", false
+	}
+
+	want = name
+	if strings.HasSuffix(backend, "E") {
+		// The name is the hash followed by the original file's extension.
+		if dot := strings.Index(name, "."); dot >= 0 {
+			want = name[:dot]
+		}
+	}
+	return newHash(), strings.ToLower(want), true
+}
+
+// checkKeyContent checks the content of fh against what key says about it:
+// its size, and its hash if the key's backend names one. It reports whether
+// the hash could be checked.
+func checkKeyContent(key string, fh io.ReadSeeker) (bool, error) {
+	_, size, _ := parseKey(key)
+	if size >= 0 {
+		length, err := fh.Seek(0, 2)
+		if err != nil {
+			return false, err
+		}
+		if length != size {
+			return false, fmt.Errorf("content is %v bytes, but key %v is %v bytes", length, key, size)
+		}
+	}
+
+	h, want, ok := keyHash(key)
+	if !ok {
+		return false, nil
+	}
+	sum, err := hashFile(fh, h)
+	if err != nil {
+		return false, err
+	}
+	if sum != want {
+		return false, fmt.Errorf("content hashes to %v, but the key names %v", sum, want)
+	}
+	return true, nil
+}
+
+func runRetrieveVersion(be *B2Ext, config argsConfig, args []string) error {
+	if len(args) != 3 {
+		return errors.New("usage: retrieveversion <key> <fileid> <file>")
+	}
+	key, fileID, file := args[0], args[1], args[2]
+	bh := be.bucket
+
+	fh, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	b2file, err := bh.retrieveByID(fileID, fh)
+	if err != nil {
+		os.Remove(file)
+		return fmt.Errorf("couldn't download %#v: %v", fileID, err)
+	}
+
+	// Refuse versions that can't be content of key, so that a mistyped
+	// file ID isn't taken for it.
+	if be.cas {
+		if !strings.HasPrefix(b2file.Name, be.casPrefix+"objects/") {
+			os.Remove(file)
+			return fmt.Errorf("%#v is a version of %#v, which doesn't hold key content", fileID, b2file.Name)
+		}
+	} else if b2file.Name != be.objectName(key) {
+		os.Remove(file)
+		return fmt.Errorf("%#v is a version of %#v, not of %#v", fileID, b2file.Name, be.objectName(key))
+	}
+
+	checked, err := checkKeyContent(key, fh)
+	if err != nil {
+		os.Remove(file)
+		return err
+	}
+	if !checked {
+		fmt.Fprintf(os.Stderr, "Warning: key %v doesn't name a hash of its content; only its size was checked\n", key)
+	}
+
+	err = fh.Close()
+	if err != nil {
+		return err
+	}
+
+	infof("Retrieved version %v of %v into %v", fileID, key, file)
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// The rename command gives a key's content a second key inside B2, for
+// git annex migrate: the content stays the same but the key changes, and
+// without this the remote would have to be sent it all over again. The
+// object is copied with b2_copy_file, so nothing is downloaded or uploaded,
+// and the old key can then be removed with --delete.
+
+// copyKey copies the object holding oldKey in bh to newKey's object name,
+// and returns the copy's size and SHA1.
+func (be *B2Ext) copyKey(bh *bucketHandle, oldKey, newKey string) (int64, string, error) {
+	name := be.objectName(oldKey)
+	found, fileID, err := bh.listFileCached(name)
+	if err != nil {
+		return 0, "", fmt.Errorf("couldn't list filenames: %v", err)
+	}
+	if !found {
+		return 0, "", fmt.Errorf("%v isn't in bucket %#v", oldKey, bh.name)
+	}
+
+	var b2file *backblaze.File
+	err = bh.call("get file info", func() (err error) {
+		b2file, err = bh.GetFileInfo(fileID)
+		return err
+	})
+	if err != nil {
+		return 0, "", fmt.Errorf("couldn't get file info for %#v: %v", fileID, err)
+	}
+	if b2file == nil {
+		return 0, "", fmt.Errorf("no file info returned for %#v", fileID)
+	}
+
+	target := be.objectName(newKey)
+	copied, err := bh.copyFile(fileID, target)
+	if err != nil {
+		return 0, "", fmt.Errorf("couldn't copy %#v to %#v: %v", name, target, err)
+	}
+	bh.bloom.add(target)
+
+	sha := contentSHA1(b2file)
+	if copied.sha1() != sha {
+		return 0, "", fmt.Errorf("copied %#v to %#v, but the copy has SHA1 %#v instead of %#v",
+			name, target, copied.sha1(), sha)
+	}
+	if sha == "" {
+		fmt.Fprintf(os.Stderr, "Warning: B2 has no SHA1 for %#v, so its copy couldn't be checked\n", name)
+	}
+
+	return copied.ContentLength, sha, nil
+}
+
+func runRename(be *B2Ext, config argsConfig, args []string) error {
+	deleteOld := hasFlag(args, "--delete")
+	var keys []string
+	for _, arg := range args {
+		if arg != "--delete" {
+			keys = append(keys, arg)
+		}
+	}
+	if len(keys) != 2 {
+		return errors.New("usage: rename <old key> <new key> [--delete]")
+	}
+	oldKey, newKey := keys[0], keys[1]
+
+	for _, key := range keys {
+		err := validateKey(key)
+		if err != nil {
+			return err
+		}
+	}
+	err := be.checkNameLengths(newKey)
+	if err != nil {
+		return err
+	}
+
+	if be.cas {
+		return errors.New("rename copies objects of the normal layout; with cas=yes, store the new key instead, which won't upload content the remote already has")
+	}
+	if _, oldSize, _ := parseKey(oldKey); oldSize >= 0 {
+		if _, newSize, _ := parseKey(newKey); newSize >= 0 && newSize != oldSize {
+			return fmt.Errorf("%v is %v bytes but %v is %v bytes, so they can't have the same content",
+				oldKey, oldSize, newKey, newSize)
+		}
+	}
+
+	// Copying needs to read the source as well as write the copy.
+	if canRead, known := be.bucket.session.hasCapability("readFiles"); known && !canRead {
+		return errors.New("the application key can't read files, which copying needs; store the new key instead")
+	}
+
+	buckets := []*bucketHandle{be.bucket}
+	if be.mirror != nil {
+		buckets = append(buckets, be.mirror)
+	}
+
+	for _, bh := range buckets {
+		if be.pack {
+			packed, err := bh.packs.present(oldKey)
+			if err != nil {
+				return err
+			}
+			if packed {
+				return fmt.Errorf("%v is packed (see pack=yes) and can't be copied; store the new key instead", oldKey)
+			}
+		}
+
+		size, sha, err := be.copyKey(bh, oldKey, newKey)
+		if err != nil {
+			return err
+		}
+
+		if be.manifest {
+			err = be.manifestRecord(bh, manifestEntry{key: newKey, size: size, sha: sha})
+			if err != nil {
+				return fmt.Errorf("copied %v but couldn't record it in the manifest: %v", newKey, err)
+			}
+		}
+		if bh == be.bucket {
+			err = be.journalRecord(journalStore, newKey, size, sha)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	infof("Copied %v to %v", oldKey, newKey)
+
+	if deleteOld {
+		err = be.Remove(nil, oldKey)
+		if err != nil {
+			return fmt.Errorf("copied %v but couldn't remove %v: %v", newKey, oldKey, err)
+		}
+		infof("Removed %v", oldKey)
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The repair command downloads each of the keys it's given from the bucket
+// and checks it, against B2's SHA1 and against the key itself. A key that
+// fails (or is missing) is healed if a good copy can be found elsewhere:
+// in the local cache (cachedir) or the mirror bucket. The good copy
+// replaces the bad object, exactly as Store would store it. Every key is
+// downloaded in full, so the keys to check are always listed explicitly,
+// typically from git annex find.
+
+// repairResult is what became of one key.
+type repairResult struct {
+	status string // "ok", "healed" or "unrecoverable"
+	detail string
+}
+
+// verifyKeyIn downloads key from bh into fh and checks it.
+func (be *B2Ext) verifyKeyIn(bh *bucketHandle, key string, fh *os.File) error {
+	err := fh.Truncate(0)
+	if err == nil {
+		_, err = fh.Seek(0, 0)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = be.catKey(bh, key, fh)
+	if err != nil {
+		return describeDownloadError(key, bh, err)
+	}
+	_, err = checkKeyContent(key, fh)
+	return err
+}
+
+// goodCopy looks for an intact copy of key in the cache and the mirror
+// bucket, writing it into fh, and returns where it came from.
+func (be *B2Ext) goodCopy(key string, fh *os.File) (string, error) {
+	var tried []string
+
+	if be.cache != nil {
+		hit, err := be.cache.get(be.cacheKey(key), fh)
+		if err == nil && hit {
+			_, err = checkKeyContent(key, fh)
+			if err == nil {
+				return "cache", nil
+			}
+		}
+		if err != nil {
+			tried = append(tried, fmt.Sprintf("cache: %v", err))
+		} else {
+			tried = append(tried, "cache: not cached")
+		}
+	}
+
+	if be.mirror != nil {
+		err := be.verifyKeyIn(be.mirror, key, fh)
+		if err == nil {
+			return fmt.Sprintf("mirror bucket %#v", be.mirror.name), nil
+		}
+		tried = append(tried, fmt.Sprintf("mirror: %v", err))
+	}
+
+	if len(tried) == 0 {
+		return "", errors.New("no cachedir or mirror to repair from")
+	}
+	return "", fmt.Errorf("no good copy (%v)", strings.Join(tried, "; "))
+}
+
+// repairKey checks key in the bucket and heals it if it can. Its content
+// passes through a file named after it in dir.
+func (be *B2Ext) repairKey(key, dir string) repairResult {
+	file := filepath.Join(dir, key)
+	fh, err := os.Create(file)
+	if err != nil {
+		return repairResult{"unrecoverable", err.Error()}
+	}
+	defer os.Remove(file)
+	defer fh.Close()
+
+	verifyErr := be.verifyKeyIn(be.bucket, key, fh)
+	if verifyErr == nil {
+		return repairResult{status: "ok"}
+	}
+
+	source, err := be.goodCopy(key, fh)
+	if err != nil {
+		return repairResult{"unrecoverable", fmt.Sprintf("%v; %v", verifyErr, err)}
+	}
+	err = fh.Close()
+	if err != nil {
+		return repairResult{"unrecoverable", err.Error()}
+	}
+
+	// The bad object goes first: it may carry the right SHA1, in which
+	// case storing would take it for a good copy and skip the upload.
+	err = be.removeKey(be.bucket, key)
+	if err == nil {
+		err = be.Store(nil, key, file)
+	}
+	if err != nil {
+		return repairResult{"unrecoverable", fmt.Sprintf("%v; couldn't store the copy from %v: %v", verifyErr, source, err)}
+	}
+	return repairResult{"healed", fmt.Sprintf("from %v (%v)", source, verifyErr)}
+}
+
+// repairKeys returns the keys named by args, where "-" reads them from
+// standard input, one per line.
+func repairKeys(args []string) ([]string, error) {
+	var keys []string
+	for _, arg := range args {
+		if arg != "-" {
+			keys = append(keys, arg)
+			continue
+		}
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if key := strings.TrimSpace(scanner.Text()); key != "" {
+				keys = append(keys, key)
+			}
+		}
+		err := scanner.Err()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read keys from standard input: %v", err)
+		}
+	}
+	return keys, nil
+}
+
+func runRepair(be *B2Ext, config argsConfig, args []string) error {
+	keys, err := repairKeys(args)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("usage: repair <key>... (or - to read keys from standard input)")
+	}
+	for _, key := range keys {
+		err := validateKey(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "git-annex-remote-b2-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	progress := newBatchProgress("Verifying keys", len(keys))
+	counts := make(map[string]int)
+	for _, key := range keys {
+		res := be.repairKey(key, dir)
+		counts[res.status]++
+		if res.status != "ok" {
+			fmt.Printf("%v\t%v\t%v\n", res.status, key, res.detail)
+		}
+		_, size, _ := parseKey(key)
+		if size < 0 {
+			size = 0
+		}
+		progress.add(size)
+	}
+	progress.finish()
+
+	infof("%v keys intact, %v healed, %v unrecoverable",
+		counts["ok"], counts["healed"], counts["unrecoverable"])
+	if counts["unrecoverable"] > 0 {
+		return fmt.Errorf("%v keys couldn't be repaired", counts["unrecoverable"])
+	}
+	return nil
+}
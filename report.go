@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// reportEntry is one line of the report command's output.
+type reportEntry struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	SHA1 string `json:"sha1,omitempty"`
+}
+
+// runReport prints a JSON object for each key stored in the bucket, for
+// comparing against git-annex's idea of what the remote holds.
+func runReport(be *B2Ext, config argsConfig, args []string) error {
+	bh := be.bucket
+	out := json.NewEncoder(os.Stdout)
+
+	if !be.cas {
+		err := bh.listNamesWithInfo(be.prefix, func(f rawFile) error {
+			key, ok := keyInPrefix(be.prefix, f.FileName)
+			if !ok {
+				return nil
+			}
+			return out.Encode(reportEntry{Key: key, Name: f.FileName, Size: f.ContentLength, SHA1: f.sha1()})
+		})
+		if err != nil || bh.packs == nil {
+			return err
+		}
+		return bh.packs.keys(func(ent packEntry, packName string) error {
+			return out.Encode(reportEntry{Key: ent.key, Name: packName, Size: ent.length, SHA1: ent.sha})
+		})
+	}
+
+	// In the content-addressed layout, objects are named by their SHA1,
+	// and their sizes come from one listing of all of them.
+	sizes := make(map[string]int64)
+	err := bh.listNames(be.casPrefix+"objects/", func(f backblaze.FileStatus) error {
+		sizes[f.Name] = int64(f.Size)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return be.storedKeys(bh, func(key, contentName string, size int64, sha string) error {
+		return out.Encode(reportEntry{Key: key, Name: contentName, Size: sizes[contentName], SHA1: sha})
+	})
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+type errorClass int
+
+const (
+	// errorFatal errors won't go away by retrying.
+	errorFatal errorClass = iota
+	// errorTransient errors are network trouble, rate limiting, or B2
+	// server-side failures, all of which are worth retrying.
+	errorTransient
+	// errorNotFound means the requested file or bucket doesn't exist.
+	errorNotFound
+	// errorAuth means the credentials were rejected or lack a capability.
+	errorAuth
+	// errorClockSkew means the local clock is too far off for B2 (or its
+	// TLS certificates) to be trusted. Retrying won't help until the clock
+	// is fixed.
+	errorClockSkew
+)
+
+// isClockSkew reports whether err is a symptom of a badly wrong local
+// clock: B2 rejecting a request's timestamp, or its certificate appearing
+// expired or not yet valid.
+func isClockSkew(err error) bool {
+	if err == nil {
+		return false
+	}
+	if b2err, ok := err.(*backblaze.B2Error); ok {
+		msg := strings.ToLower(b2err.Code + " " + b2err.Message)
+		return strings.Contains(msg, "timestamp") || strings.Contains(msg, "clock") ||
+			strings.Contains(msg, "skew")
+	}
+	return strings.Contains(err.Error(), "certificate has expired or is not yet valid")
+}
+
+// clockSkewError explains err, which isClockSkew says is caused by a wrong
+// clock, as such.
+func clockSkewError(err error) error {
+	return fmt.Errorf("%v (this usually means the system clock is wrong; it says %v. "+
+		"Set the correct time, or check that NTP is running)", err, time.Now().Format(time.RFC1123))
+}
+
+func classifyError(err error) errorClass {
+	if isClockSkew(err) {
+		return errorClockSkew
+	}
+	if isTransferTimeout(err) {
+		return errorFatal
+	}
+	if b2err, ok := err.(*backblaze.B2Error); ok {
+		switch {
+		case b2err.Status == 401 || b2err.Status == 403:
+			return errorAuth
+		case b2err.Status == 404:
+			return errorNotFound
+		case b2err.Status == 408 || b2err.Status == 429 || b2err.Status >= 500:
+			return errorTransient
+		default:
+			return errorFatal
+		}
+	}
+
+	if isNetworkError(err) {
+		return errorTransient
+	}
+
+	return errorFatal
+}
+
+var errRetryBudgetExhausted = errors.New("giving up: too many B2 failures during this run (retry budget exhausted)")
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+
+	// After this many successful operations in a row, the time spent
+	// retrying so far is forgiven.
+	retryBudgetResetSuccesses = 10
+
+	// Once the budget is exhausted, operations fail immediately for this
+	// long. After that they're let through again, to find out whether B2
+	// has recovered: a success restores the budget, and a failure exhausts
+	// it again at once.
+	retryExhaustedCooldown = time.Minute
+)
+
+// retrier retries operations that fail with errors its policy (see
+// retryon.go) calls retriable: by default, transient ones. It also keeps
+// a budget shared by every operation in the process: once too much time has
+// been spent waiting to retry, or too many operations in a row have failed,
+// B2 is assumed to be down and further operations fail immediately until
+// it's seen to be back.
+//
+// Waits of concurrent operations are charged to the budget once, as the
+// time during which any of them was waiting, and each operation counts as
+// one failure however many times it's retried, so that running transfers
+// concurrently doesn't use the budget up faster.
+type retrier struct {
+	maxRetries  int
+	budget      time.Duration
+	maxFailures int
+	policy      *retryPolicy
+	clock       clock
+
+	mu          sync.Mutex
+	spent       time.Duration
+	waitingTill time.Time
+	failures    int
+	successes   int
+	exhaustedAt time.Time
+	retryAfter  time.Time
+}
+
+func newRetrier(maxRetries int, budget time.Duration, maxFailures int, policy *retryPolicy) *retrier {
+	return &retrier{
+		maxRetries:  maxRetries,
+		budget:      budget,
+		maxFailures: maxFailures,
+		policy:      policy,
+		clock:       realClock{},
+	}
+}
+
+// do calls fn until it succeeds, fails with a non-retriable error, runs out
+// of retries, or the process-wide budget is exhausted. A nil retrier calls
+// fn exactly once.
+func (r *retrier) do(op string, fn func() error) error {
+	if r == nil {
+		return fn()
+	}
+
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		if r.isExhausted() {
+			return errRetryBudgetExhausted
+		}
+
+		err := fn()
+		if err == nil {
+			r.recordSuccess()
+			return nil
+		}
+		if !r.policy.retriable(err) {
+			return err
+		}
+
+		// The final attempt still counts as a failure, but isn't followed
+		// by a wait, so it costs none of the budget.
+		last := attempt >= r.maxRetries
+		wait := delay
+		if after := r.retryAfterWait(err); after > 0 {
+			wait = after
+		}
+		if last {
+			wait = 0
+		}
+		if !r.recordFailure(attempt == 0, wait) {
+			return fmt.Errorf("%v: %v", errRetryBudgetExhausted, err)
+		}
+		if last {
+			return err
+		}
+
+		debugf("%v failed (%v), retrying in %v", op, err, wait)
+		r.clock.Sleep(wait)
+
+		delay *= 2
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+// isExhausted reports whether operations should fail without being tried.
+func (r *retrier) isExhausted() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.exhaustedAt.IsZero() && since(r.clock, r.exhaustedAt) < retryExhaustedCooldown
+}
+
+func (r *retrier) recordSuccess() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failures = 0
+	r.successes++
+	if r.successes >= retryBudgetResetSuccesses || !r.exhaustedAt.IsZero() {
+		r.spent = 0
+		r.exhaustedAt = time.Time{}
+	}
+}
+
+// recordFailure counts a retriable failure which will be followed by a wait
+// of delay (0 if it won't be retried); first is set for the first failure
+// of an operation. It returns false if that exhausts the budget.
+func (r *retrier) recordFailure(first bool, delay time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.successes = 0
+	if first {
+		r.failures++
+	}
+
+	// Only the part of the wait that doesn't overlap with other
+	// operations' waits is charged.
+	now := r.clock.Now()
+	from := now
+	if r.waitingTill.After(from) {
+		from = r.waitingTill
+	}
+	till := now.Add(delay)
+	if till.After(from) {
+		r.spent += till.Sub(from)
+		r.waitingTill = till
+	}
+
+	// A failure while operations are being let through again after the
+	// budget ran out means B2 is still down.
+	if !r.exhaustedAt.IsZero() ||
+		(r.maxFailures > 0 && r.failures >= r.maxFailures) ||
+		(r.budget > 0 && r.spent > r.budget) {
+		r.exhaustedAt = now
+		return false
+	}
+	return true
+}
+
+// B2 may send a Retry-After header with 429 and 503 responses, saying how
+// many seconds to wait before trying again. go-backblaze doesn't pass
+// response headers on, so they're noted by retryAfterTransport (see
+// transport.go) as responses arrive, and apply to every operation: B2's
+// rate limits are per account, not per request.
+
+// noteRetryAfter records a Retry-After header value, either a number of
+// seconds or an HTTP date.
+func (r *retrier) noteRetryAfter(value string) {
+	if r == nil {
+		return
+	}
+
+	now := r.clock.Now()
+	var till time.Time
+	if secs, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && secs >= 0 {
+		till = now.Add(time.Duration(secs) * time.Second)
+	} else if t, err := http.ParseTime(value); err == nil {
+		till = t
+	} else {
+		debugf("ignoring unparseable Retry-After %#v", value)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if till.After(r.retryAfter) {
+		r.retryAfter = till
+	}
+}
+
+// retryAfterWait returns how long B2 last asked to be left alone for, if
+// err is a 429 or 503 response and that time hasn't passed yet.
+func (r *retrier) retryAfterWait(err error) time.Duration {
+	b2err, ok := err.(*backblaze.B2Error)
+	if !ok || (b2err.Status != 429 && b2err.Status != 503) {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if wait := r.retryAfter.Sub(r.clock.Now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// fakeClock is a clock that only moves when slept on, recording how long
+// each sleep was.
+type fakeClock struct {
+	realClock
+
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.sleeps = append(c.sleeps, d)
+}
+
+func newTestRetrier(t *testing.T, retries int, budget time.Duration, maxFailures int) (*retrier, *fakeClock) {
+	policy, err := parseRetryOn("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRetrier(retries, budget, maxFailures, policy)
+	c := newFakeClock()
+	r.clock = c
+	return r, c
+}
+
+var errTestUnavailable = &backblaze.B2Error{Status: 503, Code: "service_unavailable", Message: "injected by the test"}
+
+// Waits that overlap, as those of concurrent operations do, are charged to
+// the budget once.
+func TestRetryBudgetChargesOverlappingWaitsOnce(t *testing.T) {
+	r, c := newTestRetrier(t, 3, 15*time.Second, 0)
+
+	if !r.recordFailure(true, 10*time.Second) || !r.recordFailure(true, 10*time.Second) {
+		t.Fatalf("two concurrent 10s waits exhausted a 15s budget")
+	}
+	if r.spent != 10*time.Second {
+		t.Errorf("spent %v, want 10s", r.spent)
+	}
+
+	c.Sleep(10 * time.Second)
+	if r.recordFailure(true, 10*time.Second) {
+		t.Errorf("a third 10s wait, after the first two, didn't exhaust a 15s budget")
+	}
+}
+
+// An operation counts as one failure however often it's retried, and the
+// budget recovers once an operation succeeds after the cooldown.
+func TestRetryBudgetRecovers(t *testing.T) {
+	r, c := newTestRetrier(t, 3, 0, 2)
+
+	calls := 0
+	failing := func() error {
+		calls++
+		return errTestUnavailable
+	}
+
+	if err := r.do("op", failing); err != errTestUnavailable {
+		t.Fatalf("first failing operation returned %v", err)
+	}
+	if calls != 4 {
+		t.Errorf("first failing operation was tried %v times, want 4", calls)
+	}
+	if r.isExhausted() {
+		t.Fatalf("one failing operation exhausted the budget")
+	}
+
+	if err := r.do("op", failing); err == nil || err == errTestUnavailable {
+		t.Fatalf("second failing operation returned %v, want the budget to be exhausted", err)
+	}
+
+	calls = 0
+	if err := r.do("op", func() error { calls++; return nil }); err != errRetryBudgetExhausted || calls != 0 {
+		t.Fatalf("operation with the budget exhausted returned %v after %v calls", err, calls)
+	}
+
+	c.Sleep(retryExhaustedCooldown)
+	if err := r.do("op", func() error { calls++; return nil }); err != nil || calls != 1 {
+		t.Fatalf("operation after the cooldown returned %v after %v calls", err, calls)
+	}
+	if r.isExhausted() {
+		t.Fatalf("budget still exhausted after a success")
+	}
+	if err := r.do("op", failing); err != errTestUnavailable {
+		t.Errorf("failing operation after recovering returned %v", err)
+	}
+}
+
+// A failure while trying again after the cooldown exhausts the budget again
+// straight away.
+func TestRetryBudgetExhaustedAgain(t *testing.T) {
+	r, c := newTestRetrier(t, 3, 0, 1)
+
+	failing := func() error { return errTestUnavailable }
+	r.do("op", failing)
+	if !r.isExhausted() {
+		t.Fatalf("budget wasn't exhausted")
+	}
+
+	c.Sleep(retryExhaustedCooldown)
+	calls := 0
+	if err := r.do("op", func() error { calls++; return errTestUnavailable }); err == nil || calls != 1 {
+		t.Fatalf("operation after the cooldown returned %v after %v calls, want one failed call", err, calls)
+	}
+	if !r.isExhausted() {
+		t.Errorf("budget wasn't exhausted again")
+	}
+}
+
+// B2's Retry-After is waited for instead of the usual backoff.
+func TestRetryAfter(t *testing.T) {
+	f := newFakeB2(t)
+	be := newTestRemote(t, f)
+	c := newFakeClock()
+	be.retry.clock = c
+
+	f.throttle("b2_list_file_names", 429, "7")
+	f.throttle("b2_list_file_names", 503, "")
+	if _, err := be.CheckPresent(nil, testKey([]byte("absent"))); err != nil {
+		t.Fatalf("CheckPresent: %v", err)
+	}
+
+	want := []time.Duration{7 * time.Second, 2 * retryBaseDelay}
+	if len(c.sleeps) != len(want) || c.sleeps[0] != want[0] || c.sleeps[1] != want[1] {
+		t.Errorf("waited %v, want %v", c.sleeps, want)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// retryon chooses which failures are retried, as a comma-separated list of:
+//
+//	503         a B2 error with that HTTP status
+//	5xx         a B2 error with any status in that hundred
+//	network     a network error, or a download cut short
+//	text:...    an error whose message contains the text, ignoring case
+//	default     whatever is retried when retryon isn't set
+//
+// The default retries 408, 429, 5xx and network, as classifyError does.
+// Clock skew, and transfers that run past maxtransfertime, are never
+// retried, whatever retryon says, since waiting fixes neither.
+
+// retryPolicy is a parsed retryon setting. A nil retryPolicy retries what
+// classifyError calls transient.
+type retryPolicy struct {
+	builtin  bool
+	statuses map[int]bool
+	hundreds map[int]bool
+	network  bool
+	texts    []string
+}
+
+// parseRetryOn parses a retryon setting, returning nil if it's empty.
+func parseRetryOn(value string) (*retryPolicy, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	p := &retryPolicy{statuses: make(map[int]bool), hundreds: make(map[int]bool)}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		switch {
+		case item == "default":
+			p.builtin = true
+		case item == "network":
+			p.network = true
+		case strings.HasPrefix(item, "text:"):
+			text := strings.TrimSpace(strings.TrimPrefix(item, "text:"))
+			if text == "" {
+				return nil, fmt.Errorf("retryon: %#v has no text to match", item)
+			}
+			p.texts = append(p.texts, strings.ToLower(text))
+		case len(item) == 3 && strings.HasSuffix(item, "xx") && item[0] >= '1' && item[0] <= '5':
+			p.hundreds[int(item[0]-'0')] = true
+		default:
+			status, err := strconv.Atoi(item)
+			if err != nil || len(item) != 3 || status < 100 || status > 599 {
+				return nil, fmt.Errorf("retryon: %#v is not an HTTP status (like 503 or 5xx), \"network\", "+
+					"\"text:<message>\" or \"default\"", item)
+			}
+			p.statuses[status] = true
+		}
+	}
+	return p, nil
+}
+
+// retriable reports whether a request that failed with err should be
+// retried.
+func (p *retryPolicy) retriable(err error) bool {
+	if p == nil {
+		return classifyError(err) == errorTransient
+	}
+	if isClockSkew(err) || isTransferTimeout(err) {
+		return false
+	}
+	if p.builtin && classifyError(err) == errorTransient {
+		return true
+	}
+
+	if b2err, ok := err.(*backblaze.B2Error); ok {
+		if p.statuses[b2err.Status] || p.hundreds[b2err.Status/100] {
+			return true
+		}
+	} else if p.network && isNetworkError(err) {
+		return true
+	}
+
+	if len(p.texts) > 0 {
+		msg := strings.ToLower(err.Error())
+		for _, text := range p.texts {
+			if strings.Contains(msg, text) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isNetworkError reports whether err is the network failing, rather than
+// B2 answering with an error.
+func isNetworkError(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if _, ok := err.(*shortDownloadError); ok {
+		return true
+	}
+	return err == io.ErrUnexpectedEOF
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The store command stores a key whose content is read from standard
+// input, for ingesting content from a pipe without a file of it on disk.
+// B2 needs the SHA1 and length of an upload up front, so the content is
+// spooled to a temporary file first, and then stored exactly as Store
+// would store it. git-annex isn't told about the key.
+
+func runStore(be *B2Ext, config argsConfig, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: store <key> < content")
+	}
+	key := args[0]
+	err := validateKey(key)
+	if err != nil {
+		return err
+	}
+
+	// The spooled file is named after the key, like git-annex's object
+	// files, so that recordfilename looks up the work tree file for it.
+	dir, err := ioutil.TempDir("", "git-annex-remote-b2-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, key)
+
+	fh, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	n, err := io.Copy(fh, os.Stdin)
+	if err != nil {
+		return fmt.Errorf("couldn't read standard input: %v", err)
+	}
+
+	checked, err := checkKeyContent(key, fh)
+	if err != nil {
+		return fmt.Errorf("refusing to store standard input as %v: %v", key, err)
+	}
+	if !checked {
+		fmt.Fprintf(os.Stderr, "Warning: key %v doesn't name a hash of its content; only its size was checked\n", key)
+	}
+
+	err = fh.Close()
+	if err != nil {
+		return err
+	}
+
+	err = be.Store(nil, key, file)
+	if err != nil {
+		return err
+	}
+
+	found, err := be.present(be.bucket, key)
+	if err != nil {
+		return fmt.Errorf("stored %v, but couldn't check it's present: %v", key, err)
+	}
+	if !found {
+		return fmt.Errorf("stored %v, but it isn't present afterwards", key)
+	}
+
+	infof("Stored %v (%v) from standard input", key, formatBytes(n))
+	return nil
+}
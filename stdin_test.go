@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withStdin makes os.Stdin read data for the rest of the test.
+func withStdin(t *testing.T, data []byte) {
+	fh, err := os.Open(writeTestFile(t, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		fh.Close()
+	})
+	os.Stdin = fh
+}
+
+// Content stored from standard input by the store command is retrieved
+// just as it was read.
+func TestStoreFromStdin(t *testing.T) {
+	f := newFakeB2(t)
+	config := testRemoteConfig(t, f)
+	be := &B2Ext{}
+	if err := be.setup(config, true); err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("piped content "), 1000)
+	key := testKey(data)
+	withStdin(t, data)
+	if err := runStore(be, config, []string{key}); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	if f.latest("test-bucket", be.objectName(key)) == nil {
+		t.Fatalf("%v wasn't uploaded", key)
+	}
+
+	file := filepath.Join(t.TempDir(), "retrieved")
+	if err := be.Retrieve(nil, key, file); err != nil {
+		t.Fatalf("Retrieve: %v", err)
+	}
+	got, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("retrieved %v bytes that differ from the %v stored", len(got), len(data))
+	}
+}
+
+// Standard input that doesn't match the key isn't stored.
+func TestStoreFromStdinMismatch(t *testing.T) {
+	f := newFakeB2(t)
+	config := testRemoteConfig(t, f)
+	be := &B2Ext{}
+	if err := be.setup(config, true); err != nil {
+		t.Fatal(err)
+	}
+
+	key := testKey([]byte("expected content"))
+	withStdin(t, []byte("something else!!"))
+	f.resetCalls()
+	if err := runStore(be, config, []string{key}); err == nil {
+		t.Fatalf("store of mismatched content succeeded")
+	}
+	if n := f.callCount("upload"); n != 0 {
+		t.Errorf("uploaded %v times for mismatched content", n)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// configureTransport applies the remote's TLS and HTTP/2 settings to
+// http.DefaultTransport, which go-backblaze uses for all of its requests.
+// (The connection pool is sized later, by sizeConnectionPool, once the
+// concurrency settings are known.)
+func configureTransport(e configSource) error {
+	caCertFile, err := e.GetConfig("cacert")
+	if err != nil {
+		return err
+	}
+
+	insecureSkipVerify, err := getBoolConfig(e, "insecureskipverify")
+	if err != nil {
+		return err
+	}
+
+	// HTTP/2 is used by default; some proxies mishandle it.
+	useHTTP2 := true
+	if v, err := e.GetConfig("http2"); err != nil {
+		return err
+	} else if v != "" {
+		useHTTP2, err = getBoolConfig(e, "http2")
+		if err != nil {
+			return err
+		}
+	}
+
+	if caCertFile == "" && !insecureSkipVerify && useHTTP2 {
+		return nil
+	}
+
+	transport, ok := baseTransport()
+	if !ok {
+		return errors.New("can't configure the transport: http.DefaultTransport is not an *http.Transport")
+	}
+
+	if !useHTTP2 {
+		// A non-nil, empty TLSNextProto keeps the transport from
+		// negotiating HTTP/2.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		if transport.TLSClientConfig != nil {
+			// A transport that has already been used also offers "h2"
+			// when connecting, and the server would then expect it.
+			tlsConfig := transport.TLSClientConfig.Clone()
+			tlsConfig.NextProtos = nil
+			for _, proto := range transport.TLSClientConfig.NextProtos {
+				if proto != "h2" {
+					tlsConfig.NextProtos = append(tlsConfig.NextProtos, proto)
+				}
+			}
+			transport.TLSClientConfig = tlsConfig
+		}
+		debugf("HTTP/2 disabled; using HTTP/1.1")
+	}
+
+	if caCertFile == "" && !insecureSkipVerify {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+
+	if caCertFile != "" {
+		pem, err := ioutil.ReadFile(caCertFile)
+		if err != nil {
+			return fmt.Errorf("couldn't read cacert: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("cacert %v does not contain any PEM certificates", caCertFile)
+		}
+		tlsConfig.RootCAs = pool
+		debugf("trusting certificates from %v", caCertFile)
+	}
+
+	if insecureSkipVerify {
+		fmt.Fprintf(os.Stderr, "WARNING: insecureskipverify is set; TLS certificates will NOT be verified "+
+			"and your B2 credentials and data are exposed to anyone on the network path\n")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	transport.TLSClientConfig = tlsConfig
+	if useHTTP2 {
+		// Replacing the TLS config disables HTTP/2 unless it's asked for
+		// explicitly.
+		transport.ForceAttemptHTTP2 = true
+	}
+
+	return nil
+}
+
+// sizeConnectionPool makes http.DefaultTransport keep at least n idle
+// connections to each host, so that n concurrent transfers can each reuse
+// a connection instead of setting up a new one every time.
+func sizeConnectionPool(n int) {
+	transport, ok := baseTransport()
+	if !ok {
+		return
+	}
+	if transport.MaxIdleConnsPerHost < n {
+		transport.MaxIdleConnsPerHost = n
+	}
+}
+
+// baseTransport returns http.DefaultTransport as an *http.Transport, looking
+// through the downloadTransport that downloadendpoint puts in front of it,
+// and the retryAfterTransport.
+func baseTransport() (*http.Transport, bool) {
+	rt := http.DefaultTransport
+	if t, ok := rt.(*downloadTransport); ok {
+		rt = t.next
+	}
+	if t, ok := rt.(*retryAfterTransport); ok {
+		rt = t.next
+	}
+	transport, ok := rt.(*http.Transport)
+	return transport, ok
+}
+
+// retryAfterTransport passes the Retry-After headers of responses on to
+// the retrier.
+type retryAfterTransport struct {
+	next  http.RoundTripper
+	retry *retrier
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && (resp.StatusCode == 429 || resp.StatusCode == 503) {
+		if after := resp.Header.Get("Retry-After"); after != "" {
+			t.retry.noteRetryAfter(after)
+		}
+	}
+	return resp, err
+}
+
+// installRetryAfterTransport makes Retry-After headers go to retry. It goes
+// in front of the base transport, under the test transport and the
+// downloadTransport, which are installed after it.
+func installRetryAfterTransport(retry *retrier) {
+	rt := http.DefaultTransport
+	for {
+		switch t := rt.(type) {
+		case *retryAfterTransport:
+			t.retry = retry
+			return
+		case *downloadTransport:
+			rt = t.next
+		case *testTransport:
+			rt = t.next
+		default:
+			http.DefaultTransport = &retryAfterTransport{next: http.DefaultTransport, retry: retry}
+			return
+		}
+	}
+}
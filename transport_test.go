@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkHTTP2 downloads a 64MB key in four segments at once from a
+// server 20ms away, over TLS, with and without HTTP/2, reporting how many
+// connections each opened. HTTP/2 multiplexes the segments over one
+// connection, where HTTP/1.1 needs a connection (and a TLS handshake) for
+// each.
+func BenchmarkHTTP2(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4<<20)
+	key := testKey(data)
+
+	for _, http2 := range []string{"yes", "no"} {
+		b.Run("http2="+http2, func(b *testing.B) {
+			// configureTransport changes http.DefaultTransport in place,
+			// so give it a copy to change.
+			transport := http.DefaultTransport
+			b.Cleanup(func() { http.DefaultTransport = transport })
+			http.DefaultTransport = transport.(*http.Transport).Clone()
+
+			var conns int64
+			f := newUnstartedFakeB2(b)
+			f.latency = 20 * time.Millisecond
+			f.EnableHTTP2 = true
+			f.Config.ConnState = func(c net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					atomic.AddInt64(&conns, 1)
+				}
+			}
+			f.StartTLS()
+
+			cert := filepath.Join(b.TempDir(), "cert.pem")
+			block := &pem.Block{Type: "CERTIFICATE", Bytes: f.Certificate().Raw}
+			if err := ioutil.WriteFile(cert, pem.EncodeToMemory(block), 0600); err != nil {
+				b.Fatal(err)
+			}
+
+			be := newTestRemote(b, f, "http2="+http2, "cacert="+cert, "downloadconcurrency=4")
+			f.put("test-bucket", be.objectName(key), data, "", nil)
+			dir := b.TempDir()
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				file := filepath.Join(dir, fmt.Sprint(i))
+				if err := be.Retrieve(nil, key, file); err != nil {
+					b.Fatalf("Retrieve: %v", err)
+				}
+				b.StopTimer()
+				os.Remove(file)
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&conns)), "conns")
+		})
+	}
+}
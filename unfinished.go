@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Large file uploads interrupted by a crash leave unfinished large files
+// behind, whose uploaded parts are billed as storage until they're
+// cancelled. With cleanupunfinished set, Prepare cancels those older than
+// it under the remote's prefix.
+
+type unfinishedFile struct {
+	FileID          string `json:"fileId"`
+	FileName        string `json:"fileName"`
+	UploadTimestamp int64  `json:"uploadTimestamp"`
+}
+
+type unfinishedFileList struct {
+	Files      []unfinishedFile `json:"files"`
+	NextFileID *string          `json:"nextFileId"`
+}
+
+// maxUnfinishedPageSize is the most unfinished large files B2 lists in one
+// call.
+const maxUnfinishedPageSize = 100
+
+// listUnfinished calls fn for each unfinished large file whose name starts
+// with prefix.
+func (bh *bucketHandle) listUnfinished(prefix string, fn func(unfinishedFile) error) error {
+	var start *string
+	for {
+		args := map[string]interface{}{
+			"bucketId":     bh.ID,
+			"namePrefix":   prefix,
+			"maxFileCount": maxUnfinishedPageSize,
+		}
+		if start != nil {
+			args["startFileId"] = *start
+		}
+
+		var page unfinishedFileList
+		err := bh.list("list unfinished large files", func() error {
+			return bh.session.raw.call("b2_list_unfinished_large_files", args, &page)
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't list unfinished large files: %v", err)
+		}
+
+		for _, f := range page.Files {
+			err = fn(f)
+			if err != nil {
+				return err
+			}
+		}
+
+		if page.NextFileID == nil {
+			return nil
+		}
+		start = page.NextFileID
+	}
+}
+
+// cancelUnfinished cancels the unfinished large files in bh under any of
+// prefixes that were started more than age ago, and returns how many it
+// cancelled.
+func (bh *bucketHandle) cancelUnfinished(prefixes []string, age time.Duration) (int, error) {
+	cutoff := bh.clock.Now().Add(-age)
+	cancelled := 0
+
+	for _, prefix := range prefixes {
+		var stale []unfinishedFile
+		err := bh.listUnfinished(prefix, func(f unfinishedFile) error {
+			if time.Unix(0, f.UploadTimestamp*int64(time.Millisecond)).Before(cutoff) {
+				stale = append(stale, f)
+			}
+			return nil
+		})
+		if err != nil {
+			return cancelled, err
+		}
+
+		for _, f := range stale {
+			err := bh.call("cancel large file", func() error {
+				return bh.session.raw.call("b2_cancel_large_file", map[string]string{
+					"fileId": f.FileID,
+				}, nil)
+			})
+			if err != nil {
+				return cancelled, fmt.Errorf("couldn't cancel unfinished large file %v (%#v): %v", f.FileID, f.FileName, err)
+			}
+			debugf("cancelled unfinished large file %v (%#v)", f.FileID, f.FileName)
+			cancelled++
+		}
+	}
+
+	return cancelled, nil
+}
+
+// cleanupUnfinished cancels stale unfinished large files in every bucket.
+// It's best-effort: failures, such as a key without permission to list
+// them, are only warned about.
+func (be *B2Ext) cleanupUnfinished() {
+	prefixes := []string{be.prefix}
+	if be.cas && !strings.HasPrefix(be.casPrefix, be.prefix) {
+		prefixes = append(prefixes, be.casPrefix)
+	}
+
+	buckets := []*bucketHandle{be.bucket}
+	if be.mirror != nil {
+		buckets = append(buckets, be.mirror)
+	}
+
+	for _, bh := range buckets {
+		cancelled, err := bh.cancelUnfinished(prefixes, be.cleanupUnfinishedAge)
+		if cancelled > 0 {
+			infof("Cancelled %v unfinished large files older than %v in bucket %#v",
+				cancelled, be.cleanupUnfinishedAge, bh.name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: couldn't clean up unfinished large files in bucket %#v: %v\n",
+				bh.name, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/kothar/go-backblaze.v0"
+)
+
+// The usage command reports how much the remote stores. Measuring that
+// takes a listing of the whole prefix, so the result is saved in the bucket
+// and reused until it's older than usagettl.
+
+type usageReport struct {
+	objects int64
+	bytes   int64
+	at      time.Time
+}
+
+func (be *B2Ext) usageName() string {
+	return be.internalName("usage")
+}
+
+// measureUsage counts the latest versions of the objects the remote keeps
+// in bh, and their total size.
+func (be *B2Ext) measureUsage(bh *bucketHandle) (usageReport, error) {
+	report := usageReport{at: time.Now()}
+	count := func(f backblaze.FileStatus) error {
+		report.objects++
+		report.bytes += int64(f.Size)
+		return nil
+	}
+
+	err := bh.listNames(be.prefix, count)
+	if err != nil {
+		return usageReport{}, err
+	}
+	if be.cas && !strings.HasPrefix(be.casPrefix, be.prefix) {
+		err = bh.listNames(be.casPrefix, count)
+		if err != nil {
+			return usageReport{}, err
+		}
+	}
+
+	return report, nil
+}
+
+// savedUsage returns the usage last saved in bh, if there is any.
+func (be *B2Ext) savedUsage(bh *bucketHandle) (usageReport, bool) {
+	data, err := bh.getSmall(be.usageName())
+	if err != nil {
+		return usageReport{}, false
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return usageReport{}, false
+	}
+	objects, err1 := strconv.ParseInt(fields[0], 10, 64)
+	bytes, err2 := strconv.ParseInt(fields[1], 10, 64)
+	at, err3 := strconv.ParseInt(fields[2], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return usageReport{}, false
+	}
+
+	return usageReport{objects: objects, bytes: bytes, at: time.Unix(at, 0)}, true
+}
+
+func runUsage(be *B2Ext, config argsConfig, args []string) error {
+	ttl, err := getDurationConfig(config, "usagettl", time.Hour)
+	if err != nil {
+		return err
+	}
+
+	bh := be.bucket
+	report, ok := be.savedUsage(bh)
+	if !ok || time.Since(report.at) > ttl || hasFlag(args, "--refresh") {
+		report, err = be.measureUsage(bh)
+		if err != nil {
+			return err
+		}
+
+		data := fmt.Sprintf("%d %d %d\n", report.objects, report.bytes, report.at.Unix())
+		err = bh.putSmall(be.usageName(), []byte(data), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("%v objects, %v (%d bytes), as of %v\n",
+		report.objects, formatBytes(report.bytes), report.bytes, report.at.Format(time.RFC3339))
+	return nil
+}